@@ -0,0 +1,305 @@
+package godb
+
+import (
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+)
+
+// aggregate functions
+const (
+	AGG_COUNT = 1 // the rows, or the non-NULL values of a column
+	AGG_SUM   = 2
+	AGG_MIN   = 3
+	AGG_MAX   = 4
+	AGG_AVG   = 5 // a TYPE_FLOAT64
+)
+
+var aggNames = [...]string{AGG_COUNT: "count", AGG_SUM: "sum", AGG_MIN: "min", AGG_MAX: "max", AGG_AVG: "avg"}
+
+// an aggregate of a column over the rows of a group, named like `sum(age)`
+// in the output. the column of AGG_COUNT may be empty to count the rows.
+// NULLs are skipped and the aggregates of no values are NULL, except COUNT.
+type Agg struct {
+	Func int
+	Col  string
+}
+
+func (agg Agg) String() string {
+	col := agg.Col
+	if col == "" {
+		col = "*"
+	}
+	return fmt.Sprintf("%s(%s)", aggNames[agg.Func], col)
+}
+
+// one row per group: the group columns then the aggregates. a sorted input
+// is aggregated as it streams, a group at a time; otherwise the groups are
+// collected in a hash table and output in the order they are first seen.
+// without group columns the whole input is a single group, even if empty.
+type aggNode struct {
+	input   planNode
+	groupBy []string
+	aggs    []Agg
+	types   []uint32 // of the aggregates
+	sorted  bool     // the input comes grouped
+}
+
+// the running aggregates of a group
+type aggGroup struct {
+	key   []Value
+	count []int64
+	sum   []int64
+	best  []Value // MIN or MAX
+}
+
+func planAggregate(input planNode, q *Query) (planNode, error) {
+	cols, types := input.schema()
+	for i, col := range q.GroupBy {
+		if !slices.Contains(cols, col) || slices.Index(q.GroupBy, col) != i {
+			return nil, fmt.Errorf("bad group column %q", col)
+		}
+	}
+	node := &aggNode{input: input, groupBy: q.GroupBy, aggs: q.Aggs}
+	for _, agg := range q.Aggs {
+		idx := slices.Index(cols, agg.Col)
+		switch {
+		case agg.Func < AGG_COUNT || agg.Func > AGG_AVG:
+			return nil, fmt.Errorf("bad aggregate function %d", agg.Func)
+		case agg.Func == AGG_COUNT && agg.Col == "":
+		case idx < 0:
+			return nil, fmt.Errorf("unknown column %s", agg.Col)
+		case (agg.Func == AGG_SUM || agg.Func == AGG_AVG) && types[idx] != TYPE_INT64:
+			return nil, fmt.Errorf("%s of a non-integer column", agg)
+		}
+		switch agg.Func {
+		case AGG_COUNT, AGG_SUM:
+			node.types = append(node.types, TYPE_INT64)
+		case AGG_AVG:
+			node.types = append(node.types, TYPE_FLOAT64)
+		default:
+			node.types = append(node.types, types[idx])
+		}
+	}
+	order, fixed := input.order()
+	node.sorted = groupedBy(order, fixed, q.GroupBy)
+
+	outCols, outTypes := node.schema()
+	if err := checkConds(outCols, outTypes, q.Having); err != nil {
+		return nil, err
+	}
+	if len(q.Having) == 0 {
+		return node, nil
+	}
+	return &filterNode{input: node, conds: q.Having}, nil
+}
+
+// whether rows sorted by the columns of `order`, whose first `fixed` are
+// constant, come grouped by the columns of `groupBy`
+func groupedBy(order []string, fixed int, groupBy []string) bool {
+	need := len(groupBy)
+	for i, col := range order {
+		if need == 0 {
+			break
+		}
+		switch {
+		case slices.Contains(groupBy, col):
+			need--
+		case i < fixed:
+			// a constant column doesn't split the groups
+		default:
+			return false
+		}
+	}
+	return need == 0
+}
+
+func (node *aggNode) rows(tree *BTree) iter.Seq[Record] {
+	if node.sorted {
+		return node.streamRows(tree)
+	}
+	return node.hashRows(tree)
+}
+
+func (node *aggNode) streamRows(tree *BTree) iter.Seq[Record] {
+	return func(yield func(Record) bool) {
+		var group *aggGroup
+		for rec := range node.input.rows(tree) {
+			key := groupKey(rec, node.groupBy)
+			if group != nil && !slices.EqualFunc(group.key, key, sameValue) {
+				if !yield(node.result(group)) {
+					return
+				}
+				group = nil
+			}
+			if group == nil {
+				group = node.newGroup(key)
+			}
+			node.add(group, rec)
+		}
+		if group == nil && len(node.groupBy) == 0 {
+			group = node.newGroup(nil)
+		}
+		if group != nil {
+			yield(node.result(group))
+		}
+	}
+}
+
+func (node *aggNode) hashRows(tree *BTree) iter.Seq[Record] {
+	return func(yield func(Record) bool) {
+		groups := map[string]*aggGroup{}
+		var seen []*aggGroup
+		for rec := range node.input.rows(tree) {
+			key := groupKey(rec, node.groupBy)
+			hash := string(hashKey(key))
+			group := groups[hash]
+			if group == nil {
+				group = node.newGroup(key)
+				groups[hash] = group
+				seen = append(seen, group)
+			}
+			node.add(group, rec)
+		}
+		for _, group := range seen {
+			if !yield(node.result(group)) {
+				return
+			}
+		}
+	}
+}
+
+// the values of the group columns of a row
+func groupKey(rec Record, groupBy []string) []Value {
+	key := make([]Value, len(groupBy))
+	for i, col := range groupBy {
+		key[i] = *rec.Get(col)
+	}
+	return key
+}
+
+// NULLs are in the same group
+func sameValue(a Value, b Value) bool {
+	return a.Type == b.Type && (a.Type == TYPE_NULL || cmpValue(a, b) == 0)
+}
+
+// the group values as a map key, tagged with the types for the NULLs
+func hashKey(key []Value) []byte {
+	var out []byte
+	for _, v := range key {
+		out = append(out, byte(v.Type))
+		if v.Type != TYPE_NULL {
+			out = encodeValues(out, []Value{v})
+		}
+	}
+	return out
+}
+
+func (node *aggNode) newGroup(key []Value) *aggGroup {
+	n := len(node.aggs)
+	return &aggGroup{key: key, count: make([]int64, n), sum: make([]int64, n), best: make([]Value, n)}
+}
+
+func (node *aggNode) add(group *aggGroup, rec Record) {
+	for i, agg := range node.aggs {
+		if agg.Col == "" {
+			group.count[i]++
+			continue
+		}
+		v := *rec.Get(agg.Col)
+		if v.Type == TYPE_NULL {
+			continue
+		}
+		group.count[i]++
+		switch agg.Func {
+		case AGG_SUM, AGG_AVG:
+			group.sum[i] += v.I64
+		case AGG_MIN:
+			if group.count[i] == 1 || cmpValue(v, group.best[i]) < 0 {
+				group.best[i] = v
+			}
+		case AGG_MAX:
+			if group.count[i] == 1 || cmpValue(v, group.best[i]) > 0 {
+				group.best[i] = v
+			}
+		}
+	}
+}
+
+func (node *aggNode) result(group *aggGroup) Record {
+	cols, _ := node.schema()
+	rec := Record{Cols: cols, Vals: slices.Clone(group.key)}
+	for i, agg := range node.aggs {
+		var v Value // NULL
+		switch {
+		case agg.Func == AGG_COUNT:
+			v = Value{Type: TYPE_INT64, I64: group.count[i]}
+		case group.count[i] == 0:
+		case agg.Func == AGG_SUM:
+			v = Value{Type: TYPE_INT64, I64: group.sum[i]}
+		case agg.Func == AGG_AVG:
+			v = Value{Type: TYPE_FLOAT64, F64: float64(group.sum[i]) / float64(group.count[i])}
+		default:
+			v = group.best[i]
+		}
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec
+}
+
+func (node *aggNode) explain() (string, []planNode) {
+	kind := "HashAggregate"
+	if node.sorted {
+		kind = "StreamAggregate"
+	}
+	var aggs []string
+	for _, agg := range node.aggs {
+		aggs = append(aggs, agg.String())
+	}
+	line := kind + " " + strings.Join(node.groupBy, ", ")
+	switch {
+	case len(node.groupBy) == 0:
+		line = kind + " " + strings.Join(aggs, ", ")
+	case len(aggs) > 0:
+		line += ": " + strings.Join(aggs, ", ")
+	}
+	return line, []planNode{node.input}
+}
+
+func (node *aggNode) schema() ([]string, []uint32) {
+	cols, types := node.input.schema()
+	var outCols []string
+	var outTypes []uint32
+	for _, col := range node.groupBy {
+		outCols = append(outCols, col)
+		outTypes = append(outTypes, types[slices.Index(cols, col)])
+	}
+	for i, agg := range node.aggs {
+		outCols = append(outCols, agg.String())
+		outTypes = append(outTypes, node.types[i])
+	}
+	return outCols, outTypes
+}
+
+// the groups come in the order of the input if it is grouped
+func (node *aggNode) order() ([]string, int) {
+	if !node.sorted {
+		return nil, 0
+	}
+	order, fixed := node.input.order()
+	var cols []string
+	outFixed := 0
+	for i, col := range order {
+		if len(cols) == len(node.groupBy) {
+			break
+		}
+		if slices.Contains(node.groupBy, col) {
+			cols = append(cols, col)
+			if i < fixed {
+				outFixed++
+			}
+		}
+	}
+	return cols, outFixed
+}
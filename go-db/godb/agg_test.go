@@ -0,0 +1,186 @@
+package godb
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExplainAggregate(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	createPeople(t, db)
+	count := Agg{Func: AGG_COUNT}
+	cases := []struct {
+		q      Query
+		expect string
+	}{
+		// the primary key order doesn't group the cities
+		{Query{GroupBy: []string{"city"}, Aggs: []Agg{count, {AGG_AVG, "age"}}},
+			"HashAggregate city: count(*), avg(age)\n  Scan people"},
+		{Query{Where: []Cond{strCond("city", OP_GT, "m")}, GroupBy: []string{"city"}, Aggs: []Agg{{AGG_MAX, "age"}}},
+			`StreamAggregate city: max(age)
+  IndexRange people(city, age, id) city > "m"`},
+		// the city is constant, the index is sorted by the age
+		{Query{Where: []Cond{strCond("city", OP_EQ, "oslo")}, GroupBy: []string{"age"}, Aggs: []Agg{count}},
+			`StreamAggregate age: count(*)
+  IndexRange people(city, age, id) city = "oslo"`},
+		{Query{Where: []Cond{intCond("id", OP_LT, 10)}, Aggs: []Agg{count, {AGG_SUM, "age"}}},
+			"StreamAggregate count(*), sum(age)\n  PKRange people(id) id < 10"},
+		{Query{Where: []Cond{strCond("name", OP_EQ, "ann")}, GroupBy: []string{"city"}},
+			`HashAggregate city
+  IndexRange people(name, id) name = "ann"`},
+		{Query{GroupBy: []string{"id"}, Aggs: []Agg{{AGG_MIN, "name"}}, Having: []Cond{strCond("min(name)", OP_GE, "b")}},
+			`Filter min(name) >= "b"
+  StreamAggregate id: min(name)
+    Scan people`},
+	}
+	for _, c := range cases {
+		c.q.Table = "people"
+		got, err := db.Explain(&c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(got) != c.expect {
+			t.Fatalf("%v:\n%s\nexpect:\n%s", c.q, got, c.expect)
+		}
+	}
+
+	for _, q := range []Query{
+		{GroupBy: []string{"nope"}},
+		{GroupBy: []string{"city", "city"}},
+		{Aggs: []Agg{{AGG_SUM, "name"}}},
+		{Aggs: []Agg{{AGG_MAX, ""}}},
+		{Aggs: []Agg{{9, "age"}}},
+		{Aggs: []Agg{count}, Having: []Cond{intCond("count(age)", OP_GT, 1)}},
+		{Aggs: []Agg{count}, Having: []Cond{strCond("count(*)", OP_GT, "1")}},
+	} {
+		q.Table = "people"
+		if _, err := db.Explain(&q); err == nil {
+			t.Fatalf("%v: planned", q)
+		}
+	}
+}
+
+// the groups of every plan are those computed from all rows
+func TestAggregateMatchesBruteForce(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	rows := fillPeople(t, db, 500)
+	r := rand.New(rand.NewSource(3))
+	aggs := []Agg{
+		{AGG_COUNT, ""}, {AGG_COUNT, "name"}, {AGG_SUM, "age"},
+		{AGG_MIN, "age"}, {AGG_MAX, "name"}, {AGG_AVG, "age"},
+	}
+	for i := 0; i < 300; i++ {
+		q := Query{Table: "people", Aggs: aggs}
+		switch r.Intn(4) {
+		case 0:
+			q.Where = []Cond{strCond("city", OP_EQ, []string{"oslo", "rome", "x"}[r.Intn(3)])}
+		case 1:
+			q.Where = []Cond{strCond("city", OP_GE, "p")}
+		case 2:
+			q.Where = []Cond{intCond("id", OP_LT, int64(r.Intn(600)))}
+		}
+		for _, col := range []string{"city", "age", "name"} {
+			if r.Intn(2) == 0 {
+				q.GroupBy = append(q.GroupBy, col)
+			}
+		}
+		r.Shuffle(len(q.GroupBy), func(i, j int) { q.GroupBy[i], q.GroupBy[j] = q.GroupBy[j], q.GroupBy[i] })
+		if r.Intn(3) == 0 {
+			q.Having = []Cond{intCond("count(*)", OP_GT, 1)}
+		}
+
+		got, err := db.Query(&q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := bruteAggregate(rows, &q)
+		if sortGroups(got) != sortGroups(expect) {
+			plan, _ := db.Explain(&q)
+			t.Fatalf("%v:\n%s\nexpect:\n%s\n%s", q, sortGroups(got), sortGroups(expect), plan)
+		}
+	}
+}
+
+func bruteAggregate(rows []Record, q *Query) []Record {
+	groups := map[string][]Record{}
+	var keys []string
+	for _, rec := range rows {
+		if !matchAll(rec, q.Where) {
+			continue
+		}
+		key := fmt.Sprint(groupKey(rec, q.GroupBy))
+		if groups[key] == nil {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], rec)
+	}
+	if len(q.GroupBy) == 0 && len(keys) == 0 {
+		keys = append(keys, "")
+	}
+	var out []Record
+	for _, key := range keys {
+		members := groups[key]
+		rec := Record{}
+		if len(members) > 0 {
+			for i, v := range groupKey(members[0], q.GroupBy) {
+				rec.Cols = append(rec.Cols, q.GroupBy[i])
+				rec.Vals = append(rec.Vals, v)
+			}
+		}
+		for _, agg := range q.Aggs {
+			var v Value
+			var vals []Value
+			for _, m := range members {
+				if agg.Col == "" {
+					vals = append(vals, Value{})
+				} else {
+					vals = append(vals, *m.Get(agg.Col))
+				}
+			}
+			switch agg.Func {
+			case AGG_COUNT:
+				v = Value{Type: TYPE_INT64, I64: int64(len(vals))}
+			case AGG_SUM, AGG_AVG:
+				if len(vals) == 0 {
+					break
+				}
+				sum := int64(0)
+				for _, x := range vals {
+					sum += x.I64
+				}
+				v = Value{Type: TYPE_INT64, I64: sum}
+				if agg.Func == AGG_AVG {
+					v = Value{Type: TYPE_FLOAT64, F64: float64(sum) / float64(len(vals))}
+				}
+			case AGG_MIN:
+				if len(vals) > 0 {
+					v = slices.MinFunc(vals, cmpValue)
+				}
+			case AGG_MAX:
+				if len(vals) > 0 {
+					v = slices.MaxFunc(vals, cmpValue)
+				}
+			}
+			rec.Cols = append(rec.Cols, agg.String())
+			rec.Vals = append(rec.Vals, v)
+		}
+		if matchAll(rec, q.Having) {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// the groups as sorted text, the plans output them in different orders
+func sortGroups(rows []Record) string {
+	var lines []string
+	for _, rec := range rows {
+		lines = append(lines, fmt.Sprint(rec))
+	}
+	slices.Sort(lines)
+	return strings.Join(lines, "\n")
+}
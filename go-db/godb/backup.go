@@ -0,0 +1,214 @@
+package godb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+)
+
+const DUMP_SIG = "GODBDUMP"
+const DUMP_VERSION = 1
+
+// the portable dump format, all integers are little-endian:
+// | sig | version | codec | comparator | record... | end mark | nrecords |
+// | 8B  |   4B    |  4B   |    32B     |           |    4B    |    8B    |
+//
+// a record is a length-prefixed KV:
+// | klen | vlen | key | val |
+// |  4B  |  4B  | ... | ... |
+//
+// the end mark is a klen of 0xffffffff; records are in the key order of the
+// database, so a dump is restored with the comparator it was taken with,
+// whose name is zero-padded as in the master page.
+//
+// the KVs are raw: values in their envelope and the internal keys (see
+// ttl.go). the restored file is created with the codec of the dump.
+
+const dumpEndMark = 0xffffffff
+
+// stream a consistent snapshot of the database to w;
+// writers can carry on while the pinned root is being dumped
+func (db *DB) Backup(w io.Writer) (int, error) {
+	tree := db.pin()
+	defer db.unpin(tree.store)
+
+	bw := bufio.NewWriter(w)
+	var hdr [16 + CMP_NAME_MAX]byte
+	copy(hdr[:8], DUMP_SIG)
+	binary.LittleEndian.PutUint32(hdr[8:], DUMP_VERSION)
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(db.opts.Codec))
+	if tree.cmp != nil {
+		copy(hdr[16:], db.opts.Comparator.Name)
+	}
+	if _, err := bw.Write(hdr[:]); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for iter := tree.SeekLE(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if len(key) == 0 {
+			continue // the dummy key
+		}
+		var lens [8]byte
+		binary.LittleEndian.PutUint32(lens[0:], uint32(len(key)))
+		binary.LittleEndian.PutUint32(lens[4:], uint32(len(val)))
+		if _, err := bw.Write(lens[:]); err != nil {
+			return count, err
+		}
+		if _, err := bw.Write(key); err != nil {
+			return count, err
+		}
+		if _, err := bw.Write(val); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	var end [12]byte
+	binary.LittleEndian.PutUint32(end[0:], dumpEndMark)
+	binary.LittleEndian.PutUint64(end[4:], uint64(count))
+	if _, err := bw.Write(end[:]); err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
+
+// rebuild a fresh database file at path from a dump, `opts` can be nil;
+// the file is only created if the whole dump is valid. it keeps the codec
+// of the dump unless `opts` has one, and the comparator of the dump, which
+// must be given unless it's a built-in one.
+func Restore(path string, r io.Reader, opts *Options) (int, error) {
+	if _, err := os.Stat(path); err == nil {
+		return 0, fmt.Errorf("restore: %s already exists", path)
+	}
+	dr := &dumpReader{r: bufio.NewReader(r)}
+	if err := dr.header(); err != nil {
+		return 0, fmt.Errorf("restore: %w", err)
+	}
+	var dbOpts Options
+	if opts != nil {
+		dbOpts = *opts
+	}
+	if dbOpts.Codec == CODEC_NONE {
+		dbOpts.Codec = dr.codec
+	}
+	cmp, err := comparatorMatch(dbOpts.Comparator, dr.cmpName, "dump")
+	if err != nil {
+		return 0, fmt.Errorf("restore: %w", err)
+	}
+	dbOpts.Comparator = cmp
+
+	tmp := path + ".restore"
+	_ = os.Remove(tmp) // left over from a failed restore
+	db, err := Open(tmp, &dbOpts)
+	if err != nil {
+		return 0, err
+	}
+	count, err := restoreInto(db, dr)
+	db.Close()
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, fmt.Errorf("restore: %w", err)
+	}
+	return count, nil
+}
+
+// bulk load the records of a dump into an empty database
+func restoreInto(db *DB, dr *dumpReader) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.tree.BulkLoad(dr.all()); err != nil {
+		return 0, err
+	}
+	if dr.err != nil {
+		return 0, dr.err
+	}
+	// a commit of the new history of the file, see repl.go
+	db.seq++
+	return dr.count, updateOrRevert(db, 0)
+}
+
+// decodes the records of a dump
+type dumpReader struct {
+	r       *bufio.Reader
+	err     error
+	count   int
+	codec   int
+	cmpName string
+}
+
+func (dr *dumpReader) header() error {
+	var hdr [16 + CMP_NAME_MAX]byte
+	if _, err := io.ReadFull(dr.r, hdr[:]); err != nil {
+		return fmt.Errorf("read dump header: %w", err)
+	}
+	if string(hdr[:8]) != DUMP_SIG {
+		return errors.New("not a dump")
+	}
+	if version := binary.LittleEndian.Uint32(hdr[8:]); version != DUMP_VERSION {
+		return fmt.Errorf("unsupported dump version %d", version)
+	}
+	dr.codec = int(binary.LittleEndian.Uint32(hdr[12:]))
+	dr.cmpName = string(bytes.TrimRight(hdr[16:], "\x00"))
+	return checkCodec(dr.codec)
+}
+
+// iterate over the records until the end mark; errors are left in dr.err
+func (dr *dumpReader) all() iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for {
+			key, val, err := dr.next()
+			if err != nil {
+				dr.err = err
+				return
+			}
+			if key == nil {
+				return // end mark
+			}
+			if !yield(key, val) {
+				return
+			}
+		}
+	}
+}
+
+// read a record, the key is nil at the end mark
+func (dr *dumpReader) next() ([]byte, []byte, error) {
+	var lens [8]byte
+	if _, err := io.ReadFull(dr.r, lens[:4]); err != nil {
+		return nil, nil, fmt.Errorf("truncated dump: %w", err)
+	}
+	klen := binary.LittleEndian.Uint32(lens[0:])
+	if klen == dumpEndMark {
+		if _, err := io.ReadFull(dr.r, lens[:]); err != nil {
+			return nil, nil, fmt.Errorf("truncated dump: %w", err)
+		}
+		if n := binary.LittleEndian.Uint64(lens[:]); n != uint64(dr.count) {
+			return nil, nil, fmt.Errorf("dump has %d records, expect %d", dr.count, n)
+		}
+		return nil, nil, nil
+	}
+
+	if _, err := io.ReadFull(dr.r, lens[4:]); err != nil {
+		return nil, nil, fmt.Errorf("truncated dump: %w", err)
+	}
+	vlen := binary.LittleEndian.Uint32(lens[4:])
+	if klen == 0 || klen > BTREE_MAX_KEY_SIZE || vlen > BTREE_MAX_VAL_SIZE {
+		return nil, nil, fmt.Errorf("record #%d: bad KV size %d, %d", dr.count, klen, vlen)
+	}
+	kv := make([]byte, klen+vlen)
+	if _, err := io.ReadFull(dr.r, kv); err != nil {
+		return nil, nil, fmt.Errorf("truncated dump: %w", err)
+	}
+	dr.count++
+	return kv[:klen], kv[klen:], nil
+}
@@ -0,0 +1,119 @@
+package godb_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"db.com/m/godb"
+	"db.com/m/godbtest"
+)
+
+// open a file left by Restore
+func openRestored(t *testing.T, path string) *godb.DB {
+	t.Helper()
+	db, err := godb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestBackupRestore(t *testing.T) {
+	db := godbtest.Open(t, nil)
+	ref := godbtest.Fill(t, db, 5000)
+
+	var dump bytes.Buffer
+	count, err := db.Backup(&dump)
+	if err != nil || count != len(ref) {
+		t.Fatalf("Backup: %d, %v", count, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "dst.db")
+	count, err = godb.Restore(path, bytes.NewReader(dump.Bytes()), nil)
+	if err != nil || count != len(ref) {
+		t.Fatalf("Restore: %d, %v", count, err)
+	}
+	restored := openRestored(t, path)
+	if err := restored.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	godbtest.Check(t, restored, ref)
+
+	// the restored file is a normal database
+	if err := restored.Set([]byte("new"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := godb.Restore(path, bytes.NewReader(dump.Bytes()), nil); err == nil {
+		t.Fatal("restore should not overwrite a file")
+	}
+}
+
+// a writer that updates the database while the dump is being written
+type writeDuring struct {
+	bytes.Buffer
+	update func()
+}
+
+func (w *writeDuring) Write(p []byte) (int, error) {
+	if w.update != nil {
+		w.update()
+		w.update = nil
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestBackupIsConsistent(t *testing.T) {
+	db := godbtest.Open(t, nil)
+	ref := godbtest.Fill(t, db, 3000)
+
+	w := &writeDuring{update: func() {
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("key%06d", i)
+			if err := db.Set([]byte(key), []byte("changed")); err != nil {
+				t.Error(err)
+			}
+			if _, err := db.Del([]byte(fmt.Sprintf("key%06d", i+1))); err != nil {
+				t.Error(err)
+			}
+		}
+	}}
+	if _, err := db.Backup(w); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "dst.db")
+	if _, err := godb.Restore(path, &w.Buffer, nil); err != nil {
+		t.Fatal(err)
+	}
+	godbtest.Check(t, openRestored(t, path), ref) // the pinned root
+}
+
+func TestRestoreBadDump(t *testing.T) {
+	db := godbtest.Open(t, nil)
+	godbtest.Fill(t, db, 100)
+	var dump bytes.Buffer
+	if _, err := db.Backup(&dump); err != nil {
+		t.Fatal(err)
+	}
+	data := dump.Bytes()
+
+	bad := map[string][]byte{
+		"empty":     nil,
+		"signature": append([]byte("NOTADUMP"), data[8:]...),
+		"truncated": data[:len(data)/2],
+		"no end":    data[:len(data)-12],
+		"count":     append(append([]byte{}, data[:len(data)-8]...), 1, 0, 0, 0, 0, 0, 0, 0),
+	}
+	for name, input := range bad {
+		path := filepath.Join(t.TempDir(), "dst.db")
+		if _, err := godb.Restore(path, bytes.NewReader(input), nil); err == nil {
+			t.Fatalf("%s: bad dump accepted", name)
+		}
+		if matches, _ := filepath.Glob(path + "*"); len(matches) != 0 {
+			t.Fatalf("%s: files left behind: %v", name, matches)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package godb
+
+import "sort"
+
+// a mutation of ApplyBatch
+type Op struct {
+	Key []byte
+	Val []byte
+	Del bool // delete the key instead of setting it
+}
+
+// apply the mutations as if one by one in the given order (so the last op of
+// a key wins), but in a single pass: the ops are sorted and each affected node
+// is rewritten once, instead of once per key.
+func (tree *BTree) ApplyBatch(ops []Op) {
+	for _, op := range ops {
+		assert(len(op.Key) <= BTREE_MAX_KEY_SIZE)
+		assert(len(op.Val) <= BTREE_MAX_VAL_SIZE)
+	}
+	ops = sortOps(tree, ops)
+	if len(ops) == 0 || (tree.root == 0 && !hasSet(ops)) {
+		return
+	}
+	if tree.log != nil {
+		tree.log.write(txOp{kind: TXOP_BATCH, batch: ops})
+	}
+
+	var root BNode
+	if tree.root == 0 {
+		// an empty leaf with the dummy key, like the first Insert
+		root = BNode(make([]byte, BTREE_PAGE_SIZE))
+		root.setHeader(BNODE_LEAF, 1)
+		nodeAppendKV(root, 0, 0, nil, nil)
+	} else {
+		root = tree.get(tree.root)
+	}
+	nodes := treeApply(tree, root, ops)
+	if tree.root != 0 {
+		tree.del(tree.root)
+	}
+	tree.root = batchNewRoot(tree, nodes)
+}
+
+// sort the ops by key and keep the last op of each key
+func sortOps(tree *BTree, ops []Op) []Op {
+	sorted := append([]Op{}, ops...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return tree.compare(sorted[i].Key, sorted[j].Key) < 0
+	})
+	out := sorted[:0]
+	for i, op := range sorted {
+		if i+1 < len(sorted) && tree.compare(op.Key, sorted[i+1].Key) == 0 {
+			continue // overwritten by a later op
+		}
+		if op.Del && len(op.Key) == 0 {
+			continue // the dummy key is never removed
+		}
+		out = append(out, op)
+	}
+	return out
+}
+
+func hasSet(ops []Op) bool {
+	for _, op := range ops {
+		if !op.Del {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sorted ops to a subtree; the result is 0 or more unallocated nodes
+// that each fit in a page. the caller deallocates the input node.
+func treeApply(tree *BTree, node BNode, ops []Op) []BNode {
+	switch node.btype() {
+	case BNODE_LEAF:
+		return leafApply(tree, node, ops)
+	case BNODE_NODE:
+		return nodeApply(tree, node, ops)
+	default:
+		panic("bad node!")
+	}
+}
+
+// merge the ops into the KVs of a leaf
+func leafApply(tree *BTree, node BNode, ops []Op) []BNode {
+	kvs := make([]bulkKV, 0, int(node.nkeys())+len(ops))
+	i, n := uint16(0), node.nkeys()
+	for _, op := range ops {
+		for i < n && tree.compare(node.getKey(i), op.Key) < 0 {
+			kvs = append(kvs, bulkKV{key: node.getKey(i), val: node.getVal(i)})
+			i++
+		}
+		if i < n && tree.compare(node.getKey(i), op.Key) == 0 {
+			i++ // replaced or deleted
+		}
+		if !op.Del {
+			kvs = append(kvs, bulkKV{key: op.Key, val: op.Val})
+		}
+	}
+	for ; i < n; i++ {
+		kvs = append(kvs, bulkKV{key: node.getKey(i), val: node.getVal(i)})
+	}
+	return packNodes(BNODE_LEAF, kvs)
+}
+
+// a kid of an internal node being rewritten
+type batchKid struct {
+	ptr   uint64 // an existing page, or 0
+	node  BNode  // a new unallocated node, or nil
+	key   []byte
+	small bool // a new node that should be merged with a sibling
+}
+
+func (kid batchKid) load(tree *BTree) BNode {
+	if kid.node != nil {
+		return kid.node
+	}
+	return tree.get(kid.ptr)
+}
+
+// hand each kid its range of ops, then merge the kids that became small
+func nodeApply(tree *BTree, node BNode, ops []Op) []BNode {
+	kids := make([]batchKid, 0, node.nkeys())
+	for i := uint16(0); i < node.nkeys(); i++ {
+		// the ops routed to the kid i, see nodeLookUpLE
+		end := len(ops)
+		if i+1 < node.nkeys() {
+			next := node.getKey(i + 1)
+			end = sort.Search(len(ops), func(j int) bool {
+				return tree.compare(ops[j].Key, next) >= 0
+			})
+		}
+		kptr := node.getPtr(i)
+		if end == 0 {
+			kids = append(kids, batchKid{ptr: kptr, key: node.getKey(i)})
+			continue
+		}
+		for _, knode := range treeApply(tree, tree.get(kptr), ops[:end]) {
+			kids = append(kids, newBatchKid(knode))
+		}
+		tree.del(kptr)
+		ops = ops[end:]
+	}
+
+	// merge small kids with a sibling, like shouldMerge
+	merged := kids[:0]
+	for _, kid := range kids {
+		if n := len(merged); n > 0 && (merged[n-1].small || kid.small) {
+			if both, ok := batchMerge(tree, merged[n-1], kid); ok {
+				merged[n-1] = both
+				continue
+			}
+		}
+		merged = append(merged, kid)
+	}
+
+	// allocate the new kids and link them
+	links := make([]bulkKV, 0, len(merged))
+	for _, kid := range merged {
+		if kid.node != nil {
+			kid.ptr = tree.new(kid.node)
+		}
+		links = append(links, bulkKV{ptr: kid.ptr, key: kid.key})
+	}
+	return packNodes(BNODE_NODE, links)
+}
+
+func newBatchKid(node BNode) batchKid {
+	small := node.nbytes() <= BTREE_PAGE_SIZE/4
+	return batchKid{node: node, key: node.getKey(0), small: small}
+}
+
+// merge 2 adjacent kids if the result fits in a page
+func batchMerge(tree *BTree, left batchKid, right batchKid) (batchKid, bool) {
+	lnode, rnode := left.load(tree), right.load(tree)
+	if lnode.nbytes()+rnode.nbytes()-HEADER > BTREE_PAGE_SIZE {
+		return batchKid{}, false
+	}
+	new := BNode(make([]byte, BTREE_PAGE_SIZE))
+	nodeMerge(tree, new, lnode, rnode)
+	for _, old := range []batchKid{left, right} {
+		if old.ptr != 0 {
+			tree.del(old.ptr)
+		}
+	}
+	return newBatchKid(new), true
+}
+
+// pack KVs into nodes; a single node if they fit in a page,
+// otherwise nodes filled up to BTREE_BULK_FILL like the bulk loader
+func packNodes(btype uint16, kvs []bulkKV) []BNode {
+	if len(kvs) == 0 {
+		return nil
+	}
+	var nodes []BNode
+	start, size, total := 0, HEADER, HEADER
+	for _, kv := range kvs {
+		total += 8 + 2 + 4 + len(kv.key) + len(kv.val)
+	}
+	limit := BTREE_BULK_FILL
+	if total <= BTREE_PAGE_SIZE {
+		limit = BTREE_PAGE_SIZE
+	}
+	for i, kv := range kvs {
+		kvSize := 8 + 2 + 4 + len(kv.key) + len(kv.val)
+		if i > start && size+kvSize > limit {
+			nodes = append(nodes, packNode(btype, kvs[start:i]))
+			start, size = i, HEADER
+		}
+		size += kvSize
+	}
+	return append(nodes, packNode(btype, kvs[start:]))
+}
+
+func packNode(btype uint16, kvs []bulkKV) BNode {
+	node := BNode(make([]byte, BTREE_PAGE_SIZE))
+	node.setHeader(btype, uint16(len(kvs)))
+	for i, kv := range kvs {
+		nodeAppendKV(node, uint16(i), kv.ptr, kv.key, kv.val)
+	}
+	return node
+}
+
+// allocate the resulting nodes of the root, adding levels until one node is left
+func batchNewRoot(tree *BTree, nodes []BNode) uint64 {
+	if len(nodes) == 0 {
+		return 0 // everything is deleted
+	}
+	for len(nodes) > 1 {
+		links := make([]bulkKV, len(nodes))
+		for i, node := range nodes {
+			links[i] = bulkKV{ptr: tree.new(node), key: node.getKey(0)}
+		}
+		nodes = packNodes(BNODE_NODE, links)
+	}
+	// the root was shrunk to a single kid, remove the level
+	root := nodes[0]
+	for root.btype() == BNODE_NODE && root.nkeys() == 1 {
+		ptr := root.getPtr(0)
+		root = tree.get(ptr)
+		if root.btype() != BNODE_NODE || root.nkeys() != 1 {
+			return ptr
+		}
+		tree.del(ptr)
+	}
+	return tree.new(root)
+}
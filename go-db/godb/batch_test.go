@@ -0,0 +1,162 @@
+package godb
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"db.com/m/internal/kvtest"
+)
+
+// apply a batch to the harness and its reference
+func (c *C) applyBatch(ops []Op) {
+	c.tree.ApplyBatch(ops)
+	for _, op := range ops {
+		if op.Del {
+			if len(op.Key) > 0 {
+				delete(c.ref, string(op.Key))
+			}
+		} else {
+			c.ref[string(op.Key)] = string(op.Val)
+		}
+	}
+}
+
+func randomBatch(r *rand.Rand, n int, keySpace int) []Op {
+	ops := make([]Op, n)
+	for i := range ops {
+		ops[i].Key = []byte(fmt.Sprintf("key%05d", r.Intn(keySpace)))
+		if r.Intn(3) == 0 {
+			ops[i].Del = true
+		} else {
+			ops[i].Val = make([]byte, r.Intn(100))
+			if r.Intn(20) == 0 {
+				ops[i].Val = make([]byte, r.Intn(BTREE_MAX_VAL_SIZE))
+			}
+			r.Read(ops[i].Val)
+		}
+	}
+	return ops
+}
+
+func TestApplyBatchMatchesSequential(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	batch, seq := newC(), newC()
+	for round := 0; round < 60; round++ {
+		size := []int{1, 10, 100, 1000, 5000}[r.Intn(5)]
+		keySpace := []int{50, 3000, 20000}[r.Intn(3)]
+		ops := randomBatch(r, size, keySpace)
+		if round%20 == 19 {
+			// delete most of the keys to shrink the tree
+			ops = ops[:0]
+			for key := range batch.ref {
+				if r.Intn(10) > 0 {
+					ops = append(ops, Op{Key: []byte(key), Del: true})
+				}
+			}
+		}
+
+		batch.applyBatch(ops)
+		for _, op := range ops {
+			if op.Del {
+				seq.del(string(op.Key))
+			} else {
+				seq.add(string(op.Key), string(op.Val))
+			}
+		}
+		if err := batch.check(); err != nil {
+			checkTree(t, &batch.tree)
+			t.Fatalf("round %d: %v", round, err)
+		}
+		if fmt.Sprint(dumpTree(&batch.tree)) != fmt.Sprint(dumpTree(&seq.tree)) {
+			t.Fatalf("round %d: batch and sequential results differ", round)
+		}
+	}
+}
+
+func TestApplyBatchEdgeCases(t *testing.T) {
+	c := newC()
+	c.applyBatch(nil)
+	c.applyBatch([]Op{{Key: []byte("a"), Del: true}})
+	if c.tree.root != 0 {
+		t.Fatal("deletes on an empty tree should not create a root")
+	}
+
+	// the last op of a key wins
+	c.applyBatch([]Op{
+		{Key: []byte("a"), Val: []byte("1")},
+		{Key: []byte("b"), Val: []byte("1")},
+		{Key: []byte("a"), Del: true},
+		{Key: []byte("b"), Val: []byte("2")},
+		{Key: []byte(""), Val: []byte("empty")},
+		{Key: []byte("c"), Val: []byte("3")},
+	})
+	if err := c.check(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.tree.Get([]byte("a")); ok {
+		t.Fatal("a should be deleted")
+	}
+
+	// delete everything but the dummy key
+	c.applyBatch([]Op{{Key: []byte("b"), Del: true}, {Key: []byte("c"), Del: true}, {Key: nil, Del: true}})
+	if err := c.check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyBatchChurn(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	base := randomBatch(r, 20000, 20000)
+
+	count := func(apply func(c *C, ops []Op)) int {
+		c := newC()
+		c.applyBatch(base)
+		counter := &countingStore{PageStore: c.tree.store}
+		c.tree.store = counter
+		apply(c, randomBatch(rand.New(rand.NewSource(3)), 2000, 20000))
+		if err := c.check(); err != nil {
+			t.Fatal(err)
+		}
+		return counter.allocs
+	}
+	batched := count(func(c *C, ops []Op) { c.applyBatch(ops) })
+	sequential := count(func(c *C, ops []Op) {
+		for _, op := range ops {
+			c.applyBatch([]Op{op})
+		}
+	})
+	if batched*2 > sequential {
+		t.Fatalf("%d pages allocated by the batch, %d one by one", batched, sequential)
+	}
+}
+
+func TestKVApplyBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, nil)
+	ref := map[string]string{}
+	r := rand.New(rand.NewSource(4))
+	for i := 0; i < 5; i++ {
+		ops := randomBatch(r, 2000, 3000)
+		if err := db.ApplyBatch(ops); err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range ops {
+			if op.Del {
+				delete(ref, string(op.Key))
+			} else {
+				ref[string(op.Key)] = string(op.Val)
+			}
+		}
+	}
+	if err := db.ApplyBatch([]Op{{Key: []byte("ok")}, {Key: nil}}); err != errEmptyKey {
+		t.Fatal("empty key accepted")
+	}
+
+	db.Close()
+	db = openTestKV(t, path, nil)
+	if got := kvtest.Dump(db.Seek(nil)); fmt.Sprint(got) != fmt.Sprint(kvtest.Sorted(ref)) {
+		t.Fatal("reopened keys don't match")
+	}
+}
@@ -0,0 +1,126 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+)
+
+// bulk loaded nodes are packed up to this many bytes,
+// leaving some room for later inserts before they split
+const BTREE_BULK_FILL = BTREE_PAGE_SIZE * 9 / 10
+
+var errBulkNotEmpty = errors.New("bulk load: the tree is not empty")
+
+// a KV waiting to be packed into a node
+type bulkKV struct {
+	ptr uint64
+	key []byte
+	val []byte
+}
+
+// the node being filled at one level of the tree
+type bulkLevel struct {
+	btype   uint16
+	kvs     []bulkKV
+	size    int // bytes of the node if it was written now
+	flushed int // number of nodes already written
+}
+
+// build the tree bottom-up from KVs sorted in strictly ascending key order;
+// the tree must be empty, and it is left empty if an error is returned
+func (tree *BTree) BulkLoad(kvs iter.Seq2[[]byte, []byte]) error {
+	if tree.root != 0 {
+		return errBulkNotEmpty
+	}
+
+	b := bulkLoader{tree: tree}
+	if err := b.load(kvs); err != nil {
+		for _, ptr := range b.allocated {
+			tree.del(ptr)
+		}
+		return err
+	}
+	tree.root = b.finish()
+	return nil
+}
+
+type bulkLoader struct {
+	tree      *BTree
+	levels    []*bulkLevel // levels[0] is the leaf level
+	allocated []uint64     // pages to free if the load fails
+	prev      []byte       // the last key added to the leaf level
+	count     int
+}
+
+func (b *bulkLoader) load(kvs iter.Seq2[[]byte, []byte]) error {
+	b.levels = []*bulkLevel{{btype: BNODE_LEAF, size: HEADER}}
+	for key, val := range kvs {
+		if len(key) > BTREE_MAX_KEY_SIZE || len(val) > BTREE_MAX_VAL_SIZE {
+			return fmt.Errorf("bulk load: KV #%d is too large", b.count)
+		}
+		switch {
+		case b.count == 0 && len(key) != 0:
+			// a dummy key, this makes the tree cover the whole key space
+			b.add(0, bulkKV{})
+		case b.count > 0 && b.tree.compare(b.prev, key) >= 0:
+			return fmt.Errorf("bulk load: key %q is not greater than the previous key %q", key, b.prev)
+		}
+		// the iterator may reuse its buffers
+		key, val = bytes.Clone(key), bytes.Clone(val)
+		b.add(0, bulkKV{key: key, val: val})
+		b.prev = key
+		b.count++
+	}
+	return nil
+}
+
+// append a KV to the node at a level, writing out the node first if it's full
+func (b *bulkLoader) add(level int, kv bulkKV) {
+	l := b.levels[level]
+	kvSize := 8 + 2 + 4 + len(kv.key) + len(kv.val)
+	if len(l.kvs) > 0 && l.size+kvSize > BTREE_BULK_FILL {
+		b.flush(level)
+	}
+	l.kvs = append(l.kvs, kv)
+	l.size += kvSize
+}
+
+// write out the node of a level and link it from the level above
+func (b *bulkLoader) flush(level int) {
+	l := b.levels[level]
+	node := BNode(make([]byte, BTREE_PAGE_SIZE))
+	node.setHeader(l.btype, uint16(len(l.kvs)))
+	for i, kv := range l.kvs {
+		nodeAppendKV(node, uint16(i), kv.ptr, kv.key, kv.val)
+	}
+	ptr := b.tree.new(node)
+	b.allocated = append(b.allocated, ptr)
+
+	first := l.kvs[0].key
+	l.kvs, l.size = nil, HEADER
+	l.flushed++
+
+	if level+1 == len(b.levels) {
+		b.levels = append(b.levels, &bulkLevel{btype: BNODE_NODE, size: HEADER})
+	}
+	b.add(level+1, bulkKV{ptr: ptr, key: first})
+}
+
+// write out the remaining nodes bottom-up and return the root pointer
+func (b *bulkLoader) finish() uint64 {
+	if b.count == 0 {
+		return 0 // nothing was loaded
+	}
+	for level := 0; ; level++ {
+		l := b.levels[level]
+		if l.flushed == 0 {
+			// the only node of the top level becomes the root
+			assert(level+1 == len(b.levels))
+			b.flush(level)
+			return b.levels[level+1].kvs[0].ptr
+		}
+		b.flush(level)
+	}
+}
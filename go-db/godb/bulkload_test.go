@@ -0,0 +1,124 @@
+package godb
+
+import (
+	"fmt"
+	"iter"
+	"testing"
+)
+
+// iterate over the KVs in the given order
+func kvSeq(keys []string, val func(string) string) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for _, key := range keys {
+			if !yield([]byte(key), []byte(val(key))) {
+				return
+			}
+		}
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	c := newC()
+	keys := make([]string, 20000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%08d", i)
+	}
+	val := func(key string) string { return "val-" + key }
+
+	if err := c.tree.BulkLoad(kvSeq(keys, val)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	root := BNode(c.tree.get(c.tree.root))
+	if root.btype() != BNODE_NODE {
+		t.Fatal("root should be an internal node")
+	}
+	for _, key := range keys {
+		got, ok := c.tree.Get([]byte(key))
+		if !ok || string(got) != val(key) {
+			t.Fatalf("key %s: got %q, %v", key, got, ok)
+		}
+	}
+
+	// leaves are packed rather than half full
+	leaves := 0
+	for _, data := range c.pages {
+		page := BNode(data)
+		if page.btype() == BNODE_LEAF {
+			leaves++
+			if page.nbytes() > BTREE_PAGE_SIZE {
+				t.Fatal("oversized leaf")
+			}
+		}
+	}
+	if min := len(keys) * (8 + 2 + 4 + 11 + 15) / BTREE_BULK_FILL; leaves > min+1 {
+		t.Fatalf("%d leaves, expect about %d", leaves, min)
+	}
+
+	// the loaded tree is an ordinary tree
+	for i := 0; i < len(keys); i += 3 {
+		if !c.tree.Delete([]byte(keys[i])) {
+			t.Fatalf("key %s not deleted", keys[i])
+		}
+	}
+	c.tree.Insert([]byte("key"), []byte("x"))
+	if err := c.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		_, ok := c.tree.Get([]byte(key))
+		if ok != (i%3 != 0) {
+			t.Fatalf("key %s: unexpected presence %v", key, ok)
+		}
+	}
+}
+
+func TestBulkLoadSmall(t *testing.T) {
+	for _, keys := range [][]string{{}, {""}, {"a"}, {"", "a", "b"}} {
+		c := newC()
+		if err := c.tree.BulkLoad(kvSeq(keys, func(k string) string { return k + k })); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			got, ok := c.tree.Get([]byte(key))
+			if !ok || string(got) != key+key {
+				t.Fatalf("%q: key %q missing", keys, key)
+			}
+		}
+		if len(keys) == 0 && c.tree.root != 0 {
+			t.Fatal("empty input should leave an empty tree")
+		}
+	}
+}
+
+func TestBulkLoadRejectsUnsorted(t *testing.T) {
+	keys := make([]string, 5000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%08d", i)
+	}
+	keys[4000], keys[4001] = keys[4001], keys[4000]
+
+	for _, input := range [][]string{keys, {"a", "a"}} {
+		c := newC()
+		err := c.tree.BulkLoad(kvSeq(input, func(string) string { return "v" }))
+		if err == nil {
+			t.Fatal("unsorted input accepted")
+		}
+		if c.tree.root != 0 || len(c.pages) != 0 {
+			t.Fatal("failed load should leave an empty tree")
+		}
+	}
+}
+
+func TestBulkLoadNonEmptyTree(t *testing.T) {
+	c := newC()
+	c.add("a", "1")
+	if err := c.tree.BulkLoad(kvSeq([]string{"b"}, func(string) string { return "2" })); err != errBulkNotEmpty {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
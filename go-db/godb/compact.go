@@ -0,0 +1,91 @@
+package godb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// rewrite the live tree into a new file and replace the database file with it.
+// writers wait until it's done; readers carry on, pinned trees keep reading
+// the mappings of the old file, which are released with the last of them.
+func (db *DB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tmp := db.path + ".compact"
+	_ = os.Remove(tmp) // left over from a failed compaction
+	fresh, err := Open(tmp, &Options{
+		Codec:         db.opts.Codec,
+		EncryptionKey: db.opts.EncryptionKey,
+		Comparator:    db.opts.Comparator,
+		Metrics:       db.opts.Metrics,
+	})
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	fresh.seq, fresh.hist = db.seq, db.hist
+	err = compactInto(fresh, &db.tree)
+	if err == nil {
+		err = os.Rename(tmp, db.path)
+	}
+	if err != nil {
+		fresh.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("compact: %w", err)
+	}
+
+	// the path is the new file from the rename on, swap it in.
+	// a failed directory fsync may lose the rename on a crash, which
+	// leaves the old file, so the error is reported without going back.
+	_ = db.fd.Close()
+	db.fd, db.file = fresh.fd, fresh.file
+	old := db.mmap.chunks
+	db.mmap = fresh.mmap
+	db.page.flushed = fresh.page.flushed
+	db.crypt = fresh.crypt
+	db.tree.root = fresh.tree.root
+	db.publishFile(old)
+	if err := syncDir(filepath.Dir(db.path)); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	return nil
+}
+
+// bulk load the tree into an empty database and trim the file to its size
+func compactInto(fresh *DB, tree *BTree) error {
+	err := fresh.tree.BulkLoad(func(yield func([]byte, []byte) bool) {
+		// the dummy key comes first and is reused by the bulk loader
+		for iter := tree.SeekLE(nil); iter.Valid(); iter.Next() {
+			if !yield(iter.Deref()) {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := updateOrRevert(fresh, 0); err != nil {
+		return err
+	}
+
+	size := int(physPages(fresh.crypt, fresh.page.flushed)) * BTREE_PAGE_SIZE
+	if err := fresh.fd.Truncate(int64(size)); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	fresh.mmap.file = size
+	return fsync(fresh)
+}
+
+// persist a rename in the directory
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err := fd.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package godb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"db.com/m/internal/kvtest"
+)
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, nil)
+	ref := kvtest.Fill(t, db, 4000)
+	for i := 0; i < 4000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		if i%10 != 1 {
+			if _, err := db.Del([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(ref, key)
+		}
+	}
+
+	before, seq, hist := fileSize(t, path), db.seq, db.hist
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if db.seq != seq || db.hist != hist {
+		t.Fatal("the compacted file has another history")
+	}
+	after := fileSize(t, path)
+	if after*10 > before {
+		t.Fatalf("file size %d -> %d", before, after)
+	}
+	if after != int64(db.page.flushed)*BTREE_PAGE_SIZE {
+		t.Fatal("the file is not trimmed to the used pages")
+	}
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if got := kvtest.Dump(db.Seek(nil)); fmt.Sprint(got) != fmt.Sprint(kvtest.Sorted(ref)) {
+		t.Fatal("compacted keys don't match")
+	}
+
+	// the compacted database keeps working and persists
+	if err := db.Set([]byte("after"), []byte("compact")); err != nil {
+		t.Fatal(err)
+	}
+	ref["after"] = "compact"
+	db.Close()
+	db = openTestKV(t, path, nil)
+	if got := kvtest.Dump(db.Seek(nil)); fmt.Sprint(got) != fmt.Sprint(kvtest.Sorted(ref)) {
+		t.Fatal("reopened keys don't match")
+	}
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) != 0 {
+		t.Fatalf("files left behind: %v", matches)
+	}
+}
+
+func TestCompactEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, nil)
+	kvtest.Fill(t, db, 10)
+	for i := 0; i < 10; i++ {
+		if _, err := db.Del([]byte(fmt.Sprintf("key%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, path); size > 2*BTREE_PAGE_SIZE {
+		t.Fatalf("file size %d", size)
+	}
+}
+
+func TestCompactWithReaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, nil)
+	ref := kvtest.Fill(t, db, 2000)
+	pinned := db.pin()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for key, val := range ref {
+					if v, ok, _ := db.Get([]byte(key)); !ok || string(v) != val {
+						t.Errorf("Get(%s) = %q, %v", key, v, ok)
+						return
+					}
+					break
+				}
+			}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// a tree pinned before compaction still reads the old file
+	got := dumpTree(&pinned)
+	for i := range got {
+		val, _, _ := decodeVal([]byte(got[i][1]))
+		got[i][1] = string(val)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(kvtest.Sorted(ref)) {
+		t.Fatal("pinned tree changed")
+	}
+	// the old mmaps go with the last tree on them
+	if len(db.reader.retired) != 1 {
+		t.Fatalf("%d files kept mapped", len(db.reader.retired))
+	}
+	db.unpin(pinned.store)
+	if len(db.reader.retired) != 0 || len(db.reader.pins) != 0 {
+		t.Fatalf("%d files kept mapped, %d pinned", len(db.reader.retired), len(db.reader.pins))
+	}
+}
+
+// an iterator releases the old file when it's done
+func TestCompactWithIterator(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	ref := kvtest.Fill(t, db, 1000)
+	iter := db.Seek(nil)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.reader.retired) != 1 {
+		t.Fatal("unmapped the file of an iterator")
+	}
+	kvtest.Check(t, iter, ref)
+	if len(db.reader.retired) != 0 {
+		t.Fatal("the file is still mapped after the iteration")
+	}
+
+	// closed before the end
+	iter = db.Seek(nil)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	iter.Close()
+	if len(db.reader.retired) != 0 || len(db.reader.pins) != 0 {
+		t.Fatal("the file is still mapped after Close")
+	}
+}
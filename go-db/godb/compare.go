@@ -0,0 +1,146 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// the comparator name in the master page, zero-padded. no name is the byte order.
+const CMP_NAME_MAX = 32
+
+// a key order of a database. the name is recorded in the master page,
+// and a file can only be opened with the order it was created with.
+type Comparator struct {
+	Name    string
+	Compare func(a []byte, b []byte) int // negative if a < b, 0 if the same key
+}
+
+// the built-in orders, besides the default byte order
+var (
+	CaseInsensitive = Comparator{Name: "case-insensitive", Compare: compareFold}
+	Reverse         = Comparator{Name: "reverse", Compare: func(a []byte, b []byte) int {
+		return bytes.Compare(b, a)
+	}}
+)
+
+var builtinComparators = map[string]Comparator{
+	CaseInsensitive.Name: CaseInsensitive,
+	Reverse.Name:         Reverse,
+}
+
+// a built-in comparator by its name
+func ComparatorByName(name string) (Comparator, bool) {
+	c, ok := builtinComparators[name]
+	return c, ok
+}
+
+// compare the runes lowered by unicode.ToLower; the bytes of invalid UTF-8
+// sort after all runes, so that they don't collide with valid ones
+func compareFold(a []byte, b []byte) int {
+	for len(a) > 0 && len(b) > 0 {
+		ra, na := foldRune(a)
+		rb, nb := foldRune(b)
+		if ra != rb {
+			if ra < rb {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[na:], b[nb:]
+	}
+	return len(a) - len(b)
+}
+
+func foldRune(data []byte) (rune, int) {
+	r, n := utf8.DecodeRune(data)
+	if r == utf8.RuneError && n == 1 {
+		return utf8.MaxRune + 1 + rune(data[0]), 1
+	}
+	return unicode.ToLower(r), n
+}
+
+// the order of the tree of a database with a comparator: the reserved keys
+// (starting with 0) keep their byte order but sort after all user keys.
+// the dummy key is handled by BTree.compare.
+func treeOrder(c Comparator) func(a []byte, b []byte) int {
+	return func(a []byte, b []byte) int {
+		ra, rb := a[0] == 0, b[0] == 0
+		switch {
+		case ra && rb:
+			return bytes.Compare(a, b)
+		case ra:
+			return 1
+		case rb:
+			return -1
+		}
+		return c.Compare(a, b)
+	}
+}
+
+// clamp [start, end) to the user keys; a nil end means to the last user key
+func userRange(tree *BTree, start []byte, end []byte) ([]byte, []byte) {
+	if tree.cmp == nil {
+		// the reserved keys sort first
+		if len(start) == 0 || start[0] == 0 {
+			start = []byte{1}
+		}
+		return start, end
+	}
+	if len(start) == 0 || start[0] == 0 {
+		start = nil // after the dummy key
+	}
+	if end == nil || (len(end) > 0 && end[0] == 0) {
+		end = []byte{0} // the first reserved key
+	}
+	return start, end
+}
+
+// set up the key order of a new file
+func comparatorNew(db *DB) error {
+	c := db.opts.Comparator
+	switch {
+	case c.Name == "" && c.Compare == nil:
+		return nil // the byte order
+	case c.Name == "" || c.Compare == nil:
+		return errors.New("a comparator needs both a name and a function")
+	case len(c.Name) > CMP_NAME_MAX:
+		return fmt.Errorf("comparator name of %d bytes, the limit is %d", len(c.Name), CMP_NAME_MAX)
+	}
+	db.tree.cmp = treeOrder(c)
+	return nil
+}
+
+// set up the key order recorded in the master page
+func comparatorLoad(db *DB, name string) error {
+	c, err := comparatorMatch(db.opts.Comparator, name, "database")
+	if err != nil {
+		return err
+	}
+	db.opts.Comparator = c
+	return comparatorNew(db)
+}
+
+// the comparator of a recorded name, `what` has the name. the given one must
+// match, a built-in comparator doesn't have to be given.
+func comparatorMatch(c Comparator, name string, what string) (Comparator, error) {
+	if c.Name == "" && c.Compare == nil {
+		if name == "" {
+			return c, nil
+		}
+		builtin, ok := builtinComparators[name]
+		if !ok {
+			return c, fmt.Errorf("the %s is ordered by comparator %q, which must be given", what, name)
+		}
+		return builtin, nil
+	}
+	switch {
+	case name == "":
+		return c, fmt.Errorf("the %s is in byte order, not comparator %q", what, c.Name)
+	case c.Name != name:
+		return c, fmt.Errorf("the %s was created with comparator %q, not %q", what, name, c.Name)
+	}
+	return c, nil
+}
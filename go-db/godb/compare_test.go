@@ -0,0 +1,222 @@
+package godb
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"db.com/m/internal/kvtest"
+)
+
+func TestCompareFold(t *testing.T) {
+	ordered := []string{"", "a", "AB", "abc", "b", "Zz", "é", "É1", "\xff"}
+	for i, a := range ordered {
+		for j, b := range ordered {
+			got := compareFold([]byte(a), []byte(b))
+			if (got < 0) != (i < j) || (got == 0) != (i == j) {
+				t.Fatalf("compareFold(%q, %q) = %d", a, b, got)
+			}
+		}
+	}
+	if compareFold([]byte("Hello"), []byte("hELLO")) != 0 {
+		t.Fatal("case matters")
+	}
+}
+
+// the tree of the harness keeps the order of its comparator
+func TestTreeComparator(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	c := newC()
+	c.tree.cmp = Reverse.Compare
+	ref := map[string]bool{}
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%04d", r.Intn(2000))
+		if r.Intn(3) == 0 {
+			if c.tree.Delete([]byte(key)) != ref[key] {
+				t.Fatalf("Delete(%s)", key)
+			}
+			delete(ref, key)
+		} else {
+			c.tree.Insert([]byte(key), []byte("v"))
+			ref[key] = true
+		}
+	}
+	c.tree.ApplyBatch([]Op{{Key: []byte("key9999"), Val: []byte("v")}, {Key: []byte("key0000"), Del: true}})
+	ref["key9999"] = true
+	delete(ref, "key0000")
+	if c.tree.DeleteRange([]byte("key1500"), []byte("key1000")) == 0 {
+		t.Fatal("nothing deleted")
+	}
+	for key := range ref {
+		if key <= "key1500" && key > "key1000" {
+			delete(ref, key)
+		}
+	}
+	if err := c.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	var expect []string
+	for key := range ref {
+		expect = append(expect, key)
+	}
+	slices.Sort(expect)
+	slices.Reverse(expect)
+	var got []string
+	for _, kv := range dumpTree(&c.tree) {
+		got = append(got, kv[0])
+	}
+	if !slices.Equal(got, expect) {
+		t.Fatal("the keys are not in reverse order")
+	}
+}
+
+func TestComparatorKV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, &Options{Comparator: CaseInsensitive})
+	for _, key := range []string{"banana", "Apple", "cherry", "apple", "Date"} {
+		if err := db.Set([]byte(key), []byte(strings.ToUpper(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the expiry index sorts after the user keys
+	if err := db.Update(&UpdateReq{Key: []byte("Fig"), Val: []byte("F"), TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	expect := [][2]string{{"apple", "APPLE"}, {"banana", "BANANA"}, {"cherry", "CHERRY"}, {"Date", "DATE"}, {"Fig", "F"}}
+	if got := kvtest.Dump(db.Seek(nil)); fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Fatalf("got %v", got)
+	}
+	if val, ok, _ := db.Get([]byte("APPLE")); !ok || string(val) != "APPLE" {
+		t.Fatalf("Get: %q, %v", val, ok)
+	}
+	w := db.Watch([]byte("d"))
+	defer w.Close()
+	count, err := db.DeleteRange([]byte("C"), nil)
+	if err != nil || count != 3 {
+		t.Fatalf("DeleteRange: %d, %v", count, err)
+	}
+	// the prefix is matched case-insensitively
+	if events := drainEvents(w); fmt.Sprint(events) != `[delete Date "DATE" ""]` {
+		t.Fatalf("events: %v", events)
+	}
+	if countExpiry(db) != 1 {
+		t.Fatal("the expiry index was deleted")
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if _, err := db.Backup(&dump); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// a built-in comparator is found by its name
+	db = openTestKV(t, path, &Options{Comparator: Comparator{}})
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if got := kvtest.Dump(db.Seek(nil)); fmt.Sprint(got) != fmt.Sprint(expect[:2]) {
+		t.Fatalf("reopened: %v", got)
+	}
+
+	// a dump is restored with its order
+	restored := filepath.Join(t.TempDir(), "restored.db")
+	if _, err := Restore(restored, bytes.NewReader(dump.Bytes()), nil); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestKV(t, restored, nil)
+	if db.opts.Comparator.Name != CaseInsensitive.Name {
+		t.Fatalf("restored with comparator %q", db.opts.Comparator.Name)
+	}
+	if got := kvtest.Dump(db.Seek(nil)); fmt.Sprint(got) != fmt.Sprint(expect[:2]) {
+		t.Fatalf("restored: %v", got)
+	}
+}
+
+// a dump keeps the comparator it was taken with
+func TestComparatorDump(t *testing.T) {
+	custom := Comparator{Name: "length", Compare: func(a []byte, b []byte) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return bytes.Compare(a, b)
+	}}
+	for _, c := range []Comparator{Reverse, custom} {
+		t.Run(c.Name, func(t *testing.T) {
+			db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), &Options{Comparator: c})
+			ref := kvtest.Fill(t, db, 1000)
+			var dump bytes.Buffer
+			if _, err := db.Backup(&dump); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, other := range map[string]Comparator{"another": CaseInsensitive, "bytes": {}} {
+				if name == "bytes" && c.Name == Reverse.Name {
+					continue // the built-in one is found by its name
+				}
+				path := filepath.Join(t.TempDir(), "restored.db")
+				_, err := Restore(path, bytes.NewReader(dump.Bytes()), &Options{Comparator: other})
+				if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("comparator %q", c.Name)) {
+					t.Fatalf("restored with %s comparator: %v", name, err)
+				}
+			}
+
+			path := filepath.Join(t.TempDir(), "restored.db")
+			opts := &Options{}
+			if c.Name == custom.Name {
+				opts.Comparator = custom
+			}
+			if _, err := Restore(path, bytes.NewReader(dump.Bytes()), opts); err != nil {
+				t.Fatal(err)
+			}
+			restored := openTestKV(t, path, &Options{Comparator: c})
+			if err := restored.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			got := kvtest.Dump(restored.Seek(nil))
+			if expect := kvtest.Dump(db.Seek(nil)); fmt.Sprint(got) != fmt.Sprint(expect) || len(got) != len(ref) {
+				t.Fatalf("restored %d keys in another order", len(got))
+			}
+		})
+	}
+}
+
+func TestComparatorMismatch(t *testing.T) {
+	dir := t.TempDir()
+	custom := Comparator{Name: "length", Compare: func(a []byte, b []byte) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return bytes.Compare(a, b)
+	}}
+	plain := filepath.Join(dir, "plain.db")
+	openTestKV(t, plain, nil).Set([]byte("k"), []byte("v"))
+	ordered := filepath.Join(dir, "ordered.db")
+	openTestKV(t, ordered, &Options{Comparator: custom}).Set([]byte("k"), []byte("v"))
+
+	for name, open := range map[string]struct {
+		path string
+		c    Comparator
+	}{
+		"plain with a comparator":    {plain, CaseInsensitive},
+		"custom without comparator":  {ordered, Comparator{}},
+		"custom with another":        {ordered, Reverse},
+		"no name":                    {plain, Comparator{Compare: bytes.Compare}},
+		"no function":                {plain, Comparator{Name: "x"}},
+		"name too long for the page": {filepath.Join(dir, "new.db"), Comparator{Name: strings.Repeat("x", 33), Compare: bytes.Compare}},
+	} {
+		db, err := Open(open.path, &Options{Comparator: open.c})
+		if err == nil {
+			db.Close()
+			t.Fatalf("%s: opened", name)
+		}
+	}
+	openTestKV(t, ordered, &Options{Comparator: custom}).Close()
+}
@@ -0,0 +1,64 @@
+package godb
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// value codecs, the codec of a database is recorded in the master page
+const (
+	CODEC_NONE  = 0
+	CODEC_FLATE = 1 // compress/flate
+)
+
+// the compressor of the transactions, reused between values
+type compressor struct {
+	mu  sync.Mutex
+	w   *flate.Writer
+	buf bytes.Buffer
+}
+
+// compress a value with the codec of the database, called by the transactions.
+// returns the envelope flags; the value is kept as is unless it gets smaller.
+func (db *DB) compress(val []byte) ([]byte, byte) {
+	if db.opts.Codec != CODEC_FLATE || len(val) == 0 {
+		return val, 0
+	}
+	c := &db.codec
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf.Reset()
+	if c.w == nil {
+		w, err := flate.NewWriter(&c.buf, flate.DefaultCompression)
+		assert(err == nil)
+		c.w = w
+	} else {
+		c.w.Reset(&c.buf)
+	}
+	_, err := c.w.Write(val)
+	assert(err == nil) // writing to memory
+	assert(c.w.Close() == nil)
+	if c.buf.Len() >= len(val) {
+		return val, 0
+	}
+	return bytes.Clone(c.buf.Bytes()), VAL_FLATE
+}
+
+// decompress a value of the envelope
+func inflate(data []byte) ([]byte, error) {
+	val, err := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad compressed value: %v", ErrCorrupt, err)
+	}
+	return val, nil
+}
+
+func checkCodec(codec int) error {
+	if codec != CODEC_NONE && codec != CODEC_FLATE {
+		return fmt.Errorf("unknown codec %d", codec)
+	}
+	return nil
+}
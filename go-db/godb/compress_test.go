@@ -0,0 +1,167 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"db.com/m/internal/kvtest"
+)
+
+func TestCompressedKV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, &Options{Codec: CODEC_FLATE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		val := fmt.Sprintf(`{"id": %d, "name": "%s", "tags": ["a", "b", "c"]}`, i, strings.Repeat("x", i%300))
+		if i%10 == 0 {
+			val = fmt.Sprint(i) // too short to compress
+		}
+		ref[key] = val
+		req := &UpdateReq{Key: []byte(key), Val: []byte(val)}
+		if i%7 == 0 {
+			req.TTL = time.Hour
+		}
+		if err := db.Update(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ops := []Op{{Key: []byte("batch"), Val: []byte(strings.Repeat("batch", 100))}}
+	ref["batch"] = string(ops[0].Val)
+	if err := db.ApplyBatch(ops); err != nil {
+		t.Fatal(err)
+	}
+
+	// the leaves hold the compressed values
+	flated := 0
+	for iter := db.tree.Seek([]byte{1}); iter.Valid(); iter.Next() {
+		if _, raw := iter.Deref(); raw[0]&VAL_FLATE != 0 {
+			flated++
+		}
+	}
+	if flated < 1000 {
+		t.Fatalf("only %d values are compressed", flated)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	compressed := db.Stats()
+	db.Close()
+
+	// the codec is read from the file
+	db = openTestKV(t, path, nil)
+	if db.opts.Codec != CODEC_FLATE {
+		t.Fatal("the codec is not recorded")
+	}
+	if got := kvtest.Dump(db.Seek(nil)); fmt.Sprint(got) != fmt.Sprint(kvtest.Sorted(ref)) {
+		t.Fatal("reopened keys don't match")
+	}
+	req := &UpdateReq{Key: []byte("key00001"), Val: []byte("new"), Mode: MODE_CAS, Expect: []byte(ref["key00001"])}
+	if err := db.Update(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same data takes more pages without compression
+	plain := openTestKV(t, filepath.Join(t.TempDir(), "plain.db"), nil)
+	for key, val := range ref {
+		if err := plain.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := plain.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if p, c := plain.Stats().Leaves, compressed.Leaves; p < 2*c {
+		t.Fatalf("%d leaves compressed, %d leaves plain", c, p)
+	}
+}
+
+func TestCodecMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, nil)
+	if err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err := Open(path, &Options{Codec: CODEC_FLATE})
+	if err == nil {
+		db.Close()
+		t.Fatal("opened with another codec")
+	}
+	db, err = Open(path, &Options{Codec: 9})
+	if err == nil {
+		db.Close()
+		t.Fatal("opened with an unknown codec")
+	}
+}
+
+// a restored database keeps the codec of the dump
+func TestRestoreCodec(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), &Options{Codec: CODEC_FLATE})
+	ref := kvtest.Fill(t, db, 500)
+	var dump bytes.Buffer
+	if _, err := db.Backup(&dump); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "restored.db")
+	if _, err := Restore(path, &dump, nil); err != nil {
+		t.Fatal(err)
+	}
+	restored := openTestKV(t, path, nil)
+	if restored.opts.Codec != CODEC_FLATE {
+		t.Fatalf("restored with codec %d", restored.opts.Codec)
+	}
+	kvtest.Check(t, restored.Seek(nil), ref)
+}
+
+// a value that fails to decompress is an error, not a crash
+func TestCorruptValue(t *testing.T) {
+	var dump bytes.Buffer
+	dump.WriteString(DUMP_SIG)
+	binary.Write(&dump, binary.LittleEndian, [2]uint32{DUMP_VERSION, CODEC_FLATE})
+	dump.Write(make([]byte, CMP_NAME_MAX)) // the byte order
+	for _, kv := range [][2]string{{"a", "\x001"}, {"b", "\x02\xff\xff"}, {"c", "\x003"}} {
+		binary.Write(&dump, binary.LittleEndian, [2]uint32{uint32(len(kv[0])), uint32(len(kv[1]))})
+		dump.WriteString(kv[0] + kv[1])
+	}
+	binary.Write(&dump, binary.LittleEndian, uint32(dumpEndMark))
+	binary.Write(&dump, binary.LittleEndian, uint64(3))
+	path := filepath.Join(t.TempDir(), "test.db")
+	if _, err := Restore(path, &dump, nil); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestKV(t, path, nil)
+
+	if val, ok, err := db.Get([]byte("a")); err != nil || !ok || string(val) != "1" {
+		t.Fatalf("Get(a) = %q, %v, %v", val, ok, err)
+	}
+	if _, _, err := db.Get([]byte("b")); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Get(b): %v", err)
+	}
+	iter := db.Seek(nil)
+	if got := kvtest.Dump(iter); fmt.Sprint(got) != "[[a 1] [b ]]" {
+		t.Fatalf("iterated %q", got)
+	}
+	if !errors.Is(iter.Err(), ErrCorrupt) {
+		t.Fatalf("iterator: %v", iter.Err())
+	}
+	if err := db.Set([]byte("b"), []byte("x")); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Set(b): %v", err)
+	}
+	if _, err := db.DeleteRange([]byte("b"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(kvtest.Dump(db.Seek(nil))); got != "[[a 1] [c 3]]" {
+		t.Fatalf("after deleting the corrupt value: %s", got)
+	}
+}
@@ -0,0 +1,179 @@
+package godb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// page ciphers, the cipher of a database is recorded in the master page
+const (
+	CIPHER_NONE    = 0
+	CIPHER_AES_GCM = 1
+)
+
+// an encrypted file stores the nonce and the tag of each page apart from it,
+// in a tag page in front of every group of CRYPT_GROUP pages:
+// | master | tags | page 1 | ... | page 146 | tags | page 147 | ...
+// a tag page is an array of `nonce (12B) | tag (16B)`, one per page of the group.
+// the page numbers of the tree are unchanged, only the file offsets are.
+const (
+	CRYPT_NONCE    = 12
+	CRYPT_TAG      = 16
+	CRYPT_OVERHEAD = CRYPT_NONCE + CRYPT_TAG
+	CRYPT_GROUP    = BTREE_PAGE_SIZE / CRYPT_OVERHEAD
+)
+
+// the per-file salt and the key check in the master page
+const (
+	CRYPT_SALT  = 16
+	CRYPT_CHECK = 16
+)
+
+var errWrongKey = errors.New("wrong encryption key")
+
+// the AES-GCM layer between the tree and the file.
+// each file has a random salt, so that a rewritten file (compaction)
+// never encrypts with the same key and nonce as the old one.
+type pageCipher struct {
+	aead  cipher.AEAD
+	salt  []byte
+	check []byte // proves the key without decrypting a page
+}
+
+// derive the key of the file from the user key, `salt` is nil for a new file
+func newPageCipher(key []byte, salt []byte) (*pageCipher, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("encryption key of %d bytes, expect 16, 24 or 32", len(key))
+	}
+	if salt == nil {
+		salt = make([]byte, CRYPT_SALT)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(deriveKey(key, "page", salt))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	check := deriveKey(key, "check", salt)[:CRYPT_CHECK]
+	return &pageCipher{aead: aead, salt: salt, check: check}, nil
+}
+
+func deriveKey(key []byte, label string, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(salt)
+	return mac.Sum(nil)
+}
+
+// the file offset of a page in number of pages
+func physPage(pc *pageCipher, ptr uint64) uint64 {
+	if pc == nil || ptr == 0 {
+		return ptr // plain file, or the master page which is never encrypted
+	}
+	group, idx := (ptr-1)/CRYPT_GROUP, (ptr-1)%CRYPT_GROUP
+	return tagPage(group) + 1 + idx
+}
+
+// the file offset of the tag page of a group
+func tagPage(group uint64) uint64 {
+	return 1 + group*(CRYPT_GROUP+1)
+}
+
+// the file size in number of pages to hold `npages` pages of the tree
+func physPages(pc *pageCipher, npages uint64) uint64 {
+	if npages <= 1 {
+		return npages
+	}
+	return physPage(pc, npages-1) + 1
+}
+
+// the nonce and the tag of a page in its tag page
+func pageTag(chunks [][]byte, ptr uint64) []byte {
+	tags := mmapPage(chunks, tagPage((ptr-1)/CRYPT_GROUP))
+	offset := CRYPT_OVERHEAD * ((ptr - 1) % CRYPT_GROUP)
+	return tags[offset : offset+CRYPT_OVERHEAD]
+}
+
+// the page number is the associated data, so a page moved elsewhere won't decrypt
+func pageAD(ptr uint64) []byte {
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], ptr)
+	return ad[:]
+}
+
+// read a page from the mapped file, decrypting it if needed
+func readPage(pc *pageCipher, chunks [][]byte, ptr uint64) []byte {
+	data := mmapPage(chunks, physPage(pc, ptr))
+	if pc == nil {
+		return data
+	}
+	tag := pageTag(chunks, ptr)
+	sealed := append(append(make([]byte, 0, BTREE_PAGE_SIZE+CRYPT_TAG), data...), tag[CRYPT_NONCE:]...)
+	page, err := pc.aead.Open(sealed[:0], tag[:CRYPT_NONCE], sealed, pageAD(ptr))
+	if err != nil {
+		corrupt("page %d: %v", ptr, err)
+	}
+	return page
+}
+
+// write a page to the mapped file, encrypting it if needed
+func writePage(pc *pageCipher, chunks [][]byte, ptr uint64, page []byte) {
+	data := mmapPage(chunks, physPage(pc, ptr))
+	if pc == nil {
+		copy(data, page)
+		return
+	}
+	tag := pageTag(chunks, ptr)
+	_, err := rand.Read(tag[:CRYPT_NONCE])
+	assert(err == nil)
+	sealed := pc.aead.Seal(nil, tag[:CRYPT_NONCE], page, pageAD(ptr))
+	copy(data, sealed[:BTREE_PAGE_SIZE])
+	copy(tag[CRYPT_NONCE:], sealed[BTREE_PAGE_SIZE:])
+}
+
+// set up the cipher of a new file
+func cipherNew(db *DB) error {
+	if db.opts.EncryptionKey == nil {
+		return nil
+	}
+	pc, err := newPageCipher(db.opts.EncryptionKey, nil)
+	db.crypt = pc
+	return err
+}
+
+// set up the cipher recorded in the master page, the key must match
+func cipherLoad(db *DB, cipherID int, salt []byte, check []byte) error {
+	switch {
+	case cipherID == CIPHER_NONE && db.opts.EncryptionKey == nil:
+		return nil
+	case cipherID == CIPHER_NONE:
+		return errors.New("the database is not encrypted")
+	case cipherID != CIPHER_AES_GCM:
+		return fmt.Errorf("unknown cipher %d", cipherID)
+	case db.opts.EncryptionKey == nil:
+		return errors.New("the database is encrypted, a key is required")
+	}
+	pc, err := newPageCipher(db.opts.EncryptionKey, bytes.Clone(salt))
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(pc.check, check) {
+		return errWrongKey
+	}
+	db.crypt = pc
+	return nil
+}
@@ -0,0 +1,141 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"db.com/m/internal/kvtest"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEncryptedKV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, &Options{EncryptionKey: testKey})
+	ref := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		key, val := fmt.Sprintf("secret-key-%05d", i), fmt.Sprintf("secret-val-%05d-%s", i, strings.Repeat("z", i%500))
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		ref[key] = val
+	}
+	if db.page.flushed < 3*CRYPT_GROUP {
+		t.Fatalf("only %d pages, expect several groups", db.page.flushed)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("secret-key-new"), []byte("secret-val-new")); err != nil {
+		t.Fatal(err)
+	}
+	ref["secret-key-new"] = "secret-val-new"
+	db.Close()
+
+	// no plaintext in the file
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"secret", "zzzzzzzz"} {
+		if bytes.Contains(data, []byte(plain)) {
+			t.Fatalf("%q found in the file", plain)
+		}
+	}
+
+	db = openTestKV(t, path, &Options{EncryptionKey: testKey})
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if got := kvtest.Dump(db.Seek(nil)); fmt.Sprint(got) != fmt.Sprint(kvtest.Sorted(ref)) {
+		t.Fatal("reopened keys don't match")
+	}
+	db.Close()
+
+	for name, key := range map[string][]byte{
+		"no key":    nil,
+		"wrong key": []byte("0123456789abcdef0123456789abcdeX"),
+		"bad key":   []byte("short"),
+	} {
+		db, err := Open(path, &Options{EncryptionKey: key})
+		if err == nil {
+			db.Close()
+			t.Fatalf("%s: opened", name)
+		}
+	}
+}
+
+func TestEncryptionMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, nil)
+	if err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, err := Open(path, &Options{EncryptionKey: testKey})
+	if err == nil {
+		db.Close()
+		t.Fatal("a plain file opened with a key")
+	}
+}
+
+func TestEncryptedPageSwap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, &Options{EncryptionKey: testKey})
+	for i := 0; i < 500; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := db.tree.root
+	kids := BNode(db.tree.get(root))
+	leaf1, leaf2 := kids.getPtr(0), kids.getPtr(1)
+	db.Close()
+
+	// swap two pages, along with their nonces and tags
+	swap := func(a uint64, b uint64) {
+		fp, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		swapAt := func(a int64, b int64, size int) {
+			bufA, bufB := make([]byte, size), make([]byte, size)
+			_, _ = fp.ReadAt(bufA, a)
+			_, _ = fp.ReadAt(bufB, b)
+			_, _ = fp.WriteAt(bufB, a)
+			_, _ = fp.WriteAt(bufA, b)
+		}
+		swapAt(int64(physPage(db.crypt, a))*BTREE_PAGE_SIZE, int64(physPage(db.crypt, b))*BTREE_PAGE_SIZE, BTREE_PAGE_SIZE)
+		tagOffset := func(ptr uint64) int64 {
+			return int64(tagPage((ptr-1)/CRYPT_GROUP))*BTREE_PAGE_SIZE + int64(CRYPT_OVERHEAD*((ptr-1)%CRYPT_GROUP))
+		}
+		swapAt(tagOffset(a), tagOffset(b), CRYPT_OVERHEAD)
+	}
+
+	// the leaves fail to authenticate on reads
+	swap(leaf1, leaf2)
+	db = openTestKV(t, path, &Options{EncryptionKey: testKey})
+	if _, _, err := db.Get([]byte("key00000")); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Get of a swapped page: %v", err)
+	}
+	if err := db.Verify(); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "authentication failed") {
+		t.Fatalf("Verify of a swapped page: %v", err)
+	}
+	db.Close()
+
+	// the root fails on open
+	swap(leaf1, leaf2)
+	swap(root, leaf1)
+	if db, err := Open(path, &Options{EncryptionKey: testKey}); !errors.Is(err, ErrCorrupt) {
+		if err == nil {
+			db.Close()
+		}
+		t.Fatalf("opened a swapped root: %v", err)
+	}
+}
@@ -1,9 +1,10 @@
-package main
+package godb
 
 import (
 	"bytes"
 	"encoding/binary"
-	"unsafe"
+	"errors"
+	"time"
 )
 
 const HEADER = 4
@@ -29,12 +30,60 @@ type BTree struct {
 	// pointer (a nonzero page number)
 	root uint64
 
-	// callbacks for managing on-disk pages
-	get func(uint64) []byte // dereference a pointer
-	new func([]byte) uint64 // allocate a new page
-	del func(uint64)        // deallocate a page
+	// the pages, see PageStore
+	store PageStore
+
+	// the key order, bytes.Compare if nil
+	cmp func([]byte, []byte) int
+
+	// the reads and updates of a transaction, recorded if not nil
+	log *txLog
+
+	// the splits and merges are counted if not nil
+	metrics *dbMetrics
+}
+
+// dereference a pointer
+func (tree *BTree) get(ptr uint64) []byte {
+	return tree.store.Read(ptr)
+}
+
+// allocate a new page
+func (tree *BTree) new(node []byte) uint64 {
+	return tree.store.Allocate(node)
+}
+
+// deallocate a page
+func (tree *BTree) del(ptr uint64) {
+	tree.store.Free(ptr)
 }
 
+// update modes
+const (
+	MODE_UPSERT      = 0 // insert or replace
+	MODE_UPDATE_ONLY = 1 // update existing keys
+	MODE_INSERT_ONLY = 2 // only add new keys
+	MODE_CAS         = 3 // replace if the old value matches `Expect`
+)
+
+// an insert or update of a key
+type UpdateReq struct {
+	Key    []byte
+	Val    []byte
+	Mode   int
+	Expect []byte        // the old value for MODE_CAS
+	TTL    time.Duration // DB only: expire the key after this long, 0 for never
+	// out
+	Added bool   // a new key was added
+	Old   []byte // the value of an existing key, also set if the update failed
+}
+
+var (
+	ErrKeyExists     = errors.New("key already exists")
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrValueMismatch = errors.New("old value doesn't match")
+)
+
 // HEADER
 const (
 	BNODE_NODE = 1 // internal nodes without values
@@ -117,16 +166,27 @@ func (node BNode) nbytes() uint16 {
 	return node.kvPos(node.nkeys())
 }
 
+// compare keys in the order of the tree, the dummy key is always the first
+func (tree *BTree) compare(a []byte, b []byte) int {
+	switch {
+	case tree.cmp == nil:
+		return bytes.Compare(a, b)
+	case len(a) == 0 || len(b) == 0:
+		return len(a) - len(b)
+	}
+	return tree.cmp(a, b)
+}
+
 // returns the first kid node whose range intesects the key (kid[i] <=key)
 // TODO: binary search
-func nodeLookUpLE(node BNode, key []byte) uint16 {
+func nodeLookUpLE(tree *BTree, node BNode, key []byte) uint16 {
 	nkeys := node.nkeys()
 	found := uint16(0)
 
 	// the first key is  copy from the parent node,
 	// thus it's always less than or equal to the key
 	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
+		cmp := tree.compare(node.getKey(i), key)
 		if cmp <= 0 {
 			found = i
 		}
@@ -141,9 +201,18 @@ func nodeLookUpLE(node BNode, key []byte) uint16 {
 func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
 	new.setHeader(BNODE_LEAF, old.nkeys()+1)
 	nodeAppendRange(new, old, 0, 0, idx)
+	nodeAppendKV(new, idx, 0, key, val)
 	nodeAppendRange(new, old, idx+1, idx, old.nkeys()-idx)
 }
 
+// update an existing key of a leaf node
+func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
+	new.setHeader(BNODE_LEAF, old.nkeys())
+	nodeAppendRange(new, old, 0, 0, idx)
+	nodeAppendKV(new, idx, 0, key, val)
+	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-(idx+1))
+}
+
 // copy a KV into position
 func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
 	// ptrs
@@ -203,18 +272,52 @@ func nodeReplaceKidN(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNod
 
 // split a oversized node into 2 so that the 2nd node always fits on a page
 func nodeSplit2(left BNode, right BNode, old BNode) {
-	// TODO:  will do later
+	assert(old.nkeys() >= 2)
+
+	// the initial guess
+	nleft := old.nkeys() / 2
+
+	// try to fit the left half
+	leftBytes := func() uint16 {
+		return HEADER + 8*nleft + 2*nleft + old.getOffset(nleft)
+	}
+	for leftBytes() > BTREE_PAGE_SIZE {
+		nleft--
+	}
+	assert(nleft >= 1)
+
+	// try to fit the right half
+	rightBytes := func() uint16 {
+		return old.nbytes() - leftBytes() + HEADER
+	}
+	for rightBytes() > BTREE_PAGE_SIZE {
+		nleft++
+	}
+	assert(nleft < old.nkeys())
+	nright := old.nkeys() - nleft
+
+	left.setHeader(old.btype(), nleft)
+	right.setHeader(old.btype(), nright)
+	nodeAppendRange(left, old, 0, 0, nleft)
+	nodeAppendRange(right, old, 0, nleft, nright)
+
+	// the left half may be still too big
+	assert(right.nbytes() <= BTREE_PAGE_SIZE)
 }
 
 // split a node if its too big, the results are 1-3 nodes
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
+func nodeSplit3(tree *BTree, old BNode) (uint16, [3]BNode) {
 	if old.nbytes() <= BTREE_PAGE_SIZE {
 		old = old[:BTREE_PAGE_SIZE]
 		return 1, [3]BNode{old} // did not split
 	}
+	if tree.metrics != nil {
+		tree.metrics.splits.Add(1)
+	}
 
 	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE)) // might be split later
 	right := BNode(make([]byte, BTREE_PAGE_SIZE))
+	nodeSplit2(left, right, old)
 	if left.nbytes() <= BTREE_PAGE_SIZE {
 		left = left[:BTREE_PAGE_SIZE]
 		return 2, [3]BNode{left, right} // 2 nodes
@@ -233,71 +336,162 @@ func nodeSplit3(old BNode) (uint16, [3]BNode) {
 // the caller is responsivle for deallocationg the input node
 //  and splitting and allocationg result nodes
 
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+func treeInsert(tree *BTree, node BNode, req *UpdateReq) (BNode, error) {
 	//  the result node
 	//  it's allowed to be bigger than 1 page and will be split if so
 	new := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
 	// where to insert the key?
-	idx := nodeLookUpLE(node, key)
+	idx := nodeLookUpLE(tree, node, req.Key)
 	switch node.btype() {
 	case BNODE_LEAF:
 		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, node.getKey(idx)) {
+		if tree.compare(req.Key, node.getKey(idx)) == 0 {
 			// found the key, update it
-			// leafUpdate(new, node, idx, key, val)
-
+			req.Old = bytes.Clone(node.getVal(idx))
+			if err := checkMode(req, true); err != nil {
+				return BNode{}, err
+			}
+			leafUpdate(new, node, idx, req.Key, req.Val)
 		} else {
+			if err := checkMode(req, false); err != nil {
+				return BNode{}, err
+			}
 			// insert it fter the position
-			leafInsert(new, node, idx+1, key, val)
+			leafInsert(new, node, idx+1, req.Key, req.Val)
+			req.Added = true
 		}
 	case BNODE_NODE:
 		//  internal node, insert it to a kid node
-		nodeInsert(tree, new, node, idx, key, val)
+		if err := nodeInsert(tree, new, node, idx, req); err != nil {
+			return BNode{}, err
+		}
 
 	default:
 		panic("bad node!")
 	}
 
-	return new
+	return new, nil
 }
 
 // part of the treeInsert(): KV insertion to an internl node
-func nodeInsert(tree *BTree, new BNode, node BNode, idx uint16, key []byte, val []byte) {
+func nodeInsert(tree *BTree, new BNode, node BNode, idx uint16, req *UpdateReq) error {
 	kptr := node.getPtr(idx)
 	// recursive insertion to the kid node
-	knode := treeInsert(tree, tree.get(kptr), key, val)
+	knode, err := treeInsert(tree, tree.get(kptr), req)
+	if err != nil {
+		return err // nothing changed
+	}
 
 	// split the result
-	nsplit, split := nodeSplit3(knode)
+	nsplit, split := nodeSplit3(tree, knode)
 
 	// deallocate the kid node
 	tree.del(kptr)
 
 	nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+	return nil
+}
+
+// whether the mode of the request allows the update,
+// `found` tells if the key exists and req.Old is its value
+func checkMode(req *UpdateReq, found bool) error {
+	switch {
+	case found && req.Mode == MODE_INSERT_ONLY:
+		return ErrKeyExists
+	case found && req.Mode == MODE_CAS && !bytes.Equal(req.Old, req.Expect):
+		return ErrValueMismatch
+	case !found && (req.Mode == MODE_UPDATE_ONLY || req.Mode == MODE_CAS):
+		return ErrKeyNotFound
+	}
+	return nil
 }
 
 // HIGH LEVEL INTERFACES
 
-// insert a new key or update an existing key
-func (tree *BTree) Insert(key []byte, val []byte) {
+// get the value of a key
+func (tree *BTree) Get(key []byte) ([]byte, bool) {
+	if tree.log != nil {
+		tree.log.read(key, key)
+	}
+	if tree.root == 0 {
+		return nil, false
+	}
+	return treeGet(tree, tree.get(tree.root), key)
+}
+
+// look up a key in the subtree rooted at node
+func treeGet(tree *BTree, node BNode, key []byte) ([]byte, bool) {
+	idx := nodeLookUpLE(tree, node, key)
+	switch node.btype() {
+	case BNODE_LEAF:
+		if tree.compare(key, node.getKey(idx)) != 0 {
+			return nil, false
+		}
+		return node.getVal(idx), true
+	case BNODE_NODE:
+		return treeGet(tree, tree.get(node.getPtr(idx)), key)
+	default:
+		panic("bad node!")
+	}
+}
+
+// insert a new key or update an existing key;
+// returns whether the key was added, and the old value if it was replaced
+func (tree *BTree) Insert(key []byte, val []byte) (bool, []byte) {
+	req := UpdateReq{Key: key, Val: val}
+	err := tree.Update(&req)
+	assert(err == nil)
+	return req.Added, req.Old
+}
+
+// insert or update a key according to the mode of the request;
+// the tree is unchanged if the mode doesn't allow the update
+func (tree *BTree) Update(req *UpdateReq) (err error) {
+	assert(len(req.Key) <= BTREE_MAX_KEY_SIZE)
+	assert(len(req.Val) <= BTREE_MAX_VAL_SIZE)
+	req.Added, req.Old = false, nil
+	if tree.log != nil {
+		tree.log.read(req.Key, req.Key)
+		defer func() {
+			if err == nil {
+				tree.log.write(txOp{kind: TXOP_SET, key: req.Key, val: req.Val})
+			}
+		}()
+	}
+
 	if tree.root == 0 {
+		if err := checkMode(req, false); err != nil {
+			return err
+		}
+		req.Added = true
+
 		// create the first node
 		root := BNode(make([]byte, BTREE_PAGE_SIZE))
+		if len(req.Key) == 0 {
+			// the empty key lives in the dummy slot
+			root.setHeader(BNODE_LEAF, 1)
+			nodeAppendKV(root, 0, 0, nil, req.Val)
+			tree.root = tree.new(root)
+			return nil
+		}
 		root.setHeader(BNODE_LEAF, 2)
 
 		// a dummy key, this makes the tree cover the whole key space
 		// this a lookup can always find a containing node
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, key, val)
+		nodeAppendKV(root, 1, 0, req.Key, req.Val)
 
 		tree.root = tree.new(root)
 
-		return
+		return nil
 
 	}
 
-	node := treeInsert(tree, tree.get(tree.root), key, val)
-	nsplit, split := nodeSplit3(node)
+	node, err := treeInsert(tree, tree.get(tree.root), req)
+	if err != nil {
+		return err
+	}
+	nsplit, split := nodeSplit3(tree, node)
 	tree.del(tree.root)
 
 	if nsplit > 1 {
@@ -313,11 +507,16 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 	} else {
 		tree.root = tree.new(split[0])
 	}
+	return nil
 }
 
 // delete a key and returns whether the key was there
+// the empty key shares the dummy slot and is never removed
 func (tree *BTree) Delete(key []byte) bool {
-	if tree.root == 0 {
+	if tree.log != nil {
+		tree.log.read(key, key)
+	}
+	if tree.root == 0 || len(key) == 0 {
 		return false // empty tree
 	}
 
@@ -328,47 +527,48 @@ func (tree *BTree) Delete(key []byte) bool {
 	}
 
 	tree.del(tree.root) // deallocate old root
+	tree.root = deleteNewRoot(tree, updated)
+	if tree.log != nil {
+		tree.log.write(txOp{kind: TXOP_DEL, key: key})
+	}
+	return true
+}
 
+// allocate the updated root after deletions, removing the levels with a single kid
+func deleteNewRoot(tree *BTree, updated BNode) uint64 {
 	// Handle root updates
 	switch updated.btype() {
 	case BNODE_NODE:
-		if updated.nkeys() == 1 {
+		for updated.nkeys() == 1 {
 			// Root has only one child, make it the new root
-			newRoot := tree.get(updated.getPtr(0))
-			tree.root = tree.new(newRoot)
-			tree.del(updated.getPtr(0)) // deallocate child (it was copied)
-			return true
+			ptr := updated.getPtr(0)
+			updated = tree.get(ptr)
+			if updated.btype() != BNODE_NODE || updated.nkeys() != 1 {
+				return ptr
+			}
+			tree.del(ptr)
 		}
 		// Fall through to normal root update
 	case BNODE_LEAF:
 		if updated.nkeys() == 0 {
 			// Tree is now empty
-			tree.root = 0
-			return true
+			return 0
 		}
 	}
 
 	// Check if root needs splitting (unlikely but possible)
 	if updated.nbytes() <= BTREE_PAGE_SIZE {
-		tree.root = tree.new(updated)
-	} else {
-		// Split the root if it's too large
-		nsplit, split := nodeSplit3(updated)
-		if nsplit > 1 {
-			newRoot := BNode(make([]byte, BTREE_PAGE_SIZE))
-			newRoot.setHeader(BNODE_NODE, nsplit)
-			for i, knode := range split[:nsplit] {
-				ptr := tree.new(knode)
-				newRoot.setPtr(uint16(i), ptr)
-				newRoot.setKey(uint16(i), knode.getKey(0))
-			}
-			tree.root = tree.new(newRoot)
-		} else {
-			tree.root = tree.new(split[0])
-		}
+		return tree.new(updated)
 	}
-
-	return true
+	// Split the root if it's too large
+	nsplit, split := nodeSplit3(tree, updated)
+	newRoot := BNode(make([]byte, BTREE_PAGE_SIZE))
+	newRoot.setHeader(BNODE_NODE, nsplit)
+	for i, knode := range split[:nsplit] {
+		ptr, key := tree.new(knode), knode.getKey(0)
+		nodeAppendKV(newRoot, uint16(i), ptr, key, nil)
+	}
+	return tree.new(newRoot)
 }
 
 // remove a key from a leaf node
@@ -379,7 +579,10 @@ func leafDelete(new BNode, old BNode, idx uint16) {
 }
 
 // merge 2 nodes into 1
-func nodeMerge(new BNode, left BNode, right BNode) {
+func nodeMerge(tree *BTree, new BNode, left BNode, right BNode) {
+	if tree.metrics != nil {
+		tree.metrics.merges.Add(1)
+	}
 	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
 	nodeAppendRange(new, left, 0, 0, left.nkeys())
 	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
@@ -389,16 +592,8 @@ func nodeMerge(new BNode, left BNode, right BNode) {
 func nodeReplace2Kid(new BNode, old BNode, idx uint16, ptr uint64, key []byte) {
 	new.setHeader(BNODE_NODE, old.nkeys()-1)
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendRange(new, old, idx, idx+2, old.nkeys()-(idx+2))
-	new.setPtr(idx, ptr)
-	new.setKey(idx, key)
-}
-
-func (node BNode) setKey(idx uint16, key []byte) {
-	pos := node.kvPos(idx)
-	klen := uint16(len(key))
-	binary.LittleEndian.PutUint16(node[pos:], klen)
-	copy(node[pos+4:], key)
+	nodeAppendKV(new, idx, ptr, key, nil)
+	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+2))
 }
 
 //============================== MERGE CONDITIONS =======================
@@ -439,12 +634,12 @@ func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 	new := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
 
 	// Find the position to delete
-	idx := nodeLookUpLE(node, key)
+	idx := nodeLookUpLE(tree, node, key)
 
 	switch node.btype() {
 	case BNODE_LEAF:
 		// Handle leaf node deletion
-		if !bytes.Equal(key, node.getKey(idx)) {
+		if tree.compare(key, node.getKey(idx)) != 0 {
 			// Key not found
 			return BNode{}
 		}
@@ -474,7 +669,8 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	}
 	tree.del(kptr)
 
-	new := BNode(make([]byte, BTREE_PAGE_SIZE))
+	// the kid's first key may have changed, so the result can be oversized
+	new := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
 
 	// check for mergin
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
@@ -482,60 +678,21 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	switch {
 	case mergeDir < 0: // left
 		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeMerge(merged, sibling, updated)
+		nodeMerge(tree, merged, sibling, updated)
 		tree.del(node.getPtr(idx - 1))
 		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
 	case mergeDir > 0: // right
 		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeMerge(merged, updated, sibling)
+		nodeMerge(tree, merged, updated, sibling)
 		tree.del(node.getPtr(idx + 1))
 		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
 	case mergeDir == 0 && updated.nkeys() == 0:
 		assert(node.nkeys() == 1 && idx == 0) // 1 empty child but no sibling
 		new.setHeader(BNODE_NODE, 0)          // the parent becomes empty too
 	case mergeDir == 0 && updated.nkeys() > 0: // no merge
-		nodeReplaceKidN(tree, new, node, idx, updated)
+		nsplit, split := nodeSplit3(tree, updated)
+		nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
 	}
 
 	return new
 }
-
-// ==================  TEST THE B+TREE ====================== ////////
-
-type C struct {
-	tree  BTree
-	ref   map[string]string // the reference data
-	pages map[uint64]BNode  // in-memory pages
-}
-
-func newC() *C {
-	pages := map[uint64]BNode{}
-	return &C{
-		tree: BTree{
-			get: func(ptr uint64) []byte {
-				node, ok := pages[ptr]
-				assert(ok)
-				return node
-			},
-			new: func(node []byte) uint64 {
-				assert(BNode(node).nbytes() <= BTREE_PAGE_SIZE)
-				ptr := uint64(uintptr(unsafe.Pointer(&node[0])))
-				assert(pages[ptr] == nil)
-				pages[ptr] = node
-				return ptr
-			},
-			del: func(ptr uint64) {
-				assert(pages[ptr] != nil)
-				delete(pages, ptr)
-			},
-		},
-
-		ref:   map[string]string{},
-		pages: pages,
-	}
-}
-
-func (c *C) add(key string, val string) {
-	c.tree.Insert([]byte(key), []byte(val))
-	c.ref[key] = val // reference data
-}
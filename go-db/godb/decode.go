@@ -0,0 +1,53 @@
+package godb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// check raw page bytes before using them as a node. the accessors of BNode
+// trust the layout and only `assert`; a node returned from here can be used
+// with any index below nkeys() without going out of bounds.
+func decodeNode(data []byte) (BNode, error) {
+	if len(data) < HEADER {
+		return nil, fmt.Errorf("page of %d bytes has no header", len(data))
+	}
+	node := BNode(data)
+	btype, nkeys := node.btype(), node.nkeys()
+	if btype != BNODE_NODE && btype != BNODE_LEAF {
+		return nil, fmt.Errorf("bad node type %d", btype)
+	}
+
+	// the pointers and the offsets; the node must fit in a page, or the
+	// 16-bit offsets and nbytes() wrap around
+	kvStart := HEADER + 10*int(nkeys)
+	if kvStart > len(data) || kvStart > BTREE_PAGE_SIZE {
+		return nil, fmt.Errorf("%d keys overflow the page", nkeys)
+	}
+
+	// the KVs, each offset must point right past the previous KV
+	end := kvStart
+	for i := uint16(0); i < nkeys; i++ {
+		pos := end
+		if pos+4 > len(data) {
+			return nil, fmt.Errorf("KV #%d: header overflows the page", i)
+		}
+		klen := int(binary.LittleEndian.Uint16(data[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(data[pos+2:]))
+		if klen > BTREE_MAX_KEY_SIZE || vlen > BTREE_MAX_VAL_SIZE {
+			return nil, fmt.Errorf("KV #%d: bad size %d, %d", i, klen, vlen)
+		}
+		if btype == BNODE_NODE && vlen != 0 {
+			return nil, fmt.Errorf("KV #%d: internal node with a value", i)
+		}
+		end = pos + 4 + klen + vlen
+		if end > len(data) || end > BTREE_PAGE_SIZE {
+			return nil, fmt.Errorf("KV #%d: data overflows the page", i)
+		}
+		offset := int(binary.LittleEndian.Uint16(data[HEADER+8*int(nkeys)+2*int(i):]))
+		if kvStart+offset != end {
+			return nil, fmt.Errorf("KV #%d: bad offset %d", i+1, offset)
+		}
+	}
+	return node, nil
+}
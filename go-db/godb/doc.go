@@ -0,0 +1,13 @@
+// Package godb is an embedded key-value store: a copy-on-write B+tree in a
+// single mmapped file, with transactions, TTLs, watches, compression,
+// encryption at rest, backups, metrics, replication and a Redis-compatible
+// server.
+//
+// A DB is opened with Open and is safe for concurrent use. Reads (Get, Seek)
+// see the last commit without blocking. Writes are grouped in a Tx between
+// Begin and Commit, or made one at a time (Set, Update, Del, ...). Transactions
+// run concurrently on snapshots; Commit returns ErrConflict if another one
+// committed an update to a key the transaction read, and it can be retried.
+//
+// The godbtest package has helpers for the tests of code that embeds it.
+package godb
@@ -0,0 +1,109 @@
+package godb_test
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"db.com/m/godb"
+)
+
+// a database in a fresh directory, removed by the returned func
+func exampleDB(opts *godb.Options) (*godb.DB, func()) {
+	dir, err := os.MkdirTemp("", "godb")
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := godb.Open(filepath.Join(dir, "example.db"), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func ExampleOpen() {
+	db, cleanup := exampleDB(&godb.Options{Codec: godb.CODEC_FLATE})
+	defer cleanup()
+
+	if err := db.Set([]byte("hello"), []byte("world")); err != nil {
+		log.Fatal(err)
+	}
+	val, ok, err := db.Get([]byte("hello"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(val), ok)
+	// Output: world true
+}
+
+func ExampleDB_Seek() {
+	db, cleanup := exampleDB(nil)
+	defer cleanup()
+
+	for _, key := range []string{"b", "a", "d", "c"} {
+		if err := db.Set([]byte(key), []byte("v"+key)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for iter := db.Seek([]byte("b")); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		fmt.Printf("%s=%s\n", key, val)
+	}
+	// Output:
+	// b=vb
+	// c=vc
+	// d=vd
+}
+
+func ExampleDB_Begin() {
+	db, cleanup := exampleDB(nil)
+	defer cleanup()
+
+	// move a balance from one account to another, all or nothing
+	if err := db.Set([]byte("alice"), []byte("10")); err != nil {
+		log.Fatal(err)
+	}
+	var tx godb.Tx
+	db.Begin(&tx)
+	if _, err := tx.Del([]byte("alice")); err != nil {
+		db.Abort(&tx)
+		log.Fatal(err)
+	}
+	err := tx.Update(&godb.UpdateReq{Key: []byte("bob"), Val: []byte("10"), Mode: godb.MODE_INSERT_ONLY})
+	if err != nil {
+		db.Abort(&tx)
+		log.Fatal(err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		log.Fatal(err)
+	}
+
+	_, ok, _ := db.Get([]byte("alice"))
+	val, _, _ := db.Get([]byte("bob"))
+	fmt.Println(ok, string(val))
+	// Output: false 10
+}
+
+func ExampleDB_Watch() {
+	db, cleanup := exampleDB(nil)
+	defer cleanup()
+
+	w := db.Watch([]byte("user:"))
+	defer w.Close()
+	for _, key := range []string{"user:1", "order:1", "user:2"} {
+		if err := db.Set([]byte(key), []byte("x")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		ev := <-w.C
+		fmt.Println(ev.Type == godb.EVENT_INSERT, string(ev.Key))
+	}
+	// Output:
+	// true user:1
+	// true user:2
+}
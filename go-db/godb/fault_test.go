@@ -0,0 +1,298 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"db.com/m/internal/kvtest"
+)
+
+// a simulated disk under a DB file: the writes only reach the disk on fsync.
+// the DB writes the pages through the mmap, which the wrapper doesn't see,
+// so the unsynced writes are the pages changed since the last fsync. the
+// faults are injected on command: failed writes and fsyncs, and a crash
+// that loses, tears or reorders the unsynced writes.
+type faultFile struct {
+	r       *rand.Rand
+	fd      *os.File
+	disk    []byte       // the durable contents
+	clean   []byte       // the file at the last fsync
+	pending []faultWrite // the unsynced writes, in order
+	// the number of writes and fsyncs before the crash, negative for never.
+	// after the crash, the writes only reach the file and fsync fails.
+	crashIn    int
+	crashed    bool
+	failWrite  bool // fail the next write
+	failSync   bool // fail the next fsync, which writes a part of the pages
+	failMaster bool // fail the fsync after the next write, of the master page
+}
+
+type faultWrite struct {
+	off  int
+	data []byte
+}
+
+// what happens to the unsynced writes on a crash
+const (
+	FAULT_DROP    = 0 // none is written
+	FAULT_TEAR    = 1 // all are written, some partially
+	FAULT_REORDER = 2 // some are written, in any order
+)
+
+// the unit of atomic writes
+const FAULT_SECTOR = 512
+
+var errFault = errors.New("injected fault")
+
+// count down to the crash
+func (f *faultFile) tick() {
+	if f.crashIn == 0 {
+		f.crashed = true
+	}
+	f.crashIn--
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.fd.ReadAt(p, off)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.failWrite {
+		f.failWrite = false
+		return 0, errFault
+	}
+	if f.failMaster {
+		f.failMaster, f.failSync = false, true
+	}
+	f.tick()
+	return f.fd.WriteAt(p, off)
+}
+
+func (f *faultFile) Sync() error {
+	f.collect()
+	f.tick()
+	if f.crashed {
+		return errFault
+	}
+	pending := f.pending
+	f.pending = nil
+	if f.failSync {
+		// the kernel gives up on some dirty pages and marks them clean
+		f.failSync = false
+		for _, w := range pending {
+			if f.r.Intn(2) == 0 {
+				f.disk = faultApply(f.disk, w.off, w.data)
+			}
+		}
+		return errFault
+	}
+	for _, w := range pending {
+		f.disk = faultApply(f.disk, w.off, w.data)
+	}
+	return nil
+}
+
+func (f *faultFile) Close() error { return nil } // see DB.Close
+
+// queue the changed pages as unsynced writes
+func (f *faultFile) collect() {
+	data, err := os.ReadFile(f.fd.Name())
+	assert(err == nil)
+	// the file size is taken as durable right away, the new pages are zeros
+	// until written
+	if len(data) > len(f.disk) {
+		f.disk = faultApply(f.disk, len(data), nil)
+	}
+	f.clean = faultApply(f.clean, len(data), nil)
+	for off := 0; off < len(data); off += BTREE_PAGE_SIZE {
+		page := data[off:min(off+BTREE_PAGE_SIZE, len(data))]
+		if bytes.Equal(page, f.clean[off:off+len(page)]) {
+			continue
+		}
+		if !f.crashed {
+			f.pending = append(f.pending, faultWrite{off, page})
+		}
+	}
+	f.clean = data
+}
+
+// the disk after a power loss, with the unsynced writes handled by `mode`
+func (f *faultFile) crash(mode int) []byte {
+	f.collect()
+	disk := bytes.Clone(f.disk)
+	switch mode {
+	case FAULT_DROP:
+	case FAULT_TEAR:
+		for _, w := range f.pending {
+			for i := 0; i < len(w.data); i += FAULT_SECTOR {
+				if f.r.Intn(2) == 0 {
+					end := min(i+FAULT_SECTOR, len(w.data))
+					disk = faultApply(disk, w.off+i, w.data[i:end])
+				}
+			}
+		}
+	case FAULT_REORDER:
+		perm := f.r.Perm(len(f.pending))
+		for _, i := range perm[:f.r.Intn(len(perm)+1)] {
+			disk = faultApply(disk, f.pending[i].off, f.pending[i].data)
+		}
+	}
+	return disk
+}
+
+// write at an offset, extending the data
+func faultApply(data []byte, off int, p []byte) []byte {
+	if end := off + len(p); end > len(data) {
+		data = append(data, make([]byte, end-len(data))...)
+	}
+	copy(data[off:], p)
+	return data
+}
+
+// the committed state of a DB
+type faultState struct {
+	seq uint64
+	ref map[string]string
+}
+
+// random batches, a commit each, until one fails. returns the state of the
+// failed commit, which may or may not be on the disk.
+func faultWorkload(r *rand.Rand, db *DB, last *faultState, commits int) (faultState, error) {
+	for i := 0; i < commits; i++ {
+		next := faultState{seq: last.seq + 1, ref: maps.Clone(last.ref)}
+		ops := make([]Op, 1+r.Intn(10))
+		for j := range ops {
+			key := fmt.Sprintf("key%04d", r.Intn(500))
+			if r.Intn(3) == 0 {
+				ops[j] = Op{Key: []byte(key), Del: true}
+				delete(next.ref, key)
+			} else {
+				val := fmt.Sprintf("val%d", r.Intn(1000))
+				ops[j] = Op{Key: []byte(key), Val: []byte(val)}
+				next.ref[key] = val
+			}
+		}
+		if err := db.ApplyBatch(ops); err != nil {
+			return next, err
+		}
+		*last = next
+	}
+	return faultState{}, nil
+}
+
+// open a DB on a disk with the faults injected under it. the root is read
+// from the master page, and must be one of the given states.
+func faultReopen(t *testing.T, r *rand.Rand, disk []byte, states ...faultState) (*DB, *faultFile, faultState) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(path, disk, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestKV(t, path, nil)
+	file := &faultFile{r: r, fd: db.fd, disk: disk, clean: bytes.Clone(disk), crashIn: -1}
+	db.file = file
+
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(kvtest.Dump(db.Seek(nil)))
+	for _, state := range states {
+		if db.Seq() == state.seq && got == fmt.Sprint(kvtest.Sorted(state.ref)) {
+			return db, file, state
+		}
+	}
+	t.Fatalf("reopened at seq %d, not a committed state", db.Seq())
+	return nil, nil, faultState{}
+}
+
+// crash at random points, it reopens at the last commit or the failed one
+func TestCrashRecovery(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	db, file, last := faultReopen(t, r, nil, faultState{ref: map[string]string{}})
+	for round := 0; round < 30; round++ {
+		// 3 steps a commit: the fsync of the pages, the master page, its fsync
+		file.crashIn = r.Intn(80)
+		failed, err := faultWorkload(r, db, &last, 20)
+		states := []faultState{last}
+		if err != nil {
+			if !errors.Is(err, errFault) {
+				t.Fatal(err)
+			}
+			states = append(states, failed)
+		}
+		db, file, last = faultReopen(t, r, file.crash(r.Intn(3)), states...)
+	}
+}
+
+// a crash in each step of a commit: only the master page on the disk
+// makes the commit
+func TestCrashFaults(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	db, file, last := faultReopen(t, r, nil, faultState{ref: map[string]string{}})
+	if _, err := faultWorkload(r, db, &last, 50); err != nil {
+		t.Fatal(err)
+	}
+	disk := file.crash(FAULT_DROP)
+
+	for _, mode := range []int{FAULT_DROP, FAULT_TEAR, FAULT_REORDER} {
+		// before the fsync of the pages, before the master page, before its fsync
+		for crashIn := 0; crashIn < 3; crashIn++ {
+			db, file, _ := faultReopen(t, r, bytes.Clone(disk), last)
+			file.crashIn = crashIn
+			states := []faultState{last}
+			next := last
+			failed, err := faultWorkload(r, db, &next, 1)
+			if !errors.Is(err, errFault) {
+				t.Fatalf("commit: %v", err)
+			}
+			if crashIn == 2 && mode != FAULT_DROP {
+				states = append(states, failed)
+			}
+			faultReopen(t, r, file.crash(mode), states...)
+		}
+	}
+}
+
+// a failed step of a commit fails the following commits, until reopened
+func TestCrashFailedSync(t *testing.T) {
+	for _, name := range []string{"pages", "master", "master fsync"} {
+		t.Run(name, func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			db, file, last := faultReopen(t, r, nil, faultState{ref: map[string]string{}})
+			if _, err := faultWorkload(r, db, &last, 50); err != nil {
+				t.Fatal(err)
+			}
+			states := []faultState{last}
+			switch name {
+			case "pages":
+				file.failSync = true
+			case "master":
+				file.failWrite = true
+			case "master fsync":
+				file.failMaster = true
+			}
+			next := last
+			failed, err := faultWorkload(r, db, &next, 1)
+			if !errors.Is(err, errFault) {
+				t.Fatalf("commit: %v", err)
+			}
+			if name == "master fsync" {
+				states = append(states, failed)
+			}
+			for i := 0; i < 2; i++ {
+				if err := db.Set([]byte("lost"), []byte("x")); err == nil {
+					t.Fatal("committed after a failure")
+				}
+			}
+			for _, mode := range []int{FAULT_DROP, FAULT_TEAR, FAULT_REORDER} {
+				faultReopen(t, r, file.crash(mode), states...)
+			}
+		})
+	}
+}
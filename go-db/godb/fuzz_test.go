@@ -0,0 +1,136 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// a valid node of each type as seeds
+func fuzzSeedNodes() [][]byte {
+	leaf := BNode(make([]byte, BTREE_PAGE_SIZE))
+	leaf.setHeader(BNODE_LEAF, 3)
+	nodeAppendKV(leaf, 0, 0, nil, nil)
+	nodeAppendKV(leaf, 1, 0, []byte("k1"), []byte("hello"))
+	nodeAppendKV(leaf, 2, 0, []byte("k2"), []byte("world"))
+
+	internal := BNode(make([]byte, BTREE_PAGE_SIZE))
+	internal.setHeader(BNODE_NODE, 2)
+	nodeAppendKV(internal, 0, 7, nil, nil)
+	nodeAppendKV(internal, 1, 9, []byte("m"), nil)
+
+	return [][]byte{leaf[:leaf.nbytes()], internal[:internal.nbytes()], leaf}
+}
+
+// a leaf of empty KVs larger than a page, nbytes() wraps around to 8
+func fuzzOversizedNode() []byte {
+	const NKEYS = 6554
+	kvStart := HEADER + 10*NKEYS
+	data := make([]byte, kvStart+4*NKEYS)
+	node := BNode(data)
+	node.setHeader(BNODE_LEAF, NKEYS)
+	for i := uint16(1); i <= NKEYS; i++ {
+		binary.LittleEndian.PutUint16(data[HEADER+8*NKEYS+2*(int(i)-1):], 4*i)
+	}
+	return data
+}
+
+func FuzzDecodeNode(f *testing.F) {
+	for _, seed := range fuzzSeedNodes() {
+		f.Add(seed, []byte("k1"))
+	}
+	f.Add([]byte{}, []byte{})
+	f.Add([]byte{2, 0, 0xff, 0xff}, []byte("x"))
+	f.Add(fuzzOversizedNode(), []byte("x"))
+
+	f.Fuzz(func(t *testing.T, data []byte, key []byte) {
+		node, err := decodeNode(data)
+		if err != nil {
+			return
+		}
+		// a decoded node can be used without going out of bounds
+		size := 0
+		for i := uint16(0); i < node.nkeys(); i++ {
+			size += 4 + len(node.getKey(i)) + len(node.getVal(i))
+			if node.btype() == BNODE_NODE {
+				node.getPtr(i)
+			}
+		}
+		if int(node.nbytes()) != HEADER+10*int(node.nkeys())+size {
+			t.Fatalf("nbytes %d doesn't match the KVs", node.nbytes())
+		}
+		if node.nkeys() > 0 {
+			nodeLookUpLE(&BTree{}, node, key)
+		}
+	})
+}
+
+// decode fuzz input as a sequence of operations:
+// | op | klen | key | vlen |, where the value is a repeated byte.
+// the tree is checked after each operation, so the sequence is capped.
+func fuzzModelOps(data []byte) []modelOp {
+	var ops []modelOp
+	for len(data) >= 2 && len(ops) < 64 {
+		kind, klen := int(data[0]%4), int(data[1]%16)+1
+		data = data[2:]
+		if klen > len(data) {
+			break
+		}
+		op := modelOp{kind: kind, key: string(data[:klen])}
+		data = data[klen:]
+		if len(data) >= 2 {
+			vlen := int(binary.LittleEndian.Uint16(data)) % (BTREE_MAX_VAL_SIZE + 1)
+			data = data[2:]
+			op.val = string(bytes.Repeat([]byte{byte(vlen)}, vlen))
+		}
+		if op.kind == OP_SCAN {
+			op.val = fmt.Sprint(len(op.val) % 64)
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func FuzzBTreeOps(f *testing.F) {
+	f.Add([]byte("\x00\x02abc\x10\x00\x00\x02abd\xb8\x0b\x02\x02abc\x00\x00\x03\x00a\x05\x00"))
+	seed := []byte{}
+	for i := 0; i < 64; i++ {
+		seed = append(seed, byte(i%3), 3, 'k', byte('a'+i%7), byte(i), 0xb8, 0x0b)
+	}
+	f.Add(seed)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ops := fuzzModelOps(data)
+		if step, err := runModelOps(ops); err != nil {
+			t.Fatalf("step %d %v: %v", step, ops[step], err)
+		}
+	})
+}
+
+func TestDecodeNodeRejects(t *testing.T) {
+	valid := fuzzSeedNodes()[0]
+	if _, err := decodeNode(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := func(f func(b []byte)) []byte {
+		b := append([]byte{}, valid...)
+		f(b)
+		return b
+	}
+	bad := map[string][]byte{
+		"short":       valid[:2],
+		"type":        corrupt(func(b []byte) { b[0] = 9 }),
+		"nkeys":       corrupt(func(b []byte) { b[2] = 0xff }),
+		"offset":      corrupt(func(b []byte) { b[HEADER+8*3+2]++ }),
+		"val length":  corrupt(func(b []byte) { b[HEADER+10*3+4+2] = 0xff }),
+		"truncated":   valid[:len(valid)-1],
+		"offset zero": corrupt(func(b []byte) { b[HEADER+8*3+4] = 0 }),
+	}
+	for name, data := range bad {
+		if _, err := decodeNode(data); err == nil {
+			t.Fatalf("%s: corrupt node accepted", name)
+		}
+	}
+}
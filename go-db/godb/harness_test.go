@@ -0,0 +1,95 @@
+package godb
+
+import (
+	"fmt"
+	"sort"
+)
+
+// the test harness: a tree of in-memory pages and the reference data
+type C struct {
+	tree  BTree
+	ref   map[string]string // the reference data
+	pages map[uint64][]byte // the pages of the store
+}
+
+func newC() *C {
+	store := NewMemStore()
+	return &C{
+		tree:  BTree{store: store},
+		ref:   map[string]string{},
+		pages: store.pages,
+	}
+}
+
+// a store that counts the page reads and allocations of another
+type countingStore struct {
+	PageStore
+	reads  int
+	allocs int
+}
+
+func (s *countingStore) Read(ptr uint64) []byte {
+	s.reads++
+	return s.PageStore.Read(ptr)
+}
+
+func (s *countingStore) Allocate(node []byte) uint64 {
+	s.allocs++
+	return s.PageStore.Allocate(node)
+}
+
+func (c *C) add(key string, val string) {
+	c.tree.Insert([]byte(key), []byte(val))
+	c.ref[key] = val // reference data
+}
+
+func (c *C) del(key string) bool {
+	delete(c.ref, key)
+	return c.tree.Delete([]byte(key))
+}
+
+// compare the tree against the reference data
+func (c *C) check() error {
+	if err := c.tree.Verify(); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(c.ref))
+	for key := range c.ref {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// ordered iteration yields exactly the reference data
+	i := 0
+	for iter := c.tree.SeekLE(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if _, ok := c.ref[""]; len(key) == 0 && !ok {
+			continue // the dummy key
+		}
+		if i >= len(keys) {
+			return fmt.Errorf("extra key %q", key)
+		}
+		if string(key) != keys[i] || string(val) != c.ref[keys[i]] {
+			return fmt.Errorf("iteration: got %q, expect %q", key, keys[i])
+		}
+		i++
+	}
+	if i < len(keys) {
+		return fmt.Errorf("iteration: missing key %q", keys[i])
+	}
+
+	for _, key := range keys {
+		val, ok := c.tree.Get([]byte(key))
+		if !ok || string(val) != c.ref[key] {
+			return fmt.Errorf("Get(%q) = %q, %v", key, val, ok)
+		}
+	}
+
+	// no page is leaked
+	stats := c.tree.Stats()
+	if n := stats.Internal + stats.Leaves; n != len(c.pages) {
+		return fmt.Errorf("%d pages allocated, %d in the tree", len(c.pages), n)
+	}
+	return nil
+}
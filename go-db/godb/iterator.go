@@ -0,0 +1,133 @@
+package godb
+
+import "bytes"
+
+// B-tree iterator
+type BIter struct {
+	tree *BTree
+	path []BNode  // from root to leaf
+	pos  []uint16 // indexes into nodes
+	read int      // the range of tree.log.reads it extends
+}
+
+// find the closest position that is less or equal to the input key
+func (tree *BTree) SeekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	if tree.log != nil {
+		iter.read = tree.log.read(key, key)
+		defer iter.track(0)
+	}
+	if tree.root == 0 {
+		return iter // empty tree
+	}
+	for ptr := tree.root; ptr != 0; {
+		node := BNode(tree.get(ptr))
+		idx := nodeLookUpLE(tree, node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.btype() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		} else {
+			ptr = 0
+		}
+	}
+	return iter
+}
+
+// find the first position that is greater or equal to the input key
+func (tree *BTree) Seek(key []byte) *BIter {
+	iter := tree.SeekLE(key)
+	if iter.Valid() {
+		if cur, _ := iter.Deref(); tree.compare(cur, key) < 0 {
+			iter.Next()
+		}
+	}
+	if tree.log != nil {
+		// nothing before the key was used
+		tree.log.reads[iter.read].start = bytes.Clone(key)
+	}
+	return iter
+}
+
+// precondition of Deref()
+func (iter *BIter) Valid() bool {
+	last := len(iter.path) - 1
+	return last >= 0 && iter.pos[last] < iter.path[last].nkeys()
+}
+
+// get the current KV pair
+func (iter *BIter) Deref() ([]byte, []byte) {
+	assert(iter.Valid())
+	last := len(iter.path) - 1
+	node, idx := iter.path[last], iter.pos[last]
+	return node.getKey(idx), node.getVal(idx)
+}
+
+// moving forward
+func (iter *BIter) Next() {
+	iterMove(iter, len(iter.path)-1, +1)
+	iter.track(+1)
+}
+
+// moving backward
+func (iter *BIter) Prev() {
+	iterMove(iter, len(iter.path)-1, -1)
+	iter.track(-1)
+}
+
+// extend the range read by a transaction to the position
+func (iter *BIter) track(dir int) {
+	log := iter.tree.log
+	if log == nil {
+		return
+	}
+	r := &log.reads[iter.read]
+	if !iter.Valid() {
+		// moved past an edge, or an empty tree
+		if dir <= 0 {
+			r.start = nil
+		}
+		if dir >= 0 {
+			r.open = true
+		}
+		return
+	}
+	key, _ := iter.Deref()
+	if iter.tree.compare(key, r.start) < 0 {
+		r.start = bytes.Clone(key)
+	}
+	if !r.open && iter.tree.compare(key, r.end) > 0 {
+		r.end = bytes.Clone(key)
+	}
+}
+
+// move the position at a level, carrying over to the parent at the edges
+func iterMove(iter *BIter, level int, dir int) {
+	if level < 0 || !iter.Valid() {
+		return
+	}
+	idx := int(iter.pos[level]) + dir
+	if 0 <= idx && idx < int(iter.path[level].nkeys()) {
+		iter.pos[level] = uint16(idx)
+	} else if level > 0 {
+		iterMove(iter, level-1, dir)
+		if !iter.Valid() {
+			return
+		}
+	} else {
+		// past the first or the last key, the iterator becomes invalid
+		last := len(iter.path) - 1
+		iter.pos[last] = iter.path[last].nkeys()
+		return
+	}
+	if level+1 < len(iter.pos) {
+		// the parent moved, descend into the new kid
+		kid := BNode(iter.tree.get(iter.path[level].getPtr(iter.pos[level])))
+		iter.path[level+1] = kid
+		if dir > 0 {
+			iter.pos[level+1] = 0
+		} else {
+			iter.pos[level+1] = kid.nkeys() - 1
+		}
+	}
+}
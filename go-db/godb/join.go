@@ -0,0 +1,197 @@
+package godb
+
+import (
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+)
+
+// an equi-join of the rows so far with another table. with joins, the output
+// columns are named `table.col`, including those of the queried table; the
+// conditions of Query.Where and Join.Where use the plain names of their table.
+type Join struct {
+	Table string
+	On    string // a column of the rows so far, e.g. "people.city"
+	Col   string // the column of the joined table that equals it
+	Left  bool   // LEFT JOIN: keep the rows without a match, with NULLs
+	Where []Cond // conditions on the rows of the joined table
+}
+
+// for each outer row, the inner rows whose column equals the outer column.
+// with an index starting with the column, the inner rows are found by a seek
+// (index nested loop); otherwise the inner plan is rerun for each outer row
+// (nested loop).
+type joinNode struct {
+	outer      planNode
+	outerTable string // the table of the outer rows, if their names are plain
+	tdef       *TableDef
+	on         string
+	col        string
+	left       bool
+	inner      planNode
+	seek       *seekNode // nil for a nested loop
+}
+
+// the rows of a table whose column equals the value of the outer row, by a
+// range of an index starting with the column
+type seekNode struct {
+	tdef  *TableDef
+	index int
+	outer string // the outer column, for EXPLAIN
+	val   Value  // set by the join for each outer row
+}
+
+// plan the joins of a query over the access path of its table
+func planJoins(tree *BTree, node planNode, tdef *TableDef, joins []Join) (planNode, error) {
+	tables := []string{tdef.Name}
+	outerTable := tdef.Name
+	for _, join := range joins {
+		inner, err := getTableDef(tree, join.Table)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(tables, inner.Name) {
+			return nil, fmt.Errorf("table %s: joined twice", inner.Name)
+		}
+		tables = append(tables, inner.Name)
+		if err := checkConds(inner.Cols, inner.Types, join.Where); err != nil {
+			return nil, fmt.Errorf("table %s: %w", inner.Name, err)
+		}
+		cols, types := qualify(node, outerTable)
+		outer := slices.Index(cols, join.On)
+		idx := inner.colIndex(join.Col)
+		switch {
+		case outer < 0:
+			return nil, fmt.Errorf("join %s: unknown column %s", inner.Name, join.On)
+		case idx < 0:
+			return nil, fmt.Errorf("join %s: unknown column %s", inner.Name, join.Col)
+		case types[outer] != inner.Types[idx]:
+			return nil, fmt.Errorf("join %s: %s and %s are of different types", inner.Name, join.On, join.Col)
+		}
+
+		jn := &joinNode{
+			outer: node, outerTable: outerTable, tdef: inner,
+			on: join.On, col: join.Col, left: join.Left,
+		}
+		// the primary key first
+		for index := -1; index < len(inner.Indexes); index++ {
+			if inner.indexCols(index)[0] == join.Col {
+				jn.seek = &seekNode{tdef: inner, index: index, outer: join.On}
+				break
+			}
+		}
+		if jn.seek != nil {
+			jn.inner = jn.seek
+			if len(join.Where) > 0 {
+				jn.inner = &filterNode{input: jn.seek, conds: join.Where}
+			}
+		} else {
+			jn.inner = planAccess(inner, join.Where)
+		}
+		node, outerTable = jn, ""
+	}
+	return node, nil
+}
+
+// the columns of the rows of a node, named `table.col` if they are plain
+func qualify(node planNode, table string) ([]string, []uint32) {
+	cols, types := node.schema()
+	if table == "" {
+		return cols, types
+	}
+	named := make([]string, len(cols))
+	for i, col := range cols {
+		named[i] = table + "." + col
+	}
+	return named, types
+}
+
+func (node *joinNode) rows(tree *BTree) iter.Seq[Record] {
+	return func(yield func(Record) bool) {
+		cols, _ := node.schema()
+		innerCols := len(node.tdef.Cols)
+		for rec := range node.outer.rows(tree) {
+			rec = Record{Cols: cols[:len(cols)-innerCols], Vals: rec.Vals}
+			v := *rec.Get(node.on)
+			matched := false
+			if v.Type != TYPE_NULL {
+				if node.seek != nil {
+					node.seek.val = v
+				}
+				for row := range node.inner.rows(tree) {
+					if node.seek == nil && cmpValue(*row.Get(node.col), v) != 0 {
+						continue
+					}
+					matched = true
+					out := Record{Cols: cols, Vals: append(slices.Clone(rec.Vals), row.Vals...)}
+					if !yield(out) {
+						return
+					}
+				}
+			}
+			if !matched && node.left {
+				out := Record{Cols: cols, Vals: append(slices.Clone(rec.Vals), make([]Value, innerCols)...)}
+				if !yield(out) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (node *joinNode) explain() (string, []planNode) {
+	kind := "NestedLoopJoin"
+	if node.seek != nil {
+		kind = "IndexNestedLoopJoin"
+	}
+	if node.left {
+		kind = "Left" + kind
+	}
+	line := fmt.Sprintf("%s %s = %s.%s", kind, node.on, node.tdef.Name, node.col)
+	return line, []planNode{node.outer, node.inner}
+}
+
+func (node *joinNode) schema() ([]string, []uint32) {
+	cols, types := qualify(node.outer, node.outerTable)
+	cols, types = slices.Clone(cols), slices.Clone(types)
+	for i, col := range node.tdef.Cols {
+		cols = append(cols, node.tdef.Name+"."+col)
+		types = append(types, node.tdef.Types[i])
+	}
+	return cols, types
+}
+
+// the order of the outer rows
+func (node *joinNode) order() ([]string, int) {
+	cols, fixed := node.outer.order()
+	if node.outerTable == "" {
+		return cols, fixed
+	}
+	named := make([]string, len(cols))
+	for i, col := range cols {
+		named[i] = node.outerTable + "." + col
+	}
+	return named, fixed
+}
+
+func (node *seekNode) rows(tree *BTree) iter.Seq[Record] {
+	return (&rangeNode{tdef: node.tdef, index: node.index, eq: []Value{node.val}}).rows(tree)
+}
+
+func (node *seekNode) explain() (string, []planNode) {
+	kind := "IndexSeek"
+	if node.index < 0 {
+		kind = "PKSeek"
+	}
+	cols := node.tdef.indexCols(node.index)
+	return fmt.Sprintf("%s %s(%s) %s = %s", kind, node.tdef.Name, strings.Join(cols, ", "), cols[0], node.outer), nil
+}
+
+func (node *seekNode) schema() ([]string, []uint32) {
+	return node.tdef.Cols, node.tdef.Types
+}
+
+func (node *seekNode) order() ([]string, int) {
+	return node.tdef.indexCols(node.index), 1
+}
@@ -0,0 +1,198 @@
+package godb
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// people, cities and pets in the in-memory pages of the harness:
+// people.city -> cities.name (the primary key), pets.owner -> people.id (no index)
+func joinTables(t *testing.T) (*BTree, map[string][]Record) {
+	c := newC()
+	tree := &c.tree
+	for _, tdef := range []*TableDef{
+		{Name: "people", Types: []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES, TYPE_INT64},
+			Cols: []string{"id", "name", "city", "age"}, PKeys: 1, Indexes: [][]string{{"city", "age"}, {"name"}}},
+		{Name: "cities", Types: []uint32{TYPE_BYTES, TYPE_BYTES, TYPE_INT64},
+			Cols: []string{"name", "country", "pop"}, PKeys: 1, Indexes: [][]string{{"country"}}},
+		{Name: "pets", Types: []uint32{TYPE_INT64, TYPE_INT64, TYPE_BYTES},
+			Cols: []string{"id", "owner", "kind"}, PKeys: 1},
+	} {
+		if err := tableCreate(tree, tdef); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := rand.New(rand.NewSource(4))
+	rows := map[string][]Record{}
+	insert := func(table string, rec Record) {
+		tdef, err := getTableDef(tree, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tableSet(tree, tdef, rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatal(err)
+		}
+		rows[table] = append(rows[table], rec)
+	}
+	// "lima" is not a city
+	cities := []string{"oslo", "paris", "rome", "lima"}
+	countries := []string{"no", "fr", "it"}
+	for i, city := range cities[:3] {
+		rec := Record{}
+		rec.AddStr("name", []byte(city)).AddStr("country", []byte(countries[i])).AddInt64("pop", int64(i+1)*1000)
+		insert("cities", rec)
+	}
+	for i := 0; i < 200; i++ {
+		insert("people", person(int64(i), fmt.Sprintf("name%d", r.Intn(50)), cities[r.Intn(4)], int64(r.Intn(80))))
+	}
+	for i := 0; i < 150; i++ {
+		rec := Record{}
+		rec.AddInt64("id", int64(i)).AddInt64("owner", int64(r.Intn(250))).AddStr("kind", []byte([]string{"cat", "dog"}[r.Intn(2)]))
+		insert("pets", rec)
+	}
+	if err := c.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	return tree, rows
+}
+
+func TestExplainJoin(t *testing.T) {
+	tree, _ := joinTables(t)
+	cases := []struct {
+		q      Query
+		expect string
+	}{
+		{Query{Table: "people", Joins: []Join{{Table: "cities", On: "people.city", Col: "name"}}},
+			`IndexNestedLoopJoin people.city = cities.name
+  Scan people
+  PKSeek cities(name) name = people.city`},
+		{Query{Table: "cities", Joins: []Join{{Table: "people", On: "cities.name", Col: "city", Left: true,
+			Where: []Cond{intCond("age", OP_GT, 30)}}}},
+			`LeftIndexNestedLoopJoin cities.name = people.city
+  Scan cities
+  Filter age > 30
+    IndexSeek people(city, age, id) city = cities.name`},
+		{Query{Table: "people", Where: []Cond{intCond("id", OP_LT, 10)},
+			Joins: []Join{{Table: "pets", On: "people.id", Col: "owner", Where: []Cond{strCond("kind", OP_EQ, "cat")}}}},
+			`NestedLoopJoin people.id = pets.owner
+  PKRange people(id) id < 10
+  Filter kind = "cat"
+    Scan pets`},
+		// the order of the people groups them by city
+		{Query{Table: "people", Where: []Cond{strCond("city", OP_GE, "o")},
+			Joins:   []Join{{Table: "cities", On: "people.city", Col: "name"}},
+			GroupBy: []string{"people.city"}, Aggs: []Agg{{AGG_COUNT, ""}, {AGG_MAX, "cities.pop"}}},
+			`StreamAggregate people.city: count(*), max(cities.pop)
+  IndexNestedLoopJoin people.city = cities.name
+    IndexRange people(city, age, id) city >= "o"
+    PKSeek cities(name) name = people.city`},
+	}
+	for _, c := range cases {
+		node, err := planQuery(tree, &c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(explainPlan(node)); got != c.expect {
+			t.Fatalf("%v:\n%s\nexpect:\n%s", c.q, got, c.expect)
+		}
+	}
+
+	for _, join := range []Join{
+		{Table: "nope", On: "people.city", Col: "name"},
+		{Table: "people", On: "people.id", Col: "id"},
+		{Table: "cities", On: "city", Col: "name"},
+		{Table: "cities", On: "people.city", Col: "nope"},
+		{Table: "cities", On: "people.id", Col: "name"},
+		{Table: "cities", On: "people.city", Col: "name", Where: []Cond{intCond("name", OP_EQ, 1)}},
+	} {
+		if _, err := planQuery(tree, &Query{Table: "people", Joins: []Join{join}}); err == nil {
+			t.Fatalf("%v: planned", join)
+		}
+	}
+}
+
+// every join returns the rows of a brute-force nested loop over all rows
+func TestJoinMatchesBruteForce(t *testing.T) {
+	tree, rows := joinTables(t)
+	r := rand.New(rand.NewSource(5))
+	for i := 0; i < 200; i++ {
+		q := Query{Table: "people"}
+		switch r.Intn(3) {
+		case 0:
+			q.Where = []Cond{strCond("city", OP_EQ, []string{"oslo", "lima"}[r.Intn(2)])}
+		case 1:
+			q.Where = []Cond{intCond("id", OP_LT, int64(r.Intn(200)))}
+		}
+		joins := []Join{
+			{Table: "cities", On: "people.city", Col: "name"},
+			{Table: "pets", On: "people.id", Col: "owner"},
+		}
+		r.Shuffle(len(joins), func(i, j int) { joins[i], joins[j] = joins[j], joins[i] })
+		for _, join := range joins[:1+r.Intn(2)] {
+			join.Left = r.Intn(2) == 0
+			if r.Intn(3) == 0 {
+				if join.Table == "pets" {
+					join.Where = []Cond{strCond("kind", OP_EQ, "dog")}
+				} else {
+					join.Where = []Cond{intCond("pop", OP_GT, 1000)}
+				}
+			}
+			q.Joins = append(q.Joins, join)
+		}
+
+		node, err := planQuery(tree, &q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []Record
+		for rec := range node.rows(tree) {
+			got = append(got, rec)
+		}
+		expect := bruteJoin(rows, &q)
+		if sortGroups(got) != sortGroups(expect) {
+			t.Fatalf("%v: %d rows, expect %d\n%s", q, len(got), len(expect), explainPlan(node))
+		}
+	}
+}
+
+func bruteJoin(tables map[string][]Record, q *Query) []Record {
+	qualified := func(table string, rec Record) Record {
+		out := Record{Vals: rec.Vals}
+		for _, col := range rec.Cols {
+			out.Cols = append(out.Cols, table+"."+col)
+		}
+		return out
+	}
+	var out []Record
+	for _, rec := range tables[q.Table] {
+		if matchAll(rec, q.Where) {
+			out = append(out, qualified(q.Table, rec))
+		}
+	}
+	for _, join := range q.Joins {
+		var next []Record
+		for _, rec := range out {
+			matched := false
+			for _, row := range tables[join.Table] {
+				v := rec.Get(join.On)
+				if v.Type == TYPE_NULL || cmpValue(*v, *row.Get(join.Col)) != 0 || !matchAll(row, join.Where) {
+					continue
+				}
+				matched = true
+				row = qualified(join.Table, row)
+				next = append(next, Record{Cols: append(rec.Cols[:len(rec.Cols):len(rec.Cols)], row.Cols...),
+					Vals: append(rec.Vals[:len(rec.Vals):len(rec.Vals)], row.Vals...)})
+			}
+			if !matched && join.Left {
+				null := qualified(join.Table, Record{Cols: tables[join.Table][0].Cols})
+				next = append(next, Record{Cols: append(rec.Cols[:len(rec.Cols):len(rec.Cols)], null.Cols...),
+					Vals: append(rec.Vals[:len(rec.Vals):len(rec.Vals)], make([]Value, len(null.Cols))...)})
+			}
+		}
+		out = next
+	}
+	return out
+}
@@ -0,0 +1,723 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const DB_SIG = "GoPracticeDB-v02" // v02: values are wrapped in an envelope, see ttl.go
+
+// the master page is the first page of the file:
+// | sig | btree_root | page_used | codec | cipher | salt | key check | comparator | seq | history |
+// | 16B |     8B     |    8B     |  4B   |   4B   | 16B  |    16B    |    32B     | 8B  |   16B   |
+//
+// seq is the sequence number of the last commit, and history a random ID of
+// the commits numbered by it, see repl.go. files made before it have zeros.
+//
+// pages are never reused, so the tree of any past root stays intact;
+// that's what readers and backups rely on when they pin a root.
+// the file only shrinks by compaction, which rewrites the live tree.
+
+// the options of a database, the zero value is a plain file without sweeper
+type Options struct {
+	SweepEvery time.Duration // delete expired keys periodically, 0 to disable
+	Codec      int           // compress values, the file keeps the codec it was created with
+	// encrypt the pages of a new file with AES-GCM; required to open an encrypted file
+	EncryptionKey []byte
+	// the key order of a new file, the byte order if zero;
+	// required to open a file created with a comparator that isn't built in
+	Comparator Comparator
+	// where to report the metrics, see metrics.go; nil for none
+	Metrics Metrics
+}
+
+// a file-backed key-value store, safe for concurrent use
+type DB struct {
+	path string
+	opts Options
+	fd   *os.File
+	file StoreFile  // fd, or a wrapper of it in the tests: the master page and fsync
+	mu   sync.Mutex // serializes the commits
+	tree BTree      // updated by the commits
+	seq  uint64     // the sequence number of the last commit
+	hist [16]byte   // the ID of the history of seq, guarded by mu
+	mmap mmapState
+	page struct {
+		flushed uint64   // database size in number of pages
+		temp    [][]byte // newly allocated pages
+		err     error    // a failed sync, which fails the later commits
+	}
+	// the last committed tree, pinned by readers
+	reader struct {
+		sync.RWMutex
+		root   uint64
+		seq    uint64
+		chunks [][]byte
+		crypt  *pageCipher
+		// the file generation, bumped by Compact. the mmaps of a replaced
+		// file are kept until the trees pinned on it are released.
+		gen     uint64
+		pins    map[uint64]int
+		retired map[uint64][][]byte
+	}
+	// the ongoing transactions and the writes they may conflict with, see occ.go
+	txs struct {
+		sync.Mutex
+		version uint64         // the number of commits
+		ongoing map[uint64]int // the number of transactions by snapshot version
+		history []txCommit
+	}
+	// the commits kept for the followers, and whether this is one, see repl.go
+	repl    replLog
+	replica bool
+	watch   watchList
+	now     func() time.Time // the clock of TTLs
+	codec   compressor
+	crypt   *pageCipher // nil for a plain file
+	metrics *dbMetrics
+	sweep   struct {
+		stop chan struct{}
+		done chan struct{}
+	}
+}
+
+// a file mapped in chunks
+type mmapState struct {
+	file   int      // file size, can be larger than the database size
+	total  int      // mmap size, can be larger than the file size
+	chunks [][]byte // multiple mmaps, can be non-continuous
+}
+
+var (
+	errEmptyKey    = errors.New("empty key")
+	errReservedKey = errors.New("keys starting with 0 are reserved")
+)
+
+// open or create a database file, `opts` can be nil for the defaults
+func Open(path string, opts *Options) (*DB, error) {
+	db := &DB{path: path}
+	if opts != nil {
+		db.opts = *opts
+	}
+	db.metrics = newDBMetrics(db.opts.Metrics)
+	if err := db.open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *DB) open() error {
+	fd, err := os.OpenFile(db.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("OpenFile: %w", err)
+	}
+	db.fd, db.file = fd, fd
+
+	if err := db.load(); err != nil {
+		db.Close()
+		return fmt.Errorf("open: %w", err)
+	}
+	if db.opts.SweepEvery > 0 {
+		db.sweep.stop, db.sweep.done = make(chan struct{}), make(chan struct{})
+		go db.sweeper(db.opts.SweepEvery, db.sweep.stop, db.sweep.done)
+	}
+	return nil
+}
+
+func (db *DB) load() error {
+	size, chunk, err := mmapInit(db.fd)
+	if err != nil {
+		return err
+	}
+	db.mmap.file = size
+	db.mmap.total = len(chunk)
+	db.mmap.chunks = [][]byte{chunk}
+
+	db.tree.store = dbStore{db}
+	db.tree.metrics = db.metrics
+	if db.now == nil {
+		db.now = time.Now
+	}
+	if err := masterLoad(db); err != nil {
+		return err
+	}
+	if err := loadRoot(db); err != nil {
+		return err
+	}
+	db.publish()
+	return nil
+}
+
+// read the root page, which fails to decrypt with a wrong key or a bad file
+func loadRoot(db *DB) (err error) {
+	defer catchCorrupt(&err)
+	if db.tree.root != 0 {
+		_, err = decodeNode(db.tree.get(db.tree.root))
+	}
+	return err
+}
+
+// cleanups; pinned trees must not be used afterwards
+func (db *DB) Close() {
+	if db.sweep.stop != nil {
+		close(db.sweep.stop)
+		<-db.sweep.done
+		db.sweep.stop = nil
+	}
+	db.unwatchAll()
+	munmapAll(db.mmap.chunks)
+	for _, chunks := range db.reader.retired {
+		munmapAll(chunks)
+	}
+	db.mmap.chunks, db.reader.retired = nil, nil
+	if db.fd != nil {
+		_ = db.fd.Close()
+		db.fd = nil
+	}
+}
+
+// read the db, expired keys are hidden; the error is a corruption.
+// the value is a copy.
+func (db *DB) Get(key []byte) (val []byte, ok bool, err error) {
+	defer catchCorrupt(&err)
+	if len(key) == 0 || key[0] == 0 {
+		return nil, false, nil
+	}
+	tree := db.pin()
+	defer db.unpin(tree.store)
+	val, ok, _, err = lookupLive(&tree, key, db.now().UnixNano())
+	return bytes.Clone(val), ok, err
+}
+
+// an iterator over the committed user keys, without the expired ones.
+// it stops at a value that fails to decode, see Err.
+type Iter struct {
+	iter *BIter
+	now  int64
+	end  bool // reached the reserved keys, which sort last with a comparator
+	err  error
+	db   *DB // the pinned tree is released when done, nil for a Tx
+}
+
+// find the first key that is greater or equal to the input key.
+// the iterator pins the last commit until it's done or closed.
+func (db *DB) Seek(key []byte) *Iter {
+	tree := db.pin()
+	it := seekLive(&tree, key, db.now().UnixNano())
+	it.db = db
+	if !it.Valid() {
+		it.Close()
+	}
+	return it
+}
+
+func seekLive(tree *BTree, key []byte, now int64) *Iter {
+	key, _ = userRange(tree, key, nil)
+	it := &Iter{iter: tree.Seek(key), now: now}
+	it.skip()
+	return it
+}
+
+func (it *Iter) Valid() bool {
+	return !it.end && it.err == nil && it.iter.Valid()
+}
+
+// release the pinned tree, which is done when the iteration ends. an
+// iterator left open keeps the mmaps of a compacted file until DB.Close.
+func (it *Iter) Close() {
+	if it.db != nil {
+		it.end = true // the pages may be unmapped
+		it.db.unpin(it.iter.tree.store)
+		it.db = nil
+	}
+}
+
+// the key and the value point into the database, they're valid until the
+// iterator is done or closed. a corrupt value is nil and ends the iteration.
+func (it *Iter) Deref() ([]byte, []byte) {
+	key, raw := it.iter.Deref()
+	val, _, err := decodeVal(raw)
+	if err != nil {
+		it.err = fmt.Errorf("key %q: %w", bytes.Clone(key), err)
+	}
+	return key, val
+}
+
+// the corrupt value that ended the iteration, if any
+func (it *Iter) Err() error {
+	return it.err
+}
+
+func (it *Iter) Next() {
+	it.iter.Next()
+	it.skip()
+	if !it.Valid() {
+		it.Close()
+	}
+}
+
+// move past the dummy key and the expired keys
+func (it *Iter) skip() {
+	defer catchCorrupt(&it.err)
+	for ; it.iter.Valid(); it.iter.Next() {
+		key, raw := it.iter.Deref()
+		if len(key) == 0 {
+			continue
+		}
+		if key[0] == 0 {
+			it.end = true
+			return
+		}
+		if expire := valExpire(raw); expire == 0 || expire > it.now {
+			return
+		}
+	}
+}
+
+// update the db
+func (db *DB) Set(key []byte, val []byte) error {
+	return db.Update(&UpdateReq{Key: key, Val: val})
+}
+
+// insert or update a key according to the mode of the request
+func (db *DB) Update(req *UpdateReq) error {
+	return db.transact(func(tx *Tx) error {
+		return tx.Update(req)
+	})
+}
+
+// delete a key and returns whether the key was there
+func (db *DB) Del(key []byte) (bool, error) {
+	deleted := false
+	err := db.transact(func(tx *Tx) (err error) {
+		deleted, err = tx.Del(key)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+// delete all keys in [start, end), a nil end means to the last key
+func (db *DB) DeleteRange(start []byte, end []byte) (int, error) {
+	count := 0
+	err := db.transact(func(tx *Tx) error {
+		count = tx.DeleteRange(start, end)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// apply the mutations with a single pass over the tree and a single commit
+func (db *DB) ApplyBatch(ops []Op) error {
+	return db.transact(func(tx *Tx) error {
+		return tx.ApplyBatch(ops)
+	})
+}
+
+// the empty key is reserved for the dummy key of the tree,
+// and the keys starting with 0 for internal data
+func checkKV(key []byte, val []byte) error {
+	switch {
+	case len(key) == 0:
+		return errEmptyKey
+	case key[0] == 0:
+		return errReservedKey
+	case len(key) > BTREE_MAX_KEY_SIZE:
+		return fmt.Errorf("key of %d bytes is too large", len(key))
+	case len(val) > BTREE_MAX_VAL_SIZE-VAL_HEADER_MAX:
+		return fmt.Errorf("value of %d bytes is too large", len(val))
+	}
+	return nil
+}
+
+// a read-only tree of the last committed root;
+// it stays valid across later updates because pages are never reused
+func (db *DB) pin() BTree {
+	tree, _ := db.pinSeq()
+	return tree
+}
+
+// pin the last committed tree with its sequence number, until unpin
+func (db *DB) pinSeq() (BTree, uint64) {
+	db.reader.Lock()
+	defer db.reader.Unlock()
+
+	if db.reader.pins == nil {
+		db.reader.pins = map[uint64]int{}
+	}
+	db.reader.pins[db.reader.gen]++
+	return BTree{
+		root: db.reader.root,
+		cmp:  db.tree.cmp, // set once by Open
+		store: readStore{
+			chunks: db.reader.chunks, crypt: db.reader.crypt,
+			metrics: db.metrics, gen: db.reader.gen,
+		},
+	}, db.reader.seq
+}
+
+// release the store of a pinned tree; the last tree on a replaced file unmaps it
+func (db *DB) unpin(store PageStore) {
+	gen := store.(readStore).gen
+	db.reader.Lock()
+	defer db.reader.Unlock()
+	assert(db.reader.pins[gen] > 0)
+	if db.reader.pins[gen]--; db.reader.pins[gen] > 0 {
+		return
+	}
+	delete(db.reader.pins, gen)
+	if chunks, ok := db.reader.retired[gen]; ok {
+		munmapAll(chunks)
+		delete(db.reader.retired, gen)
+	}
+}
+
+// the pages of a commit, for the readers
+type readStore struct {
+	chunks  [][]byte
+	crypt   *pageCipher
+	metrics *dbMetrics
+	gen     uint64 // of the file, for unpin
+}
+
+func (s readStore) Read(ptr uint64) []byte {
+	s.metrics.pagesRead.Add(1)
+	return readPage(s.crypt, s.chunks, ptr)
+}
+
+func (s readStore) Allocate([]byte) uint64 { panic("read-only tree") }
+func (s readStore) Free(uint64)            { panic("read-only tree") }
+func (s readStore) Sync() error            { return nil }
+func (s readStore) Close() error           { return nil }
+
+// the pages of the database for the writer: the new pages are kept in memory
+// until the commit writes them with the master page
+type dbStore struct {
+	db *DB
+}
+
+func (s dbStore) Read(ptr uint64) []byte {
+	s.db.metrics.pagesRead.Add(1)
+	return s.db.pageGet(ptr)
+}
+
+func (s dbStore) Allocate(node []byte) uint64 { return s.db.pageNew(node) }
+
+func (s dbStore) Free(ptr uint64) {
+	s.db.metrics.pagesFreed.Add(1)
+	s.db.pageDel(ptr)
+}
+
+func (s dbStore) Sync() error  { return flushPages(s.db) }
+func (s dbStore) Close() error { return nil } // see DB.Close
+
+// make the committed tree visible to readers
+func (db *DB) publish() {
+	db.reader.Lock()
+	defer db.reader.Unlock()
+	db.publishLocked()
+}
+
+// make the tree of a new file visible to readers; the mmaps of the old file
+// go with the last tree pinned on it
+func (db *DB) publishFile(old [][]byte) {
+	db.reader.Lock()
+	defer db.reader.Unlock()
+	if db.reader.pins[db.reader.gen] > 0 {
+		if db.reader.retired == nil {
+			db.reader.retired = map[uint64][][]byte{}
+		}
+		db.reader.retired[db.reader.gen] = old
+	} else {
+		munmapAll(old)
+	}
+	db.reader.gen++
+	db.publishLocked()
+}
+
+func (db *DB) publishLocked() {
+	db.reader.root = db.tree.root
+	db.reader.seq = db.seq
+	db.reader.chunks = db.mmap.chunks
+	db.reader.crypt = db.crypt
+}
+
+// persist the newly allocated pages, or restore the in-memory state on failure
+func updateOrRevert(db *DB, root uint64) error {
+	flushed := db.page.flushed
+	err := flushPages(db)
+	if err != nil {
+		// the file may contain garbage past the used pages,
+		// it is overwritten by the next update
+		db.tree.root = root
+		db.page.flushed = flushed
+		db.page.temp = db.page.temp[:0]
+		return err
+	}
+	db.publish()
+	return nil
+}
+
+// persist the newly allocated pages after updates
+func flushPages(db *DB) error {
+	if db.page.err != nil {
+		return db.page.err
+	}
+	if err := writePages(db); err != nil {
+		return err
+	}
+	// after a failed sync, the master page may be on the disk or not, and
+	// the kernel may have dropped the pages. the next commit would overwrite
+	// the pages of a root that may be durable, so the file is left as it is
+	// until reopened.
+	if err := syncPages(db); err != nil {
+		db.page.err = err
+		return err
+	}
+	return nil
+}
+
+func writePages(db *DB) error {
+	// extend the file & mmap if needed
+	npages := int(physPages(db.crypt, db.page.flushed+uint64(len(db.page.temp))))
+	if err := extendFile(db.fd, &db.mmap, npages); err != nil {
+		return err
+	}
+	if err := extendMmap(db.fd, &db.mmap, npages); err != nil {
+		return err
+	}
+
+	// copy data to the file
+	for i, page := range db.page.temp {
+		writePage(db.crypt, db.mmap.chunks, db.page.flushed+uint64(i), page)
+	}
+	db.metrics.pagesWritten.Add(uint64(len(db.page.temp)))
+	db.page.flushed += uint64(len(db.page.temp))
+	db.page.temp = db.page.temp[:0]
+	return nil
+}
+
+func syncPages(db *DB) error {
+	// flush data to the disk. must be done before updating the master page.
+	if err := fsync(db); err != nil {
+		return err
+	}
+	// update & flush the master page
+	if err := masterStore(db); err != nil {
+		return err
+	}
+	return fsync(db)
+}
+
+// flush the file, timed
+func fsync(db *DB) error {
+	start := time.Now()
+	err := db.file.Sync()
+	db.metrics.fsync.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+// callback for BTree, dereference a pointer
+func (db *DB) pageGet(ptr uint64) []byte {
+	if ptr >= db.page.flushed {
+		return db.page.temp[ptr-db.page.flushed]
+	}
+	return readPage(db.crypt, db.mmap.chunks, ptr)
+}
+
+// callback for BTree, allocate a new page
+func (db *DB) pageNew(node []byte) uint64 {
+	assert(BNode(node).nbytes() <= BTREE_PAGE_SIZE)
+	page := make([]byte, BTREE_PAGE_SIZE)
+	copy(page, node)
+	ptr := db.page.flushed + uint64(len(db.page.temp))
+	db.page.temp = append(db.page.temp, page)
+	return ptr
+}
+
+// callback for BTree, deallocate a page
+func (db *DB) pageDel(uint64) {
+	// pages are never reused
+}
+
+func munmapAll(chunks [][]byte) {
+	for _, chunk := range chunks {
+		err := syscall.Munmap(chunk)
+		assert(err == nil)
+	}
+}
+
+// find the page in the mmap chunks
+func mmapPage(chunks [][]byte, ptr uint64) []byte {
+	start := uint64(0)
+	for _, chunk := range chunks {
+		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
+		if ptr < end {
+			offset := BTREE_PAGE_SIZE * (ptr - start)
+			return chunk[offset : offset+BTREE_PAGE_SIZE]
+		}
+		start = end
+	}
+	panic("bad ptr")
+}
+
+// create the initial mmap that covers the whole file
+func mmapInit(fd *os.File) (int, []byte, error) {
+	fi, err := fd.Stat()
+	if err != nil {
+		return 0, nil, fmt.Errorf("stat: %w", err)
+	}
+	if fi.Size()%BTREE_PAGE_SIZE != 0 {
+		return 0, nil, errors.New("file size is not a multiple of page size")
+	}
+
+	mmapSize := 64 << 20
+	assert(mmapSize%BTREE_PAGE_SIZE == 0)
+	for mmapSize < int(fi.Size()) {
+		mmapSize *= 2
+	}
+	// mmapSize can be larger than the file
+	chunk, err := syscall.Mmap(
+		int(fd.Fd()), 0, mmapSize,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
+	)
+	if err != nil {
+		return 0, nil, fmt.Errorf("mmap: %w", err)
+	}
+	return int(fi.Size()), chunk, nil
+}
+
+// extend the mmap by adding new mappings
+func extendMmap(fd *os.File, m *mmapState, npages int) error {
+	for m.total < npages*BTREE_PAGE_SIZE {
+		// double the address space
+		chunk, err := syscall.Mmap(
+			int(fd.Fd()), int64(m.total), m.total,
+			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
+		)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+		m.total += m.total
+		m.chunks = append(m.chunks, chunk)
+	}
+	return nil
+}
+
+// extend the file to at least `npages`
+func extendFile(fd *os.File, m *mmapState, npages int) error {
+	filePages := m.file / BTREE_PAGE_SIZE
+	if filePages >= npages {
+		return nil
+	}
+	for filePages < npages {
+		// the file size is increased exponentially,
+		// so that we don't have to extend the file for every update
+		inc := filePages / 8
+		if inc < 1 {
+			inc = 1
+		}
+		filePages += inc
+	}
+	fileSize := filePages * BTREE_PAGE_SIZE
+	if err := fd.Truncate(int64(fileSize)); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	m.file = fileSize
+	return nil
+}
+
+// the master page
+func masterLoad(db *DB) error {
+	if err := checkCodec(db.opts.Codec); err != nil {
+		return err
+	}
+	data := db.mmap.chunks[0]
+	if db.mmap.file == 0 || bytes.Equal(data[:16], make([]byte, 16)) {
+		// empty file, or the file was extended but the first update never
+		// committed. the master page will be created on the first write.
+		db.page.flushed = 1 // reserved for the master page
+		db.hist = historyNew()
+		if err := comparatorNew(db); err != nil {
+			return err
+		}
+		return cipherNew(db)
+	}
+	root := binary.LittleEndian.Uint64(data[16:])
+	used := binary.LittleEndian.Uint64(data[24:])
+	codec := int(binary.LittleEndian.Uint32(data[32:]))
+	cipherID := int(binary.LittleEndian.Uint32(data[36:]))
+	salt, check := data[40:56], data[56:72]
+	cmpName := string(bytes.TrimRight(data[72:72+CMP_NAME_MAX], "\x00"))
+	seq := binary.LittleEndian.Uint64(data[72+CMP_NAME_MAX:])
+	hist := data[80+CMP_NAME_MAX : 96+CMP_NAME_MAX]
+
+	// verify the page
+	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
+		return errors.New("bad signature")
+	}
+	if err := cipherLoad(db, cipherID, salt, check); err != nil {
+		return err
+	}
+	bad := !(1 <= used && physPages(db.crypt, used) <= uint64(db.mmap.file/BTREE_PAGE_SIZE))
+	bad = bad || !(root < used)
+	if bad {
+		return errors.New("bad master page")
+	}
+	if err := checkCodec(codec); err != nil {
+		return err
+	}
+	if db.opts.Codec != CODEC_NONE && db.opts.Codec != codec {
+		return fmt.Errorf("the database was created with codec %d, not %d", codec, db.opts.Codec)
+	}
+	db.opts.Codec = codec
+	if err := comparatorLoad(db, cmpName); err != nil {
+		return err
+	}
+
+	db.tree.root = root
+	db.page.flushed = used
+	db.seq = seq
+	copy(db.hist[:], hist)
+	return nil
+}
+
+// update the master page. it must be atomic.
+func masterStore(db *DB) error {
+	var data [96 + CMP_NAME_MAX]byte
+	copy(data[:16], []byte(DB_SIG))
+	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
+	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	binary.LittleEndian.PutUint32(data[32:], uint32(db.opts.Codec))
+	if db.crypt != nil {
+		binary.LittleEndian.PutUint32(data[36:], CIPHER_AES_GCM)
+		copy(data[40:56], db.crypt.salt)
+		copy(data[56:72], db.crypt.check)
+	}
+	if db.tree.cmp != nil {
+		copy(data[72:], db.opts.Comparator.Name)
+	}
+	binary.LittleEndian.PutUint64(data[72+CMP_NAME_MAX:], db.seq)
+	copy(data[80+CMP_NAME_MAX:], db.hist[:])
+	// NOTE: Updating the page via mmap is not atomic.
+	//       Use the `pwrite()` syscall instead.
+	_, err := db.file.WriteAt(data[:], 0)
+	if err != nil {
+		return fmt.Errorf("write master page: %w", err)
+	}
+	return nil
+}
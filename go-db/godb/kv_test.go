@@ -0,0 +1,117 @@
+package godb
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"db.com/m/internal/kvtest"
+)
+
+// open a database file, closed when the test ends
+func openTestKV(t *testing.T, path string, opts *Options) *DB {
+	t.Helper()
+	return kvtest.Open(t, func() (*DB, error) { return Open(path, opts) })
+}
+
+// all KVs in order, the dummy key excluded
+func dumpTree(tree *BTree) [][2]string {
+	var kvs [][2]string
+	for iter := tree.SeekLE(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if len(key) > 0 {
+			kvs = append(kvs, [2]string{string(key), string(val)})
+		}
+	}
+	return kvs
+}
+
+func TestKVReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, nil)
+	ref := map[string]string{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", r.Intn(1000))
+		if r.Intn(4) == 0 {
+			_, ok := ref[key]
+			deleted, err := db.Del([]byte(key))
+			if err != nil || deleted != ok {
+				t.Fatalf("Del(%s) = %v, %v", key, deleted, err)
+			}
+			delete(ref, key)
+		} else {
+			val := fmt.Sprintf("val%d", i)
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			ref[key] = val
+		}
+	}
+	db.Close()
+
+	db = openTestKV(t, path, nil)
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	got, expect := kvtest.Dump(db.Seek(nil)), kvtest.Sorted(ref)
+	if fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Fatal("reopened database doesn't match")
+	}
+	for key, val := range ref {
+		if v, ok, _ := db.Get([]byte(key)); !ok || string(v) != val {
+			t.Fatalf("Get(%s) = %q, %v", key, v, ok)
+		}
+	}
+}
+
+func TestKVBadInput(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	if err := db.Set(nil, []byte("v")); err != errEmptyKey {
+		t.Fatal("empty key accepted")
+	}
+	if err := db.Set(make([]byte, BTREE_MAX_KEY_SIZE+1), nil); err == nil {
+		t.Fatal("oversized key accepted")
+	}
+	if _, ok, _ := db.Get([]byte("missing")); ok {
+		t.Fatal("found a missing key")
+	}
+}
+
+func TestBTreeIterator(t *testing.T) {
+	c := newC()
+	for i := 0; i < 2000; i++ {
+		c.add(fmt.Sprintf("%05d", i*2), fmt.Sprint(i))
+	}
+
+	iter := c.tree.SeekLE([]byte("00101"))
+	if key, _ := iter.Deref(); string(key) != "00100" {
+		t.Fatalf("SeekLE: %s", key)
+	}
+	iter = c.tree.Seek([]byte("00101"))
+	if key, _ := iter.Deref(); string(key) != "00102" {
+		t.Fatalf("Seek: %s", key)
+	}
+
+	// forward and backward over the whole tree
+	expect := kvtest.Sorted(c.ref)
+	if got := dumpTree(&c.tree); fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Fatal("forward iteration mismatch")
+	}
+	iter = c.tree.SeekLE([]byte("99999"))
+	for i := len(expect) - 1; i >= 0; i-- {
+		key, _ := iter.Deref()
+		if string(key) != expect[i][0] {
+			t.Fatalf("backward iteration: %s, expect %s", key, expect[i][0])
+		}
+		iter.Prev()
+	}
+	if key, _ := iter.Deref(); len(key) != 0 {
+		t.Fatal("expect the dummy key at the start")
+	}
+	iter.Prev()
+	if iter.Valid() {
+		t.Fatal("iterator should be past the first key")
+	}
+}
@@ -0,0 +1,207 @@
+package godb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// where a DB reports its metrics, see Options.Metrics. a Registry is one,
+// or it can be an adapter to another metrics library.
+type Metrics interface {
+	// the counter of a name, the same one for the same name
+	Counter(name string, help string) Counter
+	// the histogram of a name, `buckets` are the increasing upper bounds
+	Histogram(name string, help string, buckets []float64) Histogram
+}
+
+type Counter interface {
+	Add(delta uint64)
+}
+
+type Histogram interface {
+	Observe(value float64)
+}
+
+// the metrics of a DB
+const (
+	METRIC_PAGES_READ    = "godb_pages_read_total"
+	METRIC_PAGES_WRITTEN = "godb_pages_written_total"
+	METRIC_PAGES_FREED   = "godb_pages_freed_total"
+	METRIC_SPLITS        = "godb_node_splits_total"
+	METRIC_MERGES        = "godb_node_merges_total"
+	METRIC_COMMIT        = "godb_commit_seconds"
+	METRIC_FSYNC         = "godb_fsync_seconds"
+)
+
+// the buckets of the latencies, from 10µs to 10s
+var LATENCY_BUCKETS = []float64{1e-5, 1e-4, 5e-4, 1e-3, 5e-3, 0.01, 0.05, 0.1, 0.5, 1, 10}
+
+// the instruments of a DB, no-ops without Options.Metrics
+type dbMetrics struct {
+	pagesRead    Counter
+	pagesWritten Counter
+	pagesFreed   Counter
+	splits       Counter
+	merges       Counter
+	commit       Histogram
+	fsync        Histogram
+}
+
+func newDBMetrics(m Metrics) *dbMetrics {
+	if m == nil {
+		m = nopMetrics{}
+	}
+	return &dbMetrics{
+		pagesRead:    m.Counter(METRIC_PAGES_READ, "Pages read from the database file."),
+		pagesWritten: m.Counter(METRIC_PAGES_WRITTEN, "Pages written to the database file."),
+		pagesFreed:   m.Counter(METRIC_PAGES_FREED, "Pages freed by the updates."),
+		splits:       m.Counter(METRIC_SPLITS, "Nodes split by the updates."),
+		merges:       m.Counter(METRIC_MERGES, "Nodes merged by the updates."),
+		commit:       m.Histogram(METRIC_COMMIT, "Commit latency in seconds.", LATENCY_BUCKETS),
+		fsync:        m.Histogram(METRIC_FSYNC, "Fsync time in seconds.", LATENCY_BUCKETS),
+	}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string, string) Counter                { return nopMetric{} }
+func (nopMetrics) Histogram(string, string, []float64) Histogram { return nopMetric{} }
+
+type nopMetric struct{}
+
+func (nopMetric) Add(uint64)      {}
+func (nopMetric) Observe(float64) {}
+
+// metrics in memory, exported in the Prometheus text format by WriteText,
+// or over HTTP as an http.Handler to be mounted at /metrics
+type Registry struct {
+	mu         sync.Mutex
+	counters   map[string]*registryCounter
+	histograms map[string]*registryHistogram
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   map[string]*registryCounter{},
+		histograms: map[string]*registryHistogram{},
+	}
+}
+
+type registryCounter struct {
+	help  string
+	value atomic.Uint64
+}
+
+func (c *registryCounter) Add(delta uint64) {
+	c.value.Add(delta)
+}
+
+type registryHistogram struct {
+	help    string
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64 // by bucket, the last one is +Inf
+	sum     float64
+}
+
+func (h *registryHistogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value) // the first bound >= value
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += value
+	h.mu.Unlock()
+}
+
+func (r *Registry) Counter(name string, help string) Counter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert(r.histograms[name] == nil)
+	c := r.counters[name]
+	if c == nil {
+		c = &registryCounter{help: help}
+		r.counters[name] = c
+	}
+	return c
+}
+
+func (r *Registry) Histogram(name string, help string, buckets []float64) Histogram {
+	assert(slices.IsSorted(buckets))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert(r.counters[name] == nil)
+	h := r.histograms[name]
+	if h == nil {
+		h = &registryHistogram{
+			help:    help,
+			buckets: slices.Clone(buckets),
+			counts:  make([]uint64, len(buckets)+1),
+		}
+		r.histograms[name] = h
+	}
+	return h
+}
+
+// the text exposition format of Prometheus, the metrics are sorted by name
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.counters)+len(r.histograms))
+	for name := range r.counters {
+		names = append(names, name)
+	}
+	for name := range r.histograms {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	slices.Sort(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		r.mu.Lock()
+		c, h := r.counters[name], r.histograms[name]
+		r.mu.Unlock()
+		if c != nil {
+			fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", name, c.help, name)
+			fmt.Fprintf(bw, "%s %d\n", name, c.value.Load())
+			continue
+		}
+		h.mu.Lock()
+		counts, sum := slices.Clone(h.counts), h.sum
+		h.mu.Unlock()
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s histogram\n", name, h.help, name)
+		total := uint64(0) // the buckets are cumulative
+		for i, count := range counts {
+			total += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(bw, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(le), total)
+		}
+		fmt.Fprintf(bw, "%s_sum %s\n%s_count %d\n", name, formatFloat(sum), name, total)
+	}
+	return bw.Flush()
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.WriteText(w)
+}
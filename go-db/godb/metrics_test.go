@@ -0,0 +1,110 @@
+package godb
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRegistryText(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("b_total", "A counter.")
+	c.Add(3)
+	r.Counter("b_total", "ignored").Add(1)
+	h := r.Histogram("a_seconds", "A histogram.", []float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		h.Observe(v)
+	}
+
+	var sb strings.Builder
+	if err := r.WriteText(&sb); err != nil {
+		t.Fatal(err)
+	}
+	expect := `# HELP a_seconds A histogram.
+# TYPE a_seconds histogram
+a_seconds_bucket{le="0.1"} 2
+a_seconds_bucket{le="1"} 3
+a_seconds_bucket{le="+Inf"} 4
+a_seconds_sum 2.65
+a_seconds_count 4
+# HELP b_total A counter.
+# TYPE b_total counter
+b_total 4
+`
+	if sb.String() != expect {
+		t.Fatalf("got:\n%s", sb.String())
+	}
+}
+
+// the value of a sample in the text format
+func metricValue(t *testing.T, text string, sample string) float64 {
+	t.Helper()
+	m := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(sample) + ` (\S+)$`).FindStringSubmatch(text)
+	if m == nil {
+		t.Fatalf("no %s in:\n%s", sample, text)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestDBMetrics(t *testing.T) {
+	registry := NewRegistry()
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), &Options{Metrics: registry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// split the nodes, then merge them
+	const N = 500
+	val := []byte(strings.Repeat("v", 100))
+	for i := 0; i < N; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%05d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < N-10; i++ {
+		if _, err := db.Del([]byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Get([]byte("key00499"))
+
+	// the endpoint
+	srv := httptest.NewServer(registry)
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(body)
+
+	for _, name := range []string{METRIC_PAGES_READ, METRIC_PAGES_WRITTEN, METRIC_PAGES_FREED, METRIC_SPLITS, METRIC_MERGES} {
+		if metricValue(t, text, name) == 0 {
+			t.Errorf("%s is 0", name)
+		}
+	}
+	if got := metricValue(t, text, METRIC_COMMIT+"_count"); got != 2*N-10 {
+		t.Errorf("%v commits", got)
+	}
+	// 2 per commit
+	if got := metricValue(t, text, METRIC_FSYNC+"_count"); got != 2*(2*N-10) {
+		t.Errorf("%v fsyncs", got)
+	}
+	if metricValue(t, text, METRIC_FSYNC+`_bucket{le="+Inf"}`) != metricValue(t, text, METRIC_FSYNC+"_count") {
+		t.Error("the +Inf bucket is not the count")
+	}
+}
@@ -0,0 +1,227 @@
+package godb
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	modelSeed  = flag.Int64("model.seed", 0, "replay a single model test seed")
+	modelBase  = flag.Int64("model.base", 1, "the seed of the first model test run, 0 for the clock")
+	modelRuns  = flag.Int("model.runs", 20, "number of random model test runs")
+	modelSteps = flag.Int("model.steps", 1500, "operations per model test run")
+)
+
+const (
+	OP_INSERT = iota // add a new key
+	OP_UPDATE        // overwrite an existing key
+	OP_DELETE        // delete a key, which may be missing
+	OP_SCAN          // iterate over a range
+)
+
+type modelOp struct {
+	kind int
+	key  string
+	val  string // the value, or the number of keys to scan
+}
+
+func (op modelOp) String() string {
+	name := [...]string{"insert", "update", "delete", "scan"}[op.kind]
+	val := op.val
+	if len(val) > 8 {
+		val = fmt.Sprintf("%.8s...(%d bytes)", val, len(val))
+	}
+	return fmt.Sprintf("%s(%q, %q)", name, op.key, val)
+}
+
+// a random sequence of operations; keys are drawn from a small space so that
+// updates and deletes hit existing keys, and values are sometimes large to
+// build a deep tree quickly
+func genModelOps(seed int64, n int) []modelOp {
+	r := rand.New(rand.NewSource(seed))
+	keys := []string{}
+	randKey := func() string {
+		return fmt.Sprintf("k%0*d", 1+r.Intn(8), r.Intn(2000))
+	}
+	randVal := func() string {
+		size := r.Intn(20)
+		if r.Intn(10) == 0 {
+			size = r.Intn(BTREE_MAX_VAL_SIZE + 1)
+		}
+		return strings.Repeat(string(rune('a'+r.Intn(26))), size)
+	}
+
+	ops := make([]modelOp, 0, n)
+	for len(ops) < n {
+		op := modelOp{kind: r.Intn(4)}
+		if len(keys) == 0 || op.kind == OP_INSERT {
+			op.kind = OP_INSERT
+			op.key = randKey()
+			keys = append(keys, op.key)
+		} else {
+			op.key = keys[r.Intn(len(keys))]
+		}
+		switch op.kind {
+		case OP_INSERT, OP_UPDATE:
+			op.val = randVal()
+		case OP_DELETE:
+			if r.Intn(5) == 0 {
+				op.key = randKey() // probably missing
+			}
+		case OP_SCAN:
+			op.val = fmt.Sprint(r.Intn(50))
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// apply the operations and compare the tree with the reference after each one;
+// returns the index of the failed operation, or -1
+func runModelOps(ops []modelOp) (step int, err error) {
+	c := newC()
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	for step = range ops {
+		if err = applyModelOp(c, ops[step]); err != nil {
+			return step, err
+		}
+		if err = c.check(); err != nil {
+			return step, err
+		}
+	}
+	return -1, nil
+}
+
+func applyModelOp(c *C, op modelOp) error {
+	switch op.kind {
+	case OP_INSERT, OP_UPDATE:
+		c.add(op.key, op.val)
+	case OP_DELETE:
+		_, expect := c.ref[op.key]
+		if got := c.del(op.key); got != expect {
+			return fmt.Errorf("Delete(%q) = %v", op.key, got)
+		}
+	case OP_SCAN:
+		var n int
+		fmt.Sscan(op.val, &n)
+		var expect []string
+		for key := range c.ref {
+			if key >= op.key {
+				expect = append(expect, key)
+			}
+		}
+		sort.Strings(expect)
+		iter := c.tree.Seek([]byte(op.key))
+		for i := 0; i < n && i < len(expect); i++ {
+			if !iter.Valid() {
+				return fmt.Errorf("scan from %q: ended at %d", op.key, i)
+			}
+			key, val := iter.Deref()
+			if string(key) != expect[i] || string(val) != c.ref[expect[i]] {
+				return fmt.Errorf("scan from %q: got %q, expect %q", op.key, key, expect[i])
+			}
+			iter.Next()
+		}
+	}
+	return nil
+}
+
+// remove chunks of operations while the sequence still fails
+func shrinkModelOps(ops []modelOp, fails func([]modelOp) bool) []modelOp {
+	for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+		for start := 0; start < len(ops); {
+			end := min(start+chunk, len(ops))
+			smaller := append(append([]modelOp{}, ops[:start]...), ops[end:]...)
+			if fails(smaller) {
+				ops = smaller // still fails without this chunk
+			} else {
+				start = end
+			}
+		}
+	}
+	return ops
+}
+
+func runModelSeed(t *testing.T, seed int64, steps int) {
+	t.Helper()
+	ops := genModelOps(seed, steps)
+	step, err := runModelOps(ops)
+	if err == nil {
+		return
+	}
+	t.Errorf("seed %d failed at step %d: %v", seed, step, err)
+	minimal := shrinkModelOps(ops[:step+1], func(ops []modelOp) bool {
+		_, err := runModelOps(ops)
+		return err != nil
+	})
+	_, err = runModelOps(minimal)
+	lines := make([]string, len(minimal))
+	for i, op := range minimal {
+		lines[i] = "  " + op.String()
+	}
+	t.Fatalf("minimal sequence of %d ops fails with: %v\n%s\nreplay with: go test -run TestBTreeModel -model.seed=%d -model.steps=%d",
+		len(minimal), err, strings.Join(lines, "\n"), seed, steps)
+}
+
+func TestBTreeModel(t *testing.T) {
+	if *modelSeed != 0 {
+		runModelSeed(t, *modelSeed, *modelSteps)
+		return
+	}
+	runs := *modelRuns
+	if testing.Short() {
+		runs = 3
+	}
+	// fixed by default, so that a failure is the same on every run
+	base := *modelBase
+	if base == 0 {
+		base = time.Now().UnixNano()
+	}
+	t.Logf("seeds %d to %d", base, base+int64(runs)-1)
+	for i := 0; i < runs; i++ {
+		runModelSeed(t, base+int64(i), *modelSteps)
+	}
+}
+
+func TestModelShrink(t *testing.T) {
+	// a deliberately broken model: deleting "k3" also forgets "k1"
+	ops := []modelOp{
+		{OP_INSERT, "k1", "a"}, {OP_INSERT, "k2", "b"}, {OP_UPDATE, "k2", "c"},
+		{OP_INSERT, "k3", "d"}, {OP_SCAN, "k", "3"}, {OP_DELETE, "k3", ""},
+	}
+	broken := func(ops []modelOp) bool {
+		c := newC()
+		for _, op := range ops {
+			if err := applyModelOp(c, op); err != nil {
+				return true
+			}
+			if op.kind == OP_DELETE && op.key == "k3" {
+				delete(c.ref, "k1")
+			}
+			if err := c.check(); err != nil {
+				return true
+			}
+		}
+		return false
+	}
+	if !broken(ops) {
+		t.Fatal("the broken model should fail")
+	}
+	if _, err := runModelOps(ops); err != nil {
+		t.Fatal(err)
+	}
+
+	ops = shrinkModelOps(ops, broken)
+	if fmt.Sprint(ops) != `[insert("k1", "a") delete("k3", "")]` {
+		t.Fatalf("not minimal: %v", ops)
+	}
+}
@@ -0,0 +1,207 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+	"math"
+)
+
+// optimistic concurrency control: a transaction reads a snapshot and records
+// the key ranges it read and its updates (txLog). on commit, the ranges are
+// checked against the keys written by the transactions committed since the
+// snapshot (txCommit); if none overlaps, what the transaction read is still
+// current, and its updates are replayed on the tree of the last commit.
+
+var ErrConflict = errors.New("transaction conflict, retry it")
+
+// the pointers of the private pages of a transaction
+const TX_PAGE = 1 << 63
+
+// updates recorded by a transaction
+const (
+	TXOP_SET       = 1
+	TXOP_DEL       = 2
+	TXOP_DEL_RANGE = 3 // [key, end), a nil end means to the last key
+	TXOP_BATCH     = 4
+)
+
+type txOp struct {
+	kind  int
+	key   []byte
+	val   []byte
+	end   []byte
+	batch []Op
+}
+
+// the keys in [start, end]; a nil start is the first key
+type keyRange struct {
+	start []byte
+	end   []byte
+	open  bool // no end, up to the last key
+}
+
+// the reads and the updates of a transaction
+type txLog struct {
+	reads  []keyRange
+	writes []keyRange
+	ops    []txOp
+}
+
+// the writes of a commit, kept while an older transaction may conflict with it
+type txCommit struct {
+	version uint64
+	writes  []keyRange
+}
+
+// record a read of [start, end], returns its index
+func (log *txLog) read(start []byte, end []byte) int {
+	log.reads = append(log.reads, keyRange{start: bytes.Clone(start), end: bytes.Clone(end)})
+	return len(log.reads) - 1
+}
+
+// record a read of [start, end), a nil end means to the last key
+func (log *txLog) readRange(start []byte, end []byte) {
+	// the end is included, which is only more conservative
+	log.reads = append(log.reads, keyRange{start: bytes.Clone(start), end: bytes.Clone(end), open: end == nil})
+}
+
+// record an update, the inputs are copied
+func (log *txLog) write(op txOp) {
+	op.key, op.val, op.end = bytes.Clone(op.key), bytes.Clone(op.val), bytes.Clone(op.end)
+	switch op.kind {
+	case TXOP_SET, TXOP_DEL:
+		log.writes = append(log.writes, keyRange{start: op.key, end: op.key})
+	case TXOP_DEL_RANGE:
+		log.writes = append(log.writes, keyRange{start: op.key, end: op.end, open: op.end == nil})
+	case TXOP_BATCH:
+		batch := make([]Op, len(op.batch))
+		for i, bop := range op.batch {
+			batch[i] = Op{Key: bytes.Clone(bop.Key), Val: bytes.Clone(bop.Val), Del: bop.Del}
+			log.writes = append(log.writes, keyRange{start: batch[i].Key, end: batch[i].Key})
+		}
+		op.batch = batch
+	}
+	log.ops = append(log.ops, op)
+}
+
+// apply the updates to another tree
+func (log *txLog) replay(tree *BTree) {
+	for _, op := range log.ops {
+		switch op.kind {
+		case TXOP_SET:
+			tree.Insert(op.key, op.val)
+		case TXOP_DEL:
+			tree.Delete(op.key)
+		case TXOP_DEL_RANGE:
+			tree.DeleteRange(op.key, op.end)
+		case TXOP_BATCH:
+			tree.ApplyBatch(op.batch)
+		}
+	}
+}
+
+// whether the ranges share a key
+func overlaps(tree *BTree, a keyRange, b keyRange) bool {
+	return (b.open || tree.compare(a.start, b.end) <= 0) &&
+		(a.open || tree.compare(b.start, a.end) <= 0)
+}
+
+// a private copy-on-write tree over the last commit, for a transaction
+func (db *DB) txTree(tx *Tx) BTree {
+	snapshot := db.pin()
+	return BTree{
+		root:  snapshot.root,
+		cmp:   snapshot.cmp,
+		log:   &tx.log,
+		store: &txStore{snapshot: snapshot.store, pages: map[uint64][]byte{}},
+	}
+}
+
+// the private pages of a transaction over the pages of its snapshot
+type txStore struct {
+	snapshot PageStore
+	pages    map[uint64][]byte
+	next     uint64
+}
+
+func (s *txStore) Read(ptr uint64) []byte {
+	if ptr&TX_PAGE != 0 {
+		return s.pages[ptr]
+	}
+	return s.snapshot.Read(ptr)
+}
+
+func (s *txStore) Allocate(node []byte) uint64 {
+	assert(BNode(node).nbytes() <= BTREE_PAGE_SIZE)
+	s.next++
+	ptr := TX_PAGE | s.next
+	s.pages[ptr] = node
+	return ptr
+}
+
+// the pages of the snapshot are shared
+func (s *txStore) Free(ptr uint64) {
+	delete(s.pages, ptr)
+}
+
+func (s *txStore) Sync() error  { return nil } // committed by replaying the log
+func (s *txStore) Close() error { return nil }
+
+// whether a transaction committed after the snapshot wrote a key that the
+// transaction read, called by the commit
+func (db *DB) conflicted(tx *Tx) bool {
+	db.txs.Lock()
+	defer db.txs.Unlock()
+	for _, commit := range db.txs.history {
+		if commit.version <= tx.version {
+			continue
+		}
+		for _, w := range commit.writes {
+			for _, r := range tx.log.reads {
+				if overlaps(&db.tree, w, r) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// unregister a transaction and drop the history no other one needs
+func (db *DB) txEnd(tx *Tx) {
+	db.unpin(tx.tree.store.(*txStore).snapshot)
+	db.txs.Lock()
+	defer db.txs.Unlock()
+	assert(db.txs.ongoing[tx.version] > 0)
+	if db.txs.ongoing[tx.version]--; db.txs.ongoing[tx.version] == 0 {
+		delete(db.txs.ongoing, tx.version)
+	}
+	oldest := uint64(math.MaxUint64)
+	for version := range db.txs.ongoing {
+		oldest = min(oldest, version)
+	}
+	history := db.txs.history[:0]
+	for _, commit := range db.txs.history {
+		if commit.version > oldest {
+			history = append(history, commit)
+		}
+	}
+	clear(db.txs.history[len(history):])
+	db.txs.history = history
+	tx.tree.store, tx.log = nil, txLog{}
+}
+
+// run a transaction, again on conflicts
+func (db *DB) transact(fn func(tx *Tx) error) error {
+	for {
+		var tx Tx
+		db.Begin(&tx)
+		if err := fn(&tx); err != nil {
+			db.Abort(&tx)
+			return err
+		}
+		if err := db.Commit(&tx); err != ErrConflict {
+			return err
+		}
+	}
+}
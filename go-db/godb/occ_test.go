@@ -0,0 +1,174 @@
+package godb
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"db.com/m/internal/kvtest"
+)
+
+func TestTxConflict(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	for _, key := range []string{"a", "b", "k1", "k2", "k3", "k4"} {
+		if err := db.Set([]byte(key), []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the transactions don't block each other
+	var tx1, tx2 Tx
+	db.Begin(&tx1)
+	db.Begin(&tx2)
+	tx1.Get([]byte("a"))
+	if err := tx1.Set([]byte("b"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Set([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := tx1.Get([]byte("x")); ok {
+		t.Fatal("x")
+	}
+	if err := db.Commit(&tx2); err != nil {
+		t.Fatal(err)
+	}
+	// tx1 read the old "a"
+	if err := db.Commit(&tx1); err != ErrConflict {
+		t.Fatalf("commit: %v", err)
+	}
+	if val, _, _ := db.Get([]byte("b")); string(val) != "0" {
+		t.Fatal("the updates of a conflicting transaction were applied")
+	}
+
+	// disjoint keys
+	db.Begin(&tx1)
+	db.Begin(&tx2)
+	tx1.Set([]byte("a"), []byte("3"))
+	tx2.Set([]byte("b"), []byte("3"))
+	if err := db.Commit(&tx1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(&tx2); err != nil {
+		t.Fatal(err)
+	}
+
+	// a scan reads the keys up to where the iterator stopped
+	scan := func(tx *Tx) {
+		it := tx.Seek([]byte("k"))
+		for i := 0; i < 2; i++ {
+			it.Next()
+		}
+	}
+	for _, c := range []struct {
+		key      string
+		conflict bool
+	}{
+		{"k0", true}, {"k2", true}, {"k25", true}, {"k3", true},
+		{"k35", false}, {"k4", false}, {"j", false},
+	} {
+		db.Begin(&tx1)
+		db.Begin(&tx2)
+		scan(&tx1)
+		tx1.Set([]byte("b"), []byte("4"))
+		tx2.Set([]byte(c.key), []byte("4"))
+		if err := db.Commit(&tx2); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Commit(&tx1); (err == ErrConflict) != c.conflict {
+			t.Fatalf("scan and update %s: %v", c.key, err)
+		}
+		if c.key != "k2" && c.key != "k3" && c.key != "k4" {
+			db.Del([]byte(c.key))
+		}
+	}
+
+	// a transaction without updates always commits
+	db.Begin(&tx1)
+	scan(&tx1)
+	db.Set([]byte("k2"), []byte("5"))
+	if err := db.Commit(&tx1); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.txs.ongoing) != 0 || len(db.txs.history) != 0 {
+		t.Fatalf("ongoing %v, history %v", db.txs.ongoing, db.txs.history)
+	}
+}
+
+// concurrent increments are neither lost nor blocked
+func TestTxConcurrentCounters(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	const WORKERS, INCS = 8, 50
+	conflicts := make([]int, WORKERS)
+	var wg sync.WaitGroup
+	for w := 0; w < WORKERS; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < INCS; i++ {
+				// one shared counter and one counter per worker
+				keys := []string{"total", fmt.Sprintf("worker%d", w)}
+				for {
+					var tx Tx
+					db.Begin(&tx)
+					for _, key := range keys {
+						val, _, _ := tx.Get([]byte(key))
+						n, _ := strconv.Atoi(string(val))
+						if err := tx.Set([]byte(key), []byte(strconv.Itoa(n+1))); err != nil {
+							panic(err)
+						}
+					}
+					err := db.Commit(&tx)
+					if err == nil {
+						break
+					}
+					if err != ErrConflict {
+						panic(err)
+					}
+					conflicts[w]++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if val, _, _ := db.Get([]byte("total")); string(val) != strconv.Itoa(WORKERS*INCS) {
+		t.Fatalf("total: %s", val)
+	}
+	for w := 0; w < WORKERS; w++ {
+		if val, _, _ := db.Get([]byte(fmt.Sprintf("worker%d", w))); string(val) != strconv.Itoa(INCS) {
+			t.Fatalf("worker%d: %s", w, val)
+		}
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("conflicts: %v", conflicts)
+}
+
+// the one-shot updates retry by themselves
+func TestTxRetry(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("key%d", i%10))
+				if err := db.Set(key, []byte(strconv.Itoa(w))); err != nil {
+					panic(err)
+				}
+				if _, err := db.Del(key); err != nil {
+					panic(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if kvs := kvtest.Dump(db.Seek(nil)); len(kvs) != 0 {
+		t.Fatalf("left over: %v", kvs)
+	}
+}
@@ -0,0 +1,470 @@
+package godb
+
+import (
+	"bytes"
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+)
+
+// comparison operators of a condition
+const (
+	OP_EQ = 1
+	OP_LT = 2
+	OP_LE = 3
+	OP_GT = 4
+	OP_GE = 5
+)
+
+var opNames = [...]string{OP_EQ: "=", OP_LT: "<", OP_LE: "<=", OP_GT: ">", OP_GE: ">="}
+
+// a predicate `Col Op Val`, the conditions of a query are ANDed
+type Cond struct {
+	Col string
+	Op  int
+	Val Value
+}
+
+// a query over a table, planned by the access paths its conditions allow
+type Query struct {
+	Table string
+	Where []Cond
+	Joins []Join
+	// aggregate the rows into one row per group, see Agg
+	GroupBy []string
+	Aggs    []Agg
+	Having  []Cond // conditions on the groups, by the output columns
+}
+
+// a node of a query plan, which streams its rows from a tree
+type planNode interface {
+	rows(tree *BTree) iter.Seq[Record]
+	// the line of EXPLAIN and the inputs
+	explain() (string, []planNode)
+	// the columns and types of the rows
+	schema() ([]string, []uint32)
+	// the columns the rows are sorted by, in order; the first `fixed` are constant
+	order() (cols []string, fixed int)
+}
+
+// every row of a table in primary key order
+type scanNode struct {
+	tdef *TableDef
+}
+
+// a range of the primary key or of a secondary index: equalities on the
+// first columns of the index, then an optional range on the next column
+type rangeNode struct {
+	tdef   *TableDef
+	index  int     // -1 for the primary key
+	eq     []Value // the values of the first columns
+	lo, hi *bound  // the range of the next column, nil if unbounded
+}
+
+type bound struct {
+	val  Value
+	incl bool
+}
+
+// the rows of the input that match all conditions
+type filterNode struct {
+	input planNode
+	conds []Cond
+}
+
+func cmpValue(a Value, b Value) int {
+	assert(a.Type == b.Type)
+	switch a.Type {
+	case TYPE_INT64:
+		switch {
+		case a.I64 < b.I64:
+			return -1
+		case a.I64 > b.I64:
+			return 1
+		}
+		return 0
+	case TYPE_BYTES:
+		return bytes.Compare(a.Str, b.Str)
+	case TYPE_FLOAT64:
+		switch {
+		case a.F64 < b.F64:
+			return -1
+		case a.F64 > b.F64:
+			return 1
+		}
+		return 0
+	default:
+		corrupt("bad value type %d", a.Type) // of a stored table
+		return 0
+	}
+}
+
+func (cond Cond) match(rec Record) bool {
+	v := rec.Get(cond.Col)
+	if v == nil || v.Type == TYPE_NULL {
+		return false
+	}
+	cmp := cmpValue(*v, cond.Val)
+	switch cond.Op {
+	case OP_EQ:
+		return cmp == 0
+	case OP_LT:
+		return cmp < 0
+	case OP_LE:
+		return cmp <= 0
+	case OP_GT:
+		return cmp > 0
+	case OP_GE:
+		return cmp >= 0
+	default:
+		panic("bad operator")
+	}
+}
+
+func (v Value) String() string {
+	switch v.Type {
+	case TYPE_INT64:
+		return fmt.Sprint(v.I64)
+	case TYPE_BYTES:
+		return fmt.Sprintf("%q", v.Str)
+	case TYPE_FLOAT64:
+		return fmt.Sprint(v.F64)
+	default:
+		return "NULL"
+	}
+}
+
+func (cond Cond) String() string {
+	return fmt.Sprintf("%s %s %s", cond.Col, opNames[cond.Op], cond.Val)
+}
+
+// the conditions on rows of the columns
+func checkConds(cols []string, types []uint32, conds []Cond) error {
+	for _, cond := range conds {
+		idx := slices.Index(cols, cond.Col)
+		switch {
+		case idx < 0:
+			return fmt.Errorf("unknown column %s", cond.Col)
+		case cond.Val.Type != types[idx]:
+			return fmt.Errorf("bad type of %s", cond)
+		case cond.Op < OP_EQ || cond.Op > OP_GE:
+			return fmt.Errorf("bad operator %d", cond.Op)
+		}
+	}
+	return nil
+}
+
+// choose the access path of a table: the index whose columns are the most
+// constrained by the conditions, preferring the primary key on a tie, or a
+// full scan. the conditions not enforced by the access path are filtered.
+func planAccess(tdef *TableDef, conds []Cond) planNode {
+	var best *rangeNode
+	var bestUsed []bool
+	bestScore := 0
+	for index := -1; index < len(tdef.Indexes); index++ {
+		node, used := planRange(tdef, index, conds)
+		// an equality is worth more than any range
+		score := 2 * len(node.eq)
+		if node.lo != nil || node.hi != nil {
+			score++
+		}
+		if score > bestScore {
+			best, bestUsed, bestScore = node, used, score
+		}
+	}
+
+	var input planNode = &scanNode{tdef: tdef}
+	var rest []Cond
+	if best != nil {
+		input = best
+		for i, cond := range conds {
+			if !bestUsed[i] {
+				rest = append(rest, cond)
+			}
+		}
+	} else {
+		rest = conds
+	}
+	if len(rest) == 0 {
+		return input
+	}
+	return &filterNode{input: input, conds: rest}
+}
+
+// the range of an index allowed by the conditions, and the conditions it enforces
+func planRange(tdef *TableDef, index int, conds []Cond) (*rangeNode, []bool) {
+	node := &rangeNode{tdef: tdef, index: index}
+	used := make([]bool, len(conds))
+	for _, col := range tdef.indexCols(index) {
+		eq := slices.IndexFunc(conds, func(c Cond) bool { return c.Col == col && c.Op == OP_EQ })
+		if eq >= 0 {
+			node.eq = append(node.eq, conds[eq].Val)
+			// other conditions on the column are still checked by a filter
+			used[eq] = true
+			continue
+		}
+		for i, cond := range conds {
+			if cond.Col != col {
+				continue
+			}
+			b := &bound{val: cond.Val, incl: cond.Op == OP_LE || cond.Op == OP_GE}
+			if cond.Op == OP_GT || cond.Op == OP_GE {
+				if node.lo == nil || tighter(b, node.lo, 1) {
+					node.lo = b
+				}
+			} else {
+				if node.hi == nil || tighter(b, node.hi, -1) {
+					node.hi = b
+				}
+			}
+			used[i] = true
+		}
+		break
+	}
+	return node, used
+}
+
+// whether the bound `a` excludes more than `b`; dir is 1 for lower bounds
+func tighter(a *bound, b *bound, dir int) bool {
+	cmp := cmpValue(a.val, b.val) * dir
+	return cmp > 0 || (cmp == 0 && !a.incl && b.incl)
+}
+
+// plan a query from the catalog of the tree
+func planQuery(tree *BTree, q *Query) (planNode, error) {
+	tdef, err := getTableDef(tree, q.Table)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConds(tdef.Cols, tdef.Types, q.Where); err != nil {
+		return nil, fmt.Errorf("table %s: %w", tdef.Name, err)
+	}
+	node := planAccess(tdef, q.Where)
+	if len(q.Joins) > 0 {
+		if node, err = planJoins(tree, node, tdef, q.Joins); err != nil {
+			return nil, err
+		}
+	}
+	if len(q.GroupBy) == 0 && len(q.Aggs) == 0 && len(q.Having) == 0 {
+		return node, nil
+	}
+	if node, err = planAggregate(node, q); err != nil {
+		return nil, fmt.Errorf("table %s: %w", tdef.Name, err)
+	}
+	return node, nil
+}
+
+func (node *scanNode) rows(tree *BTree) iter.Seq[Record] {
+	return func(yield func(Record) bool) {
+		prefix := encodeKey(node.tdef.Prefix, nil)
+		for it := tree.Seek(prefix); it.Valid(); it.Next() {
+			key, val := it.Deref()
+			if !bytes.HasPrefix(key, prefix) {
+				return
+			}
+			if !yield(decodeRow(node.tdef, key, val)) {
+				return
+			}
+		}
+	}
+}
+
+func (node *scanNode) explain() (string, []planNode) {
+	return fmt.Sprintf("Scan %s", node.tdef.Name), nil
+}
+
+func (node *scanNode) schema() ([]string, []uint32) {
+	return node.tdef.Cols, node.tdef.Types
+}
+
+func (node *scanNode) order() ([]string, int) {
+	return node.tdef.Cols[:node.tdef.PKeys], 0
+}
+
+func (node *rangeNode) rows(tree *BTree) iter.Seq[Record] {
+	return func(yield func(Record) bool) {
+		tdef := node.tdef
+		prefix := tdef.indexPrefix(node.index)
+		cols := tdef.indexCols(node.index)
+		types := tdef.colTypes(cols)
+		start := node.eq
+		if node.lo != nil {
+			start = append(slices.Clone(start), node.lo.val)
+		}
+		for it := tree.Seek(encodeKey(prefix, start)); it.Valid(); it.Next() {
+			key, val := it.Deref()
+			vals, ok := decodeKey(prefix, key, types)
+			if !ok || !node.inRange(vals) {
+				return
+			}
+			if node.lo != nil && !node.lo.incl && cmpValue(vals[len(node.eq)], node.lo.val) == 0 {
+				continue
+			}
+			var rec Record
+			if node.index < 0 {
+				rec = decodeRow(tdef, key, val)
+			} else {
+				rec = indexRow(tree, tdef, cols, vals)
+			}
+			if !yield(rec) {
+				return
+			}
+		}
+	}
+}
+
+// whether the index values are still in the range, the keys being sorted
+func (node *rangeNode) inRange(vals []Value) bool {
+	for i, v := range node.eq {
+		if cmpValue(vals[i], v) != 0 {
+			return false
+		}
+	}
+	if node.hi != nil {
+		cmp := cmpValue(vals[len(node.eq)], node.hi.val)
+		return cmp < 0 || (cmp == 0 && node.hi.incl)
+	}
+	return true
+}
+
+// the row of an index entry, a dangling entry is a corruption
+func indexRow(tree *BTree, tdef *TableDef, cols []string, vals []Value) Record {
+	pkey := Record{}
+	for _, col := range tdef.Cols[:tdef.PKeys] {
+		pkey.Cols = append(pkey.Cols, col)
+		pkey.Vals = append(pkey.Vals, vals[slices.Index(cols, col)])
+	}
+	ok, err := tableGet(tree, tdef, &pkey)
+	assert(err == nil) // the pkey is well-formed
+	if !ok {
+		corrupt("table %s: index entry without a row", tdef.Name)
+	}
+	return pkey
+}
+
+func (node *rangeNode) explain() (string, []planNode) {
+	tdef := node.tdef
+	cols := tdef.indexCols(node.index)
+	var conds []string
+	for i, v := range node.eq {
+		conds = append(conds, Cond{Col: cols[i], Op: OP_EQ, Val: v}.String())
+	}
+	if node.lo != nil {
+		op := OP_GT
+		if node.lo.incl {
+			op = OP_GE
+		}
+		conds = append(conds, Cond{Col: cols[len(node.eq)], Op: op, Val: node.lo.val}.String())
+	}
+	if node.hi != nil {
+		op := OP_LT
+		if node.hi.incl {
+			op = OP_LE
+		}
+		conds = append(conds, Cond{Col: cols[len(node.eq)], Op: op, Val: node.hi.val}.String())
+	}
+	kind := "IndexRange"
+	switch {
+	case node.index < 0 && len(node.eq) == tdef.PKeys:
+		kind = "PKLookup"
+	case node.index < 0:
+		kind = "PKRange"
+	}
+	return fmt.Sprintf("%s %s(%s) %s", kind, tdef.Name, strings.Join(cols, ", "), strings.Join(conds, " AND ")), nil
+}
+
+func (node *rangeNode) schema() ([]string, []uint32) {
+	return node.tdef.Cols, node.tdef.Types
+}
+
+func (node *rangeNode) order() ([]string, int) {
+	return node.tdef.indexCols(node.index), len(node.eq)
+}
+
+func (node *filterNode) rows(tree *BTree) iter.Seq[Record] {
+	return func(yield func(Record) bool) {
+		for rec := range node.input.rows(tree) {
+			if matchAll(rec, node.conds) && !yield(rec) {
+				return
+			}
+		}
+	}
+}
+
+func matchAll(rec Record, conds []Cond) bool {
+	for _, cond := range conds {
+		if !cond.match(rec) {
+			return false
+		}
+	}
+	return true
+}
+
+func (node *filterNode) explain() (string, []planNode) {
+	var conds []string
+	for _, cond := range node.conds {
+		conds = append(conds, cond.String())
+	}
+	return "Filter " + strings.Join(conds, " AND "), []planNode{node.input}
+}
+
+func (node *filterNode) schema() ([]string, []uint32) {
+	return node.input.schema()
+}
+
+func (node *filterNode) order() ([]string, int) {
+	return node.input.order()
+}
+
+// the plan as a tree, one node per line with the inputs indented
+func explainPlan(node planNode) string {
+	var sb strings.Builder
+	var walk func(node planNode, depth int)
+	walk = func(node planNode, depth int) {
+		line, inputs := node.explain()
+		sb.WriteString(strings.Repeat("  ", depth) + line + "\n")
+		for _, input := range inputs {
+			walk(input, depth+1)
+		}
+	}
+	walk(node, 0)
+	return sb.String()
+}
+
+// the rows are decoded as they're read, a corruption stops the query
+func runQuery(tree *BTree, q *Query) (out []Record, err error) {
+	defer catchCorrupt(&err)
+	node, err := planQuery(tree, q)
+	if err != nil {
+		return nil, err
+	}
+	for rec := range node.rows(tree) {
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+// run a query on the last commit
+func (db *DB) Query(q *Query) ([]Record, error) {
+	tree := db.pin()
+	defer db.unpin(tree.store)
+	return runQuery(&tree, q)
+}
+
+// run a query on the transaction, including its own updates
+func (tx *Tx) Query(q *Query) ([]Record, error) {
+	return runQuery(&tx.tree, q)
+}
+
+// the plan of a query as a tree, one node per line
+func (db *DB) Explain(q *Query) (plan string, err error) {
+	defer catchCorrupt(&err)
+	tree := db.pin()
+	defer db.unpin(tree.store)
+	node, err := planQuery(&tree, q)
+	if err != nil {
+		return "", err
+	}
+	return explainPlan(node), nil
+}
@@ -0,0 +1,136 @@
+package godb
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func intCond(col string, op int, val int64) Cond {
+	return Cond{Col: col, Op: op, Val: Value{Type: TYPE_INT64, I64: val}}
+}
+
+func strCond(col string, op int, val string) Cond {
+	return Cond{Col: col, Op: op, Val: Value{Type: TYPE_BYTES, Str: []byte(val)}}
+}
+
+// a people table with random rows, returns the rows
+func fillPeople(t *testing.T, db *DB, n int) []Record {
+	t.Helper()
+	createPeople(t, db)
+	r := rand.New(rand.NewSource(1))
+	cities := []string{"oslo", "paris", "rome", "lima"}
+	var rows []Record
+	var tx Tx
+	db.Begin(&tx)
+	for i := 0; i < n; i++ {
+		rec := person(int64(i), fmt.Sprintf("name%d", r.Intn(n)), cities[r.Intn(len(cities))], int64(r.Intn(80)))
+		if _, err := tx.SetRecord("people", rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, rec)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestExplain(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	createPeople(t, db)
+	cases := []struct {
+		where  []Cond
+		expect string
+	}{
+		{nil, "Scan people"},
+		{[]Cond{intCond("id", OP_EQ, 7)}, "PKLookup people(id) id = 7"},
+		{[]Cond{intCond("id", OP_GT, 7), intCond("id", OP_LE, 9), intCond("id", OP_GE, 8)},
+			"PKRange people(id) id >= 8 AND id <= 9"},
+		{[]Cond{strCond("city", OP_EQ, "oslo")}, `IndexRange people(city, age, id) city = "oslo"`},
+		{[]Cond{intCond("age", OP_LT, 30), strCond("city", OP_EQ, "oslo")},
+			`IndexRange people(city, age, id) city = "oslo" AND age < 30`},
+		{[]Cond{strCond("name", OP_EQ, "ann"), intCond("age", OP_GT, 30)},
+			`Filter age > 30
+  IndexRange people(name, id) name = "ann"`},
+		// the equality on the primary key beats the index
+		{[]Cond{strCond("city", OP_EQ, "oslo"), intCond("id", OP_EQ, 7)},
+			`Filter city = "oslo"
+  PKLookup people(id) id = 7`},
+		// the age alone can't use the city index
+		{[]Cond{intCond("age", OP_EQ, 30)}, "Filter age = 30\n  Scan people"},
+	}
+	for _, c := range cases {
+		got, err := db.Explain(&Query{Table: "people", Where: c.where})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(got) != c.expect {
+			t.Fatalf("%v:\n%s\nexpect:\n%s", c.where, got, c.expect)
+		}
+	}
+
+	for _, where := range [][]Cond{
+		{intCond("nope", OP_EQ, 1)},
+		{strCond("id", OP_EQ, "x")},
+		{intCond("id", 9, 1)},
+	} {
+		if _, err := db.Explain(&Query{Table: "people", Where: where}); err == nil {
+			t.Fatalf("%v: planned", where)
+		}
+	}
+	if _, err := db.Explain(&Query{Table: "nope"}); err == nil {
+		t.Fatal("unknown table planned")
+	}
+}
+
+// every plan returns the rows a full scan and a filter return
+func TestQueryMatchesFilter(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	rows := fillPeople(t, db, 500)
+	r := rand.New(rand.NewSource(2))
+	random := func() Cond {
+		op := OP_EQ + r.Intn(5)
+		switch r.Intn(4) {
+		case 0:
+			return intCond("id", op, int64(r.Intn(520)-10))
+		case 1:
+			return intCond("age", op, int64(r.Intn(90)-5))
+		case 2:
+			return strCond("city", op, []string{"lima", "oslo", "p", "paris", "rome", "z"}[r.Intn(6)])
+		default:
+			return strCond("name", op, fmt.Sprintf("name%d", r.Intn(500)))
+		}
+	}
+	for i := 0; i < 500; i++ {
+		var where []Cond
+		for j := r.Intn(4); j > 0; j-- {
+			where = append(where, random())
+		}
+		got, err := db.Query(&Query{Table: "people", Where: where})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expect []Record
+		for _, rec := range rows {
+			if matchAll(rec, where) {
+				expect = append(expect, rec)
+			}
+		}
+		// the rows may come in the order of an index
+		if len(got) != len(expect) || sortRecords(got) != sortRecords(expect) {
+			plan, _ := db.Explain(&Query{Table: "people", Where: where})
+			t.Fatalf("%v: %d rows, expect %d\n%s", where, len(got), len(expect), plan)
+		}
+	}
+}
+
+// the rows by id, as text
+func sortRecords(rows []Record) string {
+	sorted := slices.Clone(rows)
+	slices.SortFunc(sorted, func(a, b Record) int { return cmpValue(*a.Get("id"), *b.Get("id")) })
+	return fmt.Sprint(sorted)
+}
@@ -0,0 +1,158 @@
+package godb
+
+// delete all keys in [start, end), a nil end means to the last key;
+// the dummy key is never removed.
+// subtrees inside the range are deallocated without being rewritten, only
+// the nodes on the 2 edges of the range are. returns the number of deleted keys.
+func (tree *BTree) DeleteRange(start []byte, end []byte) int {
+	if tree.log != nil {
+		// the count depends on the keys of the range
+		tree.log.readRange(start, end)
+	}
+	if tree.root == 0 || (end != nil && tree.compare(start, end) >= 0) {
+		return 0
+	}
+
+	updated, count := treeDeleteRange(tree, tree.get(tree.root), start, end, nil)
+	if count == 0 {
+		return 0
+	}
+	tree.del(tree.root)
+	tree.root = deleteNewRoot(tree, updated)
+	if tree.log != nil {
+		tree.log.write(txOp{kind: TXOP_DEL_RANGE, key: start, end: end})
+	}
+	return count
+}
+
+// delete a range from a subtree whose keys are less than `hi` (nil if unbounded);
+// the result is empty if nothing was deleted
+func treeDeleteRange(tree *BTree, node BNode, start []byte, end []byte, hi []byte) (BNode, int) {
+	switch node.btype() {
+	case BNODE_LEAF:
+		return leafDeleteRange(tree, node, start, end)
+	case BNODE_NODE:
+		return nodeDeleteRange(tree, node, start, end, hi)
+	default:
+		panic("bad node!")
+	}
+}
+
+func leafDeleteRange(tree *BTree, node BNode, start []byte, end []byte) (BNode, int) {
+	nkeys := node.nkeys()
+	first := nkeys // the first key to delete
+	for i := uint16(0); i < nkeys; i++ {
+		if key := node.getKey(i); len(key) > 0 && tree.compare(key, start) >= 0 {
+			first = i
+			break
+		}
+	}
+	last := first // past the last key to delete
+	for last < nkeys && (end == nil || tree.compare(node.getKey(last), end) < 0) {
+		last++
+	}
+	if first == last {
+		return BNode{}, 0
+	}
+
+	new := BNode(make([]byte, BTREE_PAGE_SIZE))
+	new.setHeader(BNODE_LEAF, nkeys-(last-first))
+	nodeAppendRange(new, node, 0, 0, first)
+	nodeAppendRange(new, node, first, last, nkeys-last)
+	return new, int(last - first)
+}
+
+// drop the kids inside the range, then trim and rebalance the edge kids
+func nodeDeleteRange(tree *BTree, node BNode, start []byte, end []byte, hi []byte) (BNode, int) {
+	nkeys := node.nkeys()
+	kept := []bulkKV{}  // links to the kept kids
+	edges := []uint16{} // indexes of the rewritten kids in `kept`
+	count := 0
+	for i := uint16(0); i < nkeys; i++ {
+		lo, khi := node.getKey(i), hi
+		if i+1 < nkeys {
+			khi = node.getKey(i + 1)
+		}
+		kptr := node.getPtr(i)
+		before := khi != nil && tree.compare(khi, start) <= 0
+		after := end != nil && tree.compare(lo, end) >= 0
+		covered := len(lo) > 0 && tree.compare(start, lo) <= 0 &&
+			(end == nil || (khi != nil && tree.compare(khi, end) <= 0))
+
+		switch {
+		case before || after:
+			kept = append(kept, bulkKV{ptr: kptr, key: lo})
+		case covered:
+			count += treeFree(tree, kptr)
+		default:
+			updated, n := treeDeleteRange(tree, tree.get(kptr), start, end, khi)
+			if n == 0 {
+				kept = append(kept, bulkKV{ptr: kptr, key: lo})
+				continue
+			}
+			count += n
+			tree.del(kptr)
+			if updated.nkeys() == 0 {
+				continue // the whole kid is gone
+			}
+			nsplit, split := nodeSplit3(tree, updated)
+			for _, knode := range split[:nsplit] {
+				edges = append(edges, uint16(len(kept)))
+				kept = append(kept, bulkKV{ptr: tree.new(knode), key: knode.getKey(0)})
+			}
+		}
+	}
+	if count == 0 {
+		return BNode{}, 0
+	}
+
+	// at most 2 kids are rewritten, each into at most 3 nodes,
+	// so the kept links fit in 2 pages
+	tmp := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+	tmp.setHeader(BNODE_NODE, uint16(len(kept)))
+	for i, kv := range kept {
+		nodeAppendKV(tmp, uint16(i), kv.ptr, kv.key, nil)
+	}
+
+	// merge the rewritten kids with a sibling, from the right so that
+	// the indexes on the left stay valid
+	for j := len(edges) - 1; j >= 0; j-- {
+		idx := edges[j]
+		kptr := tmp.getPtr(idx)
+		kid := BNode(tree.get(kptr))
+		mergeDir, sibling := shouldMerge(tree, tmp, idx, kid)
+		if mergeDir == 0 {
+			continue
+		}
+		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
+		next := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+		if mergeDir < 0 {
+			nodeMerge(tree, merged, sibling, kid)
+			tree.del(tmp.getPtr(idx - 1))
+			tree.del(kptr)
+			nodeReplace2Kid(next, tmp, idx-1, tree.new(merged), merged.getKey(0))
+		} else {
+			nodeMerge(tree, merged, kid, sibling)
+			tree.del(tmp.getPtr(idx + 1))
+			tree.del(kptr)
+			nodeReplace2Kid(next, tmp, idx, tree.new(merged), merged.getKey(0))
+		}
+		tmp = next
+	}
+	return tmp, count
+}
+
+// deallocate a whole subtree, returns the number of keys in it
+func treeFree(tree *BTree, ptr uint64) int {
+	node := BNode(tree.get(ptr))
+	count := 0
+	if node.btype() == BNODE_LEAF {
+		count = int(node.nkeys())
+	} else {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			count += treeFree(tree, node.getPtr(i))
+		}
+	}
+	tree.del(ptr)
+	return count
+}
@@ -0,0 +1,110 @@
+package godb
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"db.com/m/internal/kvtest"
+)
+
+// delete a range from the harness and its reference
+func (c *C) delRange(start string, end string, toLast bool) int {
+	var endKey []byte
+	if !toLast {
+		endKey = []byte(end)
+	}
+	for key := range c.ref {
+		if key != "" && key >= start && (toLast || key < end) {
+			delete(c.ref, key)
+		}
+	}
+	return c.tree.DeleteRange([]byte(start), endKey)
+}
+
+func TestDeleteRange(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		c := newC()
+		n := []int{10, 300, 5000}[round%3]
+		for i := 0; i < n; i++ {
+			c.add(fmt.Sprintf("key%05d", i), string(make([]byte, r.Intn(200))))
+		}
+		for j := 0; j < 3; j++ {
+			lo, hi := r.Intn(n+2), r.Intn(n+2)
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			start, end := fmt.Sprintf("key%05d", lo), fmt.Sprintf("key%05d", hi)
+			toLast := r.Intn(5) == 0
+			if r.Intn(10) == 0 {
+				start = ""
+			}
+
+			size := len(c.ref)
+			count := c.delRange(start, end, toLast)
+			if count != size-len(c.ref) {
+				t.Fatalf("round %d: deleted %d keys, expect %d", round, count, size-len(c.ref))
+			}
+			if err := c.check(); err != nil {
+				checkTree(t, &c.tree)
+				t.Fatalf("round %d: [%s, %s): %v", round, start, end, err)
+			}
+		}
+	}
+}
+
+func TestDeleteRangeFreesSubtrees(t *testing.T) {
+	c := newC()
+	for i := 0; i < 20000; i++ {
+		c.add(fmt.Sprintf("key%05d", i), "value")
+	}
+	counter := &countingStore{PageStore: c.tree.store}
+	c.tree.store = counter
+	pages := len(c.pages)
+	if n := c.delRange("key00100", "key19900", false); n != 19800 {
+		t.Fatalf("deleted %d keys", n)
+	}
+	// each page is visited once to be freed, not rewritten key by key
+	if counter.reads > pages+10 {
+		t.Fatalf("%d page reads for %d pages", counter.reads, pages)
+	}
+	if err := c.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := c.delRange("", "", true); n != 200 {
+		t.Fatalf("deleted %d keys", n)
+	}
+	if err := c.check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.pages) != 1 {
+		t.Fatal("expect a single leaf with the dummy key")
+	}
+}
+
+func TestKVDeleteRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, nil)
+	ref := kvtest.Fill(t, db, 2000)
+	n, err := db.DeleteRange([]byte("key000500"), []byte("key001500"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range ref {
+		if key >= "key000500" && key < "key001500" {
+			delete(ref, key)
+			n--
+		}
+	}
+	if n != 0 {
+		t.Fatal("wrong number of deleted keys")
+	}
+	db.Close()
+	db = openTestKV(t, path, nil)
+	if got := kvtest.Dump(db.Seek(nil)); fmt.Sprint(got) != fmt.Sprint(kvtest.Sorted(ref)) {
+		t.Fatal("reopened keys don't match")
+	}
+}
@@ -0,0 +1,669 @@
+package godb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// replication by log shipping: a primary streams its commits to followers
+// over TCP as records of their updates (txOp), numbered by the sequence
+// number of the commit that the master page keeps. a follower is read-only;
+// it applies the records in order, each in a commit with the same sequence
+// number, so after a disconnect it resumes from the last one it applied.
+// the primary keeps the last REPL_LOG_MAX records in memory; a follower that
+// is further behind, or new, first gets a snapshot of the primary.
+//
+// the sequence numbers only match between files of the same history: the
+// master page has a random ID of it, made for a new or restored file and
+// kept by compaction. a follower from an empty file gets a snapshot and
+// takes the ID of its primary; one with another ID is rejected, so a follower
+// must start from an empty file or one that followed the same primary.
+// its codec and comparator must be those of the primary. watchers of a
+// follower get no events.
+//
+// a message is:
+// | type | len | payload |
+// |  1B  | 4B  |   ...   |
+//
+// the follower sends REPL_HELLO, then the primary sends REPL_ERROR, or an
+// optional snapshot followed by the records as they are committed:
+//
+//	REPL_HELLO:     | sig | seq | codec | comparator | history (16B) |
+//	REPL_ERROR:     | message |
+//	REPL_SNAPSHOT:  | seq | history (16B) |, followed by REPL_KV messages and REPL_END
+//	REPL_KV:        | klen | key | val |
+//	REPL_END:       | count |
+//	REPL_RECORD:    | seq | op... |
+//
+// an op is a kind byte and its fields; byte strings are length-prefixed
+// with 4B, and the nil end of TXOP_DEL_RANGE has the length 0xffffffff:
+//
+//	TXOP_SET:       | key | val |
+//	TXOP_DEL:       | key |
+//	TXOP_DEL_RANGE: | key | end |
+//	TXOP_BATCH:     | n (4B) | (| del (1B) | key | val |)... |
+
+const REPL_SIG = "GoDBReplicate-02"
+
+const (
+	REPL_HELLO    = 1
+	REPL_ERROR    = 2
+	REPL_SNAPSHOT = 3
+	REPL_KV       = 4
+	REPL_END      = 5
+	REPL_RECORD   = 6
+)
+
+const (
+	REPL_LOG_MAX = 4096      // the number of records kept for the followers
+	REPL_MAX_MSG = 256 << 20 // the largest message
+	REPL_RETRY   = time.Second
+)
+
+var ErrReadOnly = errors.New("read-only replica")
+
+const replNilEnd = 0xffffffff
+
+// a commit for the followers
+type replRecord struct {
+	seq uint64
+	ops []txOp
+}
+
+// the last commits; nil `changed` until the DB is a primary
+type replLog struct {
+	sync.Mutex
+	base    uint64 // the sequence number before the first record
+	records []replRecord
+	changed chan struct{} // closed and replaced by each commit
+}
+
+// keep the commits from now on for the followers
+func (db *DB) replEnable() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.repl.Lock()
+	defer db.repl.Unlock()
+	if db.repl.changed == nil {
+		db.repl.base = db.seq
+		db.repl.changed = make(chan struct{})
+	}
+}
+
+// called by the commit, the ops are no longer modified
+func (db *DB) replAppend(ops []txOp) {
+	db.repl.Lock()
+	defer db.repl.Unlock()
+	if db.repl.changed == nil {
+		return // not a primary
+	}
+	db.repl.records = append(db.repl.records, replRecord{seq: db.seq, ops: ops})
+	if n := len(db.repl.records) - REPL_LOG_MAX; n > 0 {
+		clear(db.repl.records[:n])
+		db.repl.records = db.repl.records[n:]
+		db.repl.base += uint64(n)
+	}
+	close(db.repl.changed)
+	db.repl.changed = make(chan struct{})
+}
+
+// the records after `seq`, or a channel to wait for them;
+// false if some of them are no longer in the log
+func (db *DB) replSince(seq uint64) ([]replRecord, <-chan struct{}, bool) {
+	db.repl.Lock()
+	defer db.repl.Unlock()
+	if seq < db.repl.base {
+		return nil, nil, false
+	}
+	if idx := seq - db.repl.base; idx < uint64(len(db.repl.records)) {
+		return db.repl.records[idx:], nil, true
+	}
+	// a commit may be visible before it's in the log
+	return nil, db.repl.changed, true
+}
+
+// the ID of a new history
+func historyNew() [16]byte {
+	var hist [16]byte
+	_, err := rand.Read(hist[:])
+	assert(err == nil)
+	return hist
+}
+
+func (db *DB) history() [16]byte {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.hist
+}
+
+// the sequence number of the last commit
+func (db *DB) Seq() uint64 {
+	db.reader.RLock()
+	defer db.reader.RUnlock()
+	return db.reader.seq
+}
+
+// messages
+
+func replWriteMsg(w *bufio.Writer, typ byte, payload []byte) error {
+	var hdr [5]byte
+	hdr[0] = typ
+	binary.LittleEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func replReadMsg(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[1:])
+	if size > REPL_MAX_MSG {
+		return 0, nil, fmt.Errorf("message of %d bytes", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+func appendBytes(buf []byte, data []byte) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(data)))
+	return append(buf, data...)
+}
+
+// decodes a payload; the first error is kept and the rest reads zeros
+type replDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *replDecoder) next(n int) []byte {
+	if d.err == nil && len(d.data) < n {
+		d.err = errors.New("truncated message")
+	}
+	if d.err != nil {
+		return make([]byte, 8)[:min(n, 8)] // zeros for the numbers
+	}
+	out := d.data[:n]
+	d.data = d.data[n:]
+	return out
+}
+
+func (d *replDecoder) u8() byte      { return d.next(1)[0] }
+func (d *replDecoder) u32() uint32   { return binary.LittleEndian.Uint32(d.next(4)) }
+func (d *replDecoder) u64() uint64   { return binary.LittleEndian.Uint64(d.next(8)) }
+func (d *replDecoder) done() bool    { return d.err != nil || len(d.data) == 0 }
+func (d *replDecoder) bytes() []byte { return d.nbytes(d.u32()) }
+
+func (d *replDecoder) nbytes(n uint32) []byte {
+	data := d.next(int(n))
+	if d.err != nil {
+		return nil
+	}
+	return bytes.Clone(data)
+}
+
+func encodeRecord(rec replRecord) []byte {
+	buf := binary.LittleEndian.AppendUint64(nil, rec.seq)
+	for _, op := range rec.ops {
+		buf = append(buf, byte(op.kind))
+		switch op.kind {
+		case TXOP_SET:
+			buf = appendBytes(appendBytes(buf, op.key), op.val)
+		case TXOP_DEL:
+			buf = appendBytes(buf, op.key)
+		case TXOP_DEL_RANGE:
+			buf = appendBytes(buf, op.key)
+			if op.end == nil {
+				buf = binary.LittleEndian.AppendUint32(buf, replNilEnd)
+			} else {
+				buf = appendBytes(buf, op.end)
+			}
+		case TXOP_BATCH:
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(op.batch)))
+			for _, bop := range op.batch {
+				del := byte(0)
+				if bop.Del {
+					del = 1
+				}
+				buf = appendBytes(appendBytes(append(buf, del), bop.Key), bop.Val)
+			}
+		}
+	}
+	return buf
+}
+
+func decodeRecord(data []byte) (replRecord, error) {
+	d := &replDecoder{data: data}
+	rec := replRecord{seq: d.u64()}
+	for !d.done() {
+		op := txOp{kind: int(d.u8())}
+		switch op.kind {
+		case TXOP_SET:
+			op.key, op.val = d.bytes(), d.bytes()
+		case TXOP_DEL:
+			op.key = d.bytes()
+		case TXOP_DEL_RANGE:
+			op.key = d.bytes()
+			if n := d.u32(); n != replNilEnd {
+				op.end = d.nbytes(n) // not nil, even if empty
+			}
+		case TXOP_BATCH:
+			n := d.u32()
+			for i := uint32(0); i < n && d.err == nil; i++ {
+				del := d.u8()
+				op.batch = append(op.batch, Op{Del: del != 0, Key: d.bytes(), Val: d.bytes()})
+			}
+		default:
+			return replRecord{}, fmt.Errorf("record %d: bad op %d", rec.seq, op.kind)
+		}
+		rec.ops = append(rec.ops, op)
+	}
+	if d.err != nil {
+		return replRecord{}, fmt.Errorf("record %d: %w", rec.seq, d.err)
+	}
+	return rec, nil
+}
+
+// the name of the comparator in the master page, empty for the byte order
+func (db *DB) cmpName() string {
+	if db.tree.cmp == nil {
+		return ""
+	}
+	return db.opts.Comparator.Name
+}
+
+// primary
+
+// serves the commits of a DB to followers
+type Primary struct {
+	DB *DB
+	// internals
+	mu      sync.Mutex
+	ln      net.Listener
+	conns   map[net.Conn]struct{}
+	closing bool
+	stop    chan struct{}  // closed by Shutdown
+	wg      sync.WaitGroup // the connections
+}
+
+// accept followers until Shutdown, which makes it return ErrServerClosed;
+// the commits are kept for them from now on
+func (p *Primary) Serve(ln net.Listener) error {
+	p.DB.replEnable()
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		_ = ln.Close()
+		return ErrServerClosed
+	}
+	p.ln = ln
+	p.conns = map[net.Conn]struct{}{}
+	p.stop = make(chan struct{})
+	p.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		p.mu.Lock()
+		if p.closing {
+			p.mu.Unlock()
+			if conn != nil {
+				_ = conn.Close()
+			}
+			p.wg.Wait()
+			return ErrServerClosed
+		}
+		if err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		p.conns[conn] = struct{}{}
+		p.wg.Add(1)
+		p.mu.Unlock()
+		go p.serveConn(conn)
+	}
+}
+
+// stop accepting followers and disconnect them
+func (p *Primary) Shutdown() {
+	p.mu.Lock()
+	if p.ln != nil && !p.closing {
+		_ = p.ln.Close()
+		close(p.stop)
+	}
+	p.closing = true
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (p *Primary) serveConn(conn net.Conn) {
+	defer p.wg.Done()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	seq, empty, err := p.hello(r)
+	if err != nil {
+		if replWriteMsg(w, REPL_ERROR, []byte(err.Error())) == nil {
+			_ = w.Flush()
+		}
+		return
+	}
+	_ = p.DB.replStream(w, seq, empty, p.stop) // the follower reconnects on errors
+}
+
+// check the follower, returns its last sequence number and whether it's empty
+func (p *Primary) hello(r *bufio.Reader) (uint64, bool, error) {
+	typ, payload, err := replReadMsg(r)
+	if err != nil {
+		return 0, false, err
+	}
+	d := &replDecoder{data: payload}
+	sig := d.next(len(REPL_SIG))
+	seq, codec, cmpName := d.u64(), int(d.u32()), string(d.bytes())
+	hist := d.next(16)
+	switch {
+	case typ != REPL_HELLO || d.err != nil || string(sig) != REPL_SIG:
+		return 0, false, errors.New("not a follower")
+	case codec != p.DB.opts.Codec:
+		return 0, false, fmt.Errorf("the primary has codec %d, not %d", p.DB.opts.Codec, codec)
+	case cmpName != p.DB.cmpName():
+		return 0, false, fmt.Errorf("the primary has comparator %q, not %q", p.DB.cmpName(), cmpName)
+	case seq == 0:
+		return 0, true, nil // a new follower
+	case [16]byte(hist) != p.DB.history():
+		return 0, false, errors.New("the follower has another history, start it from an empty file")
+	case seq > p.DB.Seq():
+		return 0, false, fmt.Errorf("the follower is at %d, ahead of the primary at %d", seq, p.DB.Seq())
+	}
+	return seq, false, nil
+}
+
+// send a snapshot if needed, then the records after `seq` as they come
+func (db *DB) replStream(w *bufio.Writer, seq uint64, empty bool, stop <-chan struct{}) error {
+	if _, _, ok := db.replSince(seq); empty || !ok {
+		var err error
+		if seq, err = db.replSnapshot(w); err != nil {
+			return err
+		}
+	}
+	for {
+		records, changed, ok := db.replSince(seq)
+		if !ok {
+			return errors.New("the follower fell behind the log")
+		}
+		for _, rec := range records {
+			if err := replWriteMsg(w, REPL_RECORD, encodeRecord(rec)); err != nil {
+				return err
+			}
+			seq = rec.seq
+		}
+		if len(records) > 0 {
+			continue
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// send the last commit, returns its sequence number
+func (db *DB) replSnapshot(w *bufio.Writer) (uint64, error) {
+	hist := db.history() // before the tree, a follower loading a snapshot changes both
+	tree, seq := db.pinSeq()
+	defer db.unpin(tree.store)
+	msg := binary.LittleEndian.AppendUint64(nil, seq)
+	if err := replWriteMsg(w, REPL_SNAPSHOT, append(msg, hist[:]...)); err != nil {
+		return 0, err
+	}
+	count := uint64(0)
+	for iter := tree.SeekLE(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if len(key) == 0 {
+			continue // the dummy key
+		}
+		if err := replWriteMsg(w, REPL_KV, append(appendBytes(nil, key), val...)); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return seq, replWriteMsg(w, REPL_END, binary.LittleEndian.AppendUint64(nil, count))
+}
+
+// follower
+
+// keeps a DB up to date with a primary, reconnecting after errors;
+// the DB is read-only until Close
+type Follower struct {
+	DB   *DB
+	Addr string // the primary
+	// internals
+	mu        sync.Mutex
+	conn      net.Conn
+	closing   bool
+	err       error // the last one
+	snapshots int   // the number of snapshots loaded
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// make a DB follow the primary at addr, it must not be written to
+func Follow(db *DB, addr string) *Follower {
+	db.mu.Lock()
+	db.replica = true
+	db.mu.Unlock()
+	f := &Follower{DB: db, Addr: addr, stop: make(chan struct{}), done: make(chan struct{})}
+	go f.run()
+	return f
+}
+
+// stop following, the DB is writable again
+func (f *Follower) Close() {
+	f.mu.Lock()
+	if !f.closing {
+		f.closing = true
+		close(f.stop)
+		if f.conn != nil {
+			_ = f.conn.Close()
+		}
+	}
+	f.mu.Unlock()
+	<-f.done
+
+	f.DB.mu.Lock()
+	f.DB.replica = false
+	f.DB.mu.Unlock()
+}
+
+// why the follower was last disconnected, nil if it never was
+func (f *Follower) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *Follower) run() {
+	defer close(f.done)
+	for {
+		conn, err := net.DialTimeout("tcp", f.Addr, REPL_RETRY)
+		if err == nil {
+			err = f.session(conn)
+		}
+		f.mu.Lock()
+		if f.closing {
+			f.mu.Unlock()
+			return
+		}
+		f.err = err
+		f.mu.Unlock()
+
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(REPL_RETRY):
+		}
+	}
+}
+
+// apply what the primary sends until the connection fails
+func (f *Follower) session(conn net.Conn) error {
+	f.mu.Lock()
+	if f.closing {
+		f.mu.Unlock()
+		return conn.Close()
+	}
+	f.conn = conn
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.conn = nil
+		f.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	db := f.DB
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	hello := append([]byte(REPL_SIG), binary.LittleEndian.AppendUint64(nil, db.Seq())...)
+	hello = binary.LittleEndian.AppendUint32(hello, uint32(db.opts.Codec))
+	hello = appendBytes(hello, []byte(db.cmpName()))
+	hist := db.history()
+	hello = append(hello, hist[:]...)
+	if err := replWriteMsg(w, REPL_HELLO, hello); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		typ, payload, err := replReadMsg(r)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case REPL_ERROR:
+			return fmt.Errorf("primary: %s", payload)
+		case REPL_SNAPSHOT:
+			d := &replDecoder{data: payload}
+			seq, hist := d.u64(), d.next(16)
+			if d.err != nil {
+				return d.err
+			}
+			if err := db.replLoad(seq, [16]byte(hist), r); err != nil {
+				return err
+			}
+			f.mu.Lock()
+			f.snapshots++
+			f.mu.Unlock()
+		case REPL_RECORD:
+			rec, err := decodeRecord(payload)
+			if err != nil {
+				return err
+			}
+			if err := db.replApply(rec); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected message %d", typ)
+		}
+	}
+}
+
+// commit a record of the primary
+func (db *DB) replApply(rec replRecord) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if rec.seq != db.seq+1 {
+		return fmt.Errorf("record %d after %d", rec.seq, db.seq)
+	}
+	root := db.tree.root
+	(&txLog{ops: rec.ops}).replay(&db.tree)
+	db.seq = rec.seq
+	if err := updateOrRevert(db, root); err != nil {
+		db.seq--
+		return err
+	}
+	return nil
+}
+
+// replace the tree with a snapshot of the primary, in a single commit,
+// and take the history of the primary
+func (db *DB) replLoad(seq uint64, hist [16]byte, r *bufio.Reader) error {
+	var err error
+	count := uint64(0)
+	kvs := func(yield func([]byte, []byte) bool) {
+		for {
+			var typ byte
+			var payload []byte
+			if typ, payload, err = replReadMsg(r); err != nil {
+				return
+			}
+			d := &replDecoder{data: payload}
+			switch typ {
+			case REPL_KV:
+				key := d.bytes()
+				if d.err != nil {
+					err = d.err
+					return
+				}
+				count++
+				if !yield(key, d.data) {
+					return
+				}
+			case REPL_END:
+				if n := d.u64(); n != count {
+					err = fmt.Errorf("snapshot of %d KVs, expect %d", count, n)
+				}
+				return
+			default:
+				err = fmt.Errorf("unexpected message %d in a snapshot", typ)
+				return
+			}
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	root, oldSeq, oldHist := db.tree.root, db.seq, db.hist
+	db.tree.root = 0
+	if lerr := db.tree.BulkLoad(kvs); lerr != nil && err == nil {
+		err = lerr
+	}
+	if err != nil {
+		db.tree.root = root
+		db.page.temp = db.page.temp[:0]
+		return err
+	}
+	db.seq, db.hist = seq, hist
+	if err := updateOrRevert(db, root); err != nil {
+		db.seq, db.hist = oldSeq, oldHist
+		return err
+	}
+	return nil
+}
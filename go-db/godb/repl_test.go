@@ -0,0 +1,283 @@
+package godb
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"db.com/m/internal/kvtest"
+)
+
+// serve the commits of a DB on a loopback address, "" for any port
+func startTestPrimary(t *testing.T, db *DB, addr string) (*Primary, string) {
+	t.Helper()
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Primary{DB: db}
+	done := make(chan error, 1)
+	go func() { done <- p.Serve(ln) }()
+	t.Cleanup(func() {
+		p.Shutdown()
+		if err := <-done; err != ErrServerClosed {
+			t.Error(err)
+		}
+	})
+	return p, ln.Addr().String()
+}
+
+// wait until the follower has the commits of the primary
+func waitReplica(t *testing.T, f *Follower, primary *DB) {
+	t.Helper()
+	seq := primary.Seq()
+	for deadline := time.Now().Add(10 * time.Second); f.DB.Seq() != seq; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower at %d, primary at %d: %v", f.DB.Seq(), seq, f.Err())
+		}
+	}
+	ptree, ftree := primary.pin(), f.DB.pin()
+	if !reflect.DeepEqual(dumpTree(&ptree), dumpTree(&ftree)) {
+		t.Fatal("the follower differs from the primary")
+	}
+	if err := f.DB.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p *Primary) followers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+func (f *Follower) snapshotCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.snapshots
+}
+
+// updates of each kind
+func replWorkload(t *testing.T, db *DB, round int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d-%03d", round, i))
+		if err := db.Set(key, []byte(strings.Repeat("v", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	steps := []error{
+		db.Update(&UpdateReq{Key: []byte("ttl"), Val: []byte("x"), TTL: time.Hour}),
+		db.ApplyBatch([]Op{{Key: []byte("b1"), Val: []byte("1")}, {Key: []byte(fmt.Sprintf("key%d-000", round)), Del: true}}),
+	}
+	_, err := db.Del([]byte(fmt.Sprintf("key%d-001", round)))
+	steps = append(steps, err)
+	_, err = db.DeleteRange([]byte(fmt.Sprintf("key%d-050", round)), []byte(fmt.Sprintf("key%d-060", round)))
+	steps = append(steps, err)
+	_, err = db.DeleteRange([]byte(fmt.Sprintf("key%d-090", round)), nil)
+	steps = append(steps, err)
+	for _, err := range steps {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a transaction of several updates
+	var tx Tx
+	db.Begin(&tx)
+	tx.Set([]byte("tx1"), []byte(fmt.Sprint(round)))
+	tx.Set([]byte("tx2"), []byte(fmt.Sprint(round)))
+	tx.Del([]byte("b1"))
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	dir := t.TempDir()
+	ppath, fpath := filepath.Join(dir, "primary.db"), filepath.Join(dir, "follower.db")
+	primary := openTestKV(t, ppath, nil)
+	replWorkload(t, primary, 0) // before serving, sent as a snapshot
+	srv, addr := startTestPrimary(t, primary, "")
+
+	fdb := openTestKV(t, fpath, nil)
+	f := Follow(fdb, addr)
+	waitReplica(t, f, primary)
+	if f.snapshotCount() != 1 {
+		t.Fatalf("%d snapshots", f.snapshotCount())
+	}
+	if err := fdb.Set([]byte("a"), []byte("b")); err != ErrReadOnly {
+		t.Fatalf("write to a follower: %v", err)
+	}
+	replWorkload(t, primary, 1)
+	waitReplica(t, f, primary)
+
+	// the follower resumes after its last commit
+	f.Close()
+	replWorkload(t, primary, 2)
+	fdb.Close()
+	fdb = openTestKV(t, fpath, nil)
+	f = Follow(fdb, addr)
+	waitReplica(t, f, primary)
+	if f.snapshotCount() != 0 {
+		t.Fatal("sent a snapshot to a follower in the log")
+	}
+
+	// a restarted primary resumes from its last commit, with an empty log
+	seq := primary.Seq()
+	srv.Shutdown()
+	primary.Close()
+	primary = openTestKV(t, ppath, nil)
+	if primary.Seq() != seq {
+		t.Fatalf("seq %d after reopen, expect %d", primary.Seq(), seq)
+	}
+	srv, _ = startTestPrimary(t, primary, addr)
+	// the commits are kept from Serve, the follower reconnects after it
+	for deadline := time.Now().Add(10 * time.Second); srv.followers() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("not reconnected: %v", f.Err())
+		}
+	}
+	replWorkload(t, primary, 3)
+	waitReplica(t, f, primary)
+	if f.snapshotCount() != 0 {
+		t.Fatal("sent a snapshot to a follower up to date")
+	}
+
+	// a follower missing records that aren't in the log gets a snapshot
+	f.Close()
+	replWorkload(t, primary, 4)
+	srv.Shutdown()
+	primary.Close()
+	primary = openTestKV(t, ppath, nil)
+	_, addr = startTestPrimary(t, primary, "")
+	f = Follow(fdb, addr)
+	waitReplica(t, f, primary)
+	if f.snapshotCount() != 1 {
+		t.Fatalf("%d snapshots", f.snapshotCount())
+	}
+	f.Close()
+	if err := fdb.Set([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wait until the follower fails with an error like `expect`
+func waitReplError(t *testing.T, f *Follower, expect string) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); f.Err() == nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no error")
+		}
+	}
+	if err := f.Err(); !strings.Contains(err.Error(), expect) {
+		t.Fatal(err)
+	}
+}
+
+func TestReplicationRejected(t *testing.T) {
+	primary := openTestKV(t, filepath.Join(t.TempDir(), "primary.db"), nil)
+	primary.Set([]byte("a"), []byte("1"))
+	_, addr := startTestPrimary(t, primary, "")
+
+	// a file with commits of its own
+	fdb := openTestKV(t, filepath.Join(t.TempDir(), "follower.db"), nil)
+	fdb.Set([]byte("a"), []byte("1"))
+	f := Follow(fdb, addr)
+	waitReplError(t, f, "another history")
+	f.Close()
+
+	// a follower written to after it stopped following
+	fdb = openTestKV(t, filepath.Join(t.TempDir(), "follower2.db"), nil)
+	f = Follow(fdb, addr)
+	waitReplica(t, f, primary)
+	f.Close()
+	fdb.Set([]byte("b"), []byte("2"))
+	f = Follow(fdb, addr)
+	defer f.Close()
+	waitReplError(t, f, "ahead of the primary")
+}
+
+// a restored primary has a new history: its followers start over
+func TestReplicationRestored(t *testing.T) {
+	dir := t.TempDir()
+	src := openTestKV(t, filepath.Join(dir, "src.db"), nil)
+	ref := kvtest.Fill(t, src, 500)
+	var dump bytes.Buffer
+	if _, err := src.Backup(&dump); err != nil {
+		t.Fatal(err)
+	}
+	ppath := filepath.Join(dir, "primary.db")
+	if _, err := Restore(ppath, &dump, nil); err != nil {
+		t.Fatal(err)
+	}
+	primary := openTestKV(t, ppath, nil)
+	if primary.Seq() == 0 {
+		t.Fatal("the restore is not a commit")
+	}
+	_, addr := startTestPrimary(t, primary, "")
+
+	// an empty follower gets the restored data
+	fdb := openTestKV(t, filepath.Join(dir, "follower.db"), nil)
+	f := Follow(fdb, addr)
+	waitReplica(t, f, primary)
+	if f.snapshotCount() != 1 {
+		t.Fatalf("%d snapshots", f.snapshotCount())
+	}
+	f.Close()
+	kvtest.Check(t, fdb.Seek(nil), ref)
+
+	// a follower of another primary at the same sequence number
+	other := openTestKV(t, filepath.Join(dir, "other.db"), nil)
+	if err := other.Set([]byte("x"), []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	_, otherAddr := startTestPrimary(t, other, "")
+	fdb = openTestKV(t, filepath.Join(dir, "follower2.db"), nil)
+	f = Follow(fdb, otherAddr)
+	waitReplica(t, f, other)
+	f.Close()
+	if fdb.Seq() != primary.Seq() {
+		t.Fatalf("seq %d, expect %d", fdb.Seq(), primary.Seq())
+	}
+	f = Follow(fdb, addr)
+	defer f.Close()
+	waitReplError(t, f, "another history")
+}
+
+func TestReplRecordCodec(t *testing.T) {
+	rec := replRecord{seq: 7, ops: []txOp{
+		{kind: TXOP_SET, key: []byte("k"), val: []byte{}},
+		{kind: TXOP_DEL, key: []byte("d")},
+		{kind: TXOP_DEL_RANGE, key: []byte("a"), end: nil},
+		{kind: TXOP_DEL_RANGE, key: []byte("a"), end: []byte{}},
+		{kind: TXOP_BATCH, batch: []Op{{Key: []byte("x"), Val: []byte("1")}, {Key: []byte("y"), Val: []byte{}, Del: true}}},
+	}}
+	data := encodeRecord(rec)
+	got, err := decodeRecord(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.seq != rec.seq || len(got.ops) != len(rec.ops) {
+		t.Fatalf("%+v", got)
+	}
+	if got.ops[2].end != nil || got.ops[3].end == nil {
+		t.Fatal("the nil end of a range")
+	}
+	if fmt.Sprint(got.ops) != fmt.Sprint(rec.ops) {
+		t.Fatalf("%v != %v", got.ops, rec.ops)
+	}
+	// a truncated op is an error, a message ends at an op
+	for i := range data {
+		if got, err := decodeRecord(data[:i]); err == nil && len(got.ops) >= len(rec.ops) {
+			t.Fatalf("decoded a truncated record of %d bytes", i)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package godb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a TCP server for a subset of the Redis protocol (RESP). a command is either
+// a RESP array of bulk strings, as sent by Redis clients, or an inline line
+// of words separated by spaces, as typed in telnet.
+//
+//	GET key
+//	SET key value [EX seconds | PX milliseconds] [NX | XX]
+//	DEL key [key ...]
+//	SCAN cursor [COUNT count]
+//	MULTI, EXEC, DISCARD, PING [message], QUIT
+//
+// each write command is a transaction of its own, and MULTI/EXEC runs the
+// queued commands in a single transaction.
+
+// limits of the requests
+const (
+	RESP_MAX_LINE = 16 << 10
+	RESP_MAX_ARGS = 1 << 16
+	RESP_MAX_BULK = 1 << 16
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+type Server struct {
+	DB *DB
+	// internals
+	mu      sync.Mutex
+	ln      net.Listener
+	conns   map[net.Conn]struct{}
+	closing bool
+	wg      sync.WaitGroup // the connections
+}
+
+// accept connections until Shutdown, which makes it return ErrServerClosed
+// after the connections are closed
+func (srv *Server) Serve(ln net.Listener) error {
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		_ = ln.Close()
+		return ErrServerClosed
+	}
+	srv.ln = ln
+	srv.conns = map[net.Conn]struct{}{}
+	srv.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		srv.mu.Lock()
+		if srv.closing {
+			srv.mu.Unlock()
+			if conn != nil {
+				_ = conn.Close()
+			}
+			srv.wg.Wait()
+			return ErrServerClosed
+		}
+		if err != nil {
+			srv.mu.Unlock()
+			return err
+		}
+		srv.conns[conn] = struct{}{}
+		srv.wg.Add(1)
+		srv.mu.Unlock()
+		go srv.serveConn(conn)
+	}
+}
+
+// stop accepting connections and close them once their running command is
+// done. replies are only sent after the commit, so no acknowledged write is
+// lost; a MULTI that wasn't executed is dropped.
+func (srv *Server) Shutdown() {
+	srv.mu.Lock()
+	srv.closing = true
+	if srv.ln != nil {
+		_ = srv.ln.Close()
+	}
+	for conn := range srv.conns {
+		// wake up the connections waiting for a command
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	srv.mu.Unlock()
+	srv.wg.Wait()
+}
+
+func (srv *Server) serveConn(conn net.Conn) {
+	defer srv.wg.Done()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, conn)
+		srv.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	r := bufio.NewReaderSize(conn, RESP_MAX_LINE)
+	w := bufio.NewWriter(conn)
+	s := &session{db: srv.DB}
+	for {
+		args, err := readCommand(r)
+		var perr protocolError
+		if errors.As(err, &perr) {
+			writeReply(w, respError("ERR Protocol error: "+string(perr)))
+			_ = w.Flush()
+			return
+		}
+		if err != nil {
+			return // closed, or shutting down
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		reply, quit := s.handle(args)
+		writeReply(w, reply)
+		// flush when the pipelined commands are done
+		if quit || r.Buffered() == 0 {
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// RESP
+
+type protocolError string
+
+func (e protocolError) Error() string {
+	return string(e)
+}
+
+// read a command, either a RESP array or an inline line
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		var args [][]byte
+		for _, word := range bytes.Fields(line) {
+			args = append(args, bytes.Clone(word))
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > RESP_MAX_ARGS {
+		return nil, protocolError("invalid multibulk length")
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%.1s'", line))
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > RESP_MAX_BULK {
+			return nil, protocolError("invalid bulk length")
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(data, []byte("\r\n")) {
+			return nil, protocolError("bulk string without CRLF")
+		}
+		args = append(args, data[:size])
+	}
+	return args, nil
+}
+
+// a line without the line ending
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, protocolError("line too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return line, nil
+}
+
+// the replies other than a bulk string ([]byte), an integer (int)
+// and an array ([]any)
+type (
+	respSimple string   // a status like OK
+	respError  string   // starts with the kind of error like ERR
+	respNil    struct{} // a missing value
+)
+
+func writeReply(w *bufio.Writer, reply any) {
+	switch v := reply.(type) {
+	case respSimple:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case respError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case respNil:
+		fmt.Fprintf(w, "$-1\r\n")
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n", len(v))
+		w.Write(v)
+		w.WriteString("\r\n")
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	default:
+		panic(fmt.Sprintf("bad reply %T", reply))
+	}
+}
+
+// COMMANDS
+
+// what the commands run on: the database, or the transaction of a write or an EXEC
+type kvStore interface {
+	Get(key []byte) ([]byte, bool, error)
+	Seek(key []byte) *Iter
+	Update(req *UpdateReq) error
+	Del(key []byte) (bool, error)
+}
+
+type respCommand struct {
+	arity int  // the number of args with the name, -N for at least N
+	write bool // runs in a transaction
+	run   func(store kvStore, args [][]byte) any
+}
+
+var respCommands = map[string]respCommand{
+	"PING": {arity: -1, run: cmdPing},
+	"GET":  {arity: 2, run: cmdGet},
+	"SCAN": {arity: -2, run: cmdScan},
+	"SET":  {arity: -3, write: true, run: cmdSet},
+	"DEL":  {arity: -2, write: true, run: cmdDel},
+}
+
+// the state of a connection
+type session struct {
+	db    *DB
+	multi bool       // queuing commands for EXEC
+	queue [][][]byte // the queued commands
+	dirty bool       // a command was rejected while queuing, EXEC fails
+}
+
+func (s *session) handle(args [][]byte) (reply any, quit bool) {
+	name := strings.ToUpper(string(args[0]))
+	switch name {
+	case "QUIT":
+		return respSimple("OK"), true
+	case "MULTI":
+		if s.multi {
+			return respError("ERR MULTI calls can not be nested"), false
+		}
+		s.multi, s.queue, s.dirty = true, nil, false
+		return respSimple("OK"), false
+	case "DISCARD":
+		if !s.multi {
+			return respError("ERR DISCARD without MULTI"), false
+		}
+		s.multi, s.queue = false, nil
+		return respSimple("OK"), false
+	case "EXEC":
+		if !s.multi {
+			return respError("ERR EXEC without MULTI"), false
+		}
+		queue, dirty := s.queue, s.dirty
+		s.multi, s.queue = false, nil
+		if dirty {
+			return respError("EXECABORT Transaction discarded because of previous errors."), false
+		}
+		return s.exec(queue), false
+	}
+
+	cmd, ok := respCommands[name]
+	var err respError
+	switch {
+	case !ok:
+		err = respError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	case (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity):
+		err = respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+	}
+	if err != "" {
+		s.dirty = s.dirty || s.multi
+		return err, false
+	}
+	if s.multi {
+		s.queue = append(s.queue, args)
+		return respSimple("QUEUED"), false
+	}
+
+	if !cmd.write {
+		return cmd.run(s.db, args), false // reads the last commit
+	}
+	return s.exec([][][]byte{args})[0], false
+}
+
+// run commands in a transaction, again on conflicts with other clients;
+// the replies are only valid if it commits
+func (s *session) exec(queue [][][]byte) []any {
+	replies := make([]any, len(queue))
+	err := s.db.transact(func(tx *Tx) error {
+		for i, args := range queue {
+			cmd := respCommands[strings.ToUpper(string(args[0]))]
+			replies[i] = cmd.run(tx, args)
+		}
+		return nil
+	})
+	if err != nil {
+		for i := range replies {
+			replies[i] = respError("ERR commit: " + err.Error())
+		}
+	}
+	return replies
+}
+
+func cmdPing(store kvStore, args [][]byte) any {
+	if len(args) > 1 {
+		return args[1]
+	}
+	return respSimple("PONG")
+}
+
+func cmdGet(store kvStore, args [][]byte) any {
+	val, ok, err := store.Get(args[1])
+	if err != nil {
+		return respError("ERR " + err.Error())
+	}
+	if !ok {
+		return respNil{}
+	}
+	return bytes.Clone(val)
+}
+
+func cmdSet(store kvStore, args [][]byte) any {
+	req := &UpdateReq{Key: args[1], Val: args[2]}
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch {
+		case opt == "NX" && req.Mode == MODE_UPSERT:
+			req.Mode = MODE_INSERT_ONLY
+		case opt == "XX" && req.Mode == MODE_UPSERT:
+			req.Mode = MODE_UPDATE_ONLY
+		case (opt == "EX" || opt == "PX") && req.TTL == 0 && i+1 < len(args):
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || n <= 0 {
+				return respError("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			req.TTL = time.Duration(n) * unit
+			i++
+		default:
+			return respError("ERR syntax error")
+		}
+	}
+
+	err := store.Update(req)
+	switch {
+	case err == ErrKeyExists || err == ErrKeyNotFound:
+		return respNil{} // the NX or XX condition isn't met
+	case err != nil:
+		return respError("ERR " + err.Error())
+	}
+	return respSimple("OK")
+}
+
+func cmdDel(store kvStore, args [][]byte) any {
+	count := 0
+	for _, key := range args[1:] {
+		deleted, err := store.Del(key)
+		if err != nil {
+			return respError("ERR " + err.Error())
+		}
+		if deleted {
+			count++
+		}
+	}
+	return count
+}
+
+// the cursor is the hex of the next key, or "0" at the start and at the end
+func cmdScan(store kvStore, args [][]byte) any {
+	var start []byte
+	if cursor := string(args[1]); cursor != "0" {
+		var err error
+		if start, err = hex.DecodeString(cursor); err != nil || len(start) == 0 {
+			return respError("ERR invalid cursor")
+		}
+	}
+	count := 10
+	for i := 2; i < len(args); i += 2 {
+		if strings.ToUpper(string(args[i])) != "COUNT" || i+1 >= len(args) {
+			return respError("ERR syntax error")
+		}
+		n, err := strconv.Atoi(string(args[i+1]))
+		if err != nil || n <= 0 {
+			return respError("ERR value is not an integer or out of range")
+		}
+		count = n
+	}
+
+	keys := []any{}
+	iter := store.Seek(start)
+	defer iter.Close()
+	for ; iter.Valid() && len(keys) < count; iter.Next() {
+		key, _ := iter.Deref()
+		keys = append(keys, bytes.Clone(key))
+	}
+	next := "0"
+	if iter.Valid() {
+		key, _ := iter.Deref()
+		next = hex.EncodeToString(key)
+	}
+	return []any{[]byte(next), keys}
+}
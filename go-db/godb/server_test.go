@@ -0,0 +1,293 @@
+package godb_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"db.com/m/godb"
+	"db.com/m/godbtest"
+)
+
+// a RESP client for the tests
+type respClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTest(t *testing.T, addr string) *respClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &respClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// send a command as a RESP array and read the reply
+func (c *respClient) do(t *testing.T, args ...string) string {
+	t.Helper()
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// a reply in a compact form: OK, -ERR ..., "bulk", nil, 1, [a b]
+func (c *respClient) read() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return line, nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "nil", nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return "", err
+		}
+		return strconv.Quote(string(data[:n])), nil
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]string, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return "", err
+			}
+		}
+		return "[" + strings.Join(items, " ") + "]", nil
+	}
+	return "", fmt.Errorf("bad reply %q", line)
+}
+
+func startTestServer(t *testing.T) (*godb.Server, *godb.DB, string) {
+	db := godbtest.Open(t, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &godb.Server{DB: db}
+	done := make(chan error)
+	go func() { done <- srv.Serve(ln) }()
+	t.Cleanup(func() {
+		srv.Shutdown()
+		if err := <-done; err != godb.ErrServerClosed {
+			t.Error(err)
+		}
+	})
+	return srv, db, ln.Addr().String()
+}
+
+func TestServerCommands(t *testing.T) {
+	_, db, addr := startTestServer(t)
+	c := dialTest(t, addr)
+	steps := [][2]string{
+		{"PING", "PONG"},
+		{"GET a", "nil"},
+		{"SET a 1", "OK"},
+		{"SET b 2", "OK"},
+		{"set c 3", "OK"},
+		{"GET a", `"1"`},
+		{"SET a x NX", "nil"},
+		{"SET z x XX", "nil"},
+		{"SET a 4 XX", "OK"},
+		{"GET a", `"4"`},
+		{"SET t v EX 100", "OK"},
+		{"SET t v EX 0", "-ERR invalid expire time in 'set' command"},
+		{"SET t v NX XX", "-ERR syntax error"},
+		{"DEL a b nope", "2"},
+		{"SCAN 0", `["0" ["c" "t"]]`},
+		{"SCAN 0 COUNT 1", `["74" ["c"]]`},
+		{"SCAN 74 COUNT 1", `["0" ["t"]]`},
+		{"SCAN zz", "-ERR invalid cursor"},
+		{"GET", "-ERR wrong number of arguments for 'get' command"},
+		{"NOPE", "-ERR unknown command 'NOPE'"},
+		{"EXEC", "-ERR EXEC without MULTI"},
+	}
+	for _, step := range steps {
+		if got := c.do(t, strings.Fields(step[0])...); got != step[1] {
+			t.Fatalf("%s: got %s, expect %s", step[0], got, step[1])
+		}
+	}
+	// values with spaces and empty values
+	if got := c.do(t, "SET", "k", "a b\r\nc"); got != "OK" {
+		t.Fatal(got)
+	}
+	if got := c.do(t, "GET", "k"); got != `"a b\r\nc"` {
+		t.Fatal(got)
+	}
+	if got := c.do(t, "SET", "", "v"); !strings.HasPrefix(got, "-ERR") {
+		t.Fatal(got)
+	}
+	if val, ok, _ := db.Get([]byte("c")); !ok || string(val) != "3" {
+		t.Fatal("not written to the database")
+	}
+}
+
+func TestServerInline(t *testing.T) {
+	_, _, addr := startTestServer(t)
+	c := dialTest(t, addr)
+	// pipelined inline commands
+	if _, err := c.conn.Write([]byte("SET a 1\r\nGET a\nDEL a\r\n\r\nQUIT\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	var replies []string
+	for {
+		reply, err := c.read()
+		if err != nil {
+			break // closed by QUIT
+		}
+		replies = append(replies, reply)
+	}
+	if got := fmt.Sprint(replies); got != `[OK "1" 1 OK]` {
+		t.Fatal(got)
+	}
+
+	c = dialTest(t, addr)
+	if _, err := c.conn.Write([]byte("*1\r\n#3\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply, _ := c.read(); !strings.HasPrefix(reply, "-ERR Protocol error") {
+		t.Fatal(reply)
+	}
+}
+
+func TestServerMulti(t *testing.T) {
+	_, db, addr := startTestServer(t)
+	c := dialTest(t, addr)
+	c.do(t, "SET", "a", "1")
+
+	steps := [][2]string{
+		{"MULTI", "OK"},
+		{"MULTI", "-ERR MULTI calls can not be nested"},
+		{"SET a 2", "QUEUED"},
+		{"GET a", "QUEUED"},
+		{"SET a 3 NX", "QUEUED"},
+		{"DEL a", "QUEUED"},
+		{"SET b 1", "QUEUED"},
+	}
+	for _, step := range steps {
+		if got := c.do(t, strings.Fields(step[0])...); got != step[1] {
+			t.Fatalf("%s: got %s, expect %s", step[0], got, step[1])
+		}
+	}
+	// queued commands are not visible yet
+	other := dialTest(t, addr)
+	if got := other.do(t, "GET", "a"); got != `"1"` {
+		t.Fatal(got)
+	}
+	if got := c.do(t, "EXEC"); got != `[OK "2" nil 1 OK]` {
+		t.Fatal(got)
+	}
+	if _, ok, _ := db.Get([]byte("a")); ok {
+		t.Fatal("a is not deleted")
+	}
+
+	// discarded
+	c.do(t, "MULTI")
+	c.do(t, "SET", "b", "2")
+	if got := c.do(t, "DISCARD"); got != "OK" {
+		t.Fatal(got)
+	}
+	if got := c.do(t, "GET", "b"); got != `"1"` {
+		t.Fatal(got)
+	}
+	// rejected while queuing
+	c.do(t, "MULTI")
+	c.do(t, "SET", "b", "3")
+	c.do(t, "GET")
+	if got := c.do(t, "EXEC"); !strings.HasPrefix(got, "-EXECABORT") {
+		t.Fatal(got)
+	}
+	if got := c.do(t, "GET", "b"); got != `"1"` {
+		t.Fatal(got)
+	}
+}
+
+func TestServerConcurrentMulti(t *testing.T) {
+	_, _, addr := startTestServer(t)
+	// writers set 2 keys to the same value, readers never see them differ
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		c := dialTest(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				val := fmt.Sprint(i*1000 + j)
+				c.do(t, "MULTI")
+				if i%2 == 0 {
+					c.do(t, "SET", "x", val)
+					c.do(t, "SET", "y", val)
+					if got := c.do(t, "EXEC"); got != "[OK OK]" {
+						t.Error(got)
+						return
+					}
+					continue
+				}
+				c.do(t, "GET", "x")
+				c.do(t, "GET", "y")
+				got := strings.Fields(strings.Trim(c.do(t, "EXEC"), "[]"))
+				if len(got) != 2 || got[0] != got[1] {
+					t.Errorf("x and y differ: %v", got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServerShutdown(t *testing.T) {
+	srv, db, addr := startTestServer(t)
+	c := dialTest(t, addr)
+	c.do(t, "SET", "a", "1")
+	c.do(t, "MULTI")
+	c.do(t, "SET", "b", "1")
+
+	done := make(chan struct{})
+	go func() {
+		srv.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown is blocked by an idle connection")
+	}
+	if _, err := c.read(); err == nil {
+		t.Fatal("the connection is still open")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("still accepting connections")
+	}
+	if _, ok, _ := db.Get([]byte("a")); !ok {
+		t.Fatal("a committed write is lost")
+	}
+	if _, ok, _ := db.Get([]byte("b")); ok {
+		t.Fatal("an unexecuted MULTI is applied")
+	}
+}
@@ -0,0 +1,106 @@
+package godb
+
+import "math/bits"
+
+// a histogram of byte sizes in power-of-two buckets:
+// bucket 0 counts empty ones, bucket i counts sizes in [2^(i-1), 2^i)
+type SizeHistogram [13]int
+
+func (h *SizeHistogram) add(size int) {
+	h[bits.Len(uint(size))]++
+}
+
+// the range of sizes counted by a bucket
+func (h *SizeHistogram) Bucket(i int) (lo int, hi int) {
+	if i == 0 {
+		return 0, 0
+	}
+	return 1 << (i - 1), 1<<i - 1
+}
+
+type LevelStats struct {
+	Nodes int
+	Keys  int
+	Bytes int // the sum of node sizes
+}
+
+// the average fraction of a page used by the nodes of a level
+func (l LevelStats) AvgFill() float64 {
+	if l.Nodes == 0 {
+		return 0
+	}
+	return float64(l.Bytes) / float64(l.Nodes*BTREE_PAGE_SIZE)
+}
+
+type TreeStats struct {
+	Height   int
+	Internal int           // number of internal nodes
+	Leaves   int           // number of leaf nodes
+	Keys     int           // number of user keys in leaves, see Reserved
+	Reserved int           // number of internal keys: the expiry index, the tables
+	Levels   []LevelStats  // from the root down to the leaves
+	KeySizes SizeHistogram // of the user keys
+	ValSizes SizeHistogram
+}
+
+// walk the whole tree and collect the shape and size of it
+func (tree *BTree) Stats() TreeStats {
+	var stats TreeStats
+	if tree.root != 0 {
+		statsWalk(tree, tree.get(tree.root), 0, &stats)
+	}
+	stats.Height = len(stats.Levels)
+	return stats
+}
+
+func statsWalk(tree *BTree, node BNode, depth int, stats *TreeStats) {
+	if depth == len(stats.Levels) {
+		stats.Levels = append(stats.Levels, LevelStats{})
+	}
+	level := &stats.Levels[depth]
+	level.Nodes++
+	level.Keys += int(node.nkeys())
+	level.Bytes += int(node.nbytes())
+
+	switch node.btype() {
+	case BNODE_LEAF:
+		stats.Leaves++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.getKey(i)
+			if len(key) == 0 {
+				continue // the dummy key
+			}
+			if key[0] == 0 {
+				stats.Reserved++
+				continue
+			}
+			stats.Keys++
+			stats.KeySizes.add(len(key))
+			stats.ValSizes.add(len(node.getVal(i)))
+		}
+	case BNODE_NODE:
+		stats.Internal++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			statsWalk(tree, tree.get(node.getPtr(i)), depth+1, stats)
+		}
+	default:
+		panic("bad node!")
+	}
+}
+
+// the statistics of a database: the last committed tree and the file
+type DBStats struct {
+	TreeStats
+	FileSize int    // in bytes, can be larger than the used pages
+	Pages    uint64 // number of pages used, the master page included
+}
+
+func (db *DB) Stats() DBStats {
+	db.mu.Lock()
+	stats := DBStats{FileSize: db.mmap.file, Pages: db.page.flushed}
+	tree := db.pin()
+	db.mu.Unlock()
+	defer db.unpin(tree.store)
+	stats.TreeStats = tree.Stats()
+	return stats
+}
@@ -0,0 +1,78 @@
+package godb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTreeStats(t *testing.T) {
+	c := newC()
+	if stats := c.tree.Stats(); stats.Height != 0 || stats.Keys != 0 {
+		t.Fatalf("empty tree: %+v", stats)
+	}
+
+	for i := 0; i < 5000; i++ {
+		c.add(fmt.Sprintf("k%d", i), string(make([]byte, i%100)))
+	}
+	stats := c.tree.Stats()
+	if stats.Keys != len(c.ref) {
+		t.Fatalf("%d keys, expect %d", stats.Keys, len(c.ref))
+	}
+	if stats.Internal+stats.Leaves != len(c.pages) {
+		t.Fatalf("%d nodes, expect %d pages", stats.Internal+stats.Leaves, len(c.pages))
+	}
+	if stats.Height < 2 || stats.Height != len(stats.Levels) {
+		t.Fatalf("height %d", stats.Height)
+	}
+	if stats.Levels[0].Nodes != 1 || stats.Levels[stats.Height-1].Nodes != stats.Leaves {
+		t.Fatalf("bad levels %+v", stats.Levels)
+	}
+	for i, level := range stats.Levels {
+		if fill := level.AvgFill(); fill <= 0 || fill > 1 {
+			t.Fatalf("level %d: fill %f", i, fill)
+		}
+	}
+
+	sum := func(h *SizeHistogram) int {
+		n := 0
+		for _, count := range h {
+			n += count
+		}
+		return n
+	}
+	if sum(&stats.KeySizes) != stats.Keys || sum(&stats.ValSizes) != stats.Keys {
+		t.Fatal("histograms don't add up")
+	}
+	// "k0" to "k99" have 2 or 3 bytes, the rest have 4 or 5 bytes
+	if stats.KeySizes[2] != 100 || stats.KeySizes[3] != 5000-100 {
+		t.Fatalf("key sizes %v", stats.KeySizes)
+	}
+	// 50 values are empty, the 99-byte ones go to the [64, 127] bucket
+	if stats.ValSizes[0] != 50 {
+		t.Fatalf("value sizes %v", stats.ValSizes)
+	}
+	if lo, hi := stats.ValSizes.Bucket(7); lo != 64 || hi != 127 {
+		t.Fatalf("bucket 7 is [%d, %d]", lo, hi)
+	}
+}
+
+// the internal keys aren't counted as the user's
+func TestDBStatsReserved(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	if err := db.Set([]byte("plain"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(&UpdateReq{Key: []byte("ttl"), Val: []byte("v"), TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	stats := db.Stats()
+	if stats.Keys != 2 || stats.Reserved != 1 {
+		t.Fatalf("%d keys, %d internal", stats.Keys, stats.Reserved)
+	}
+	// "ttl" has 3 bytes, "plain" 5
+	if stats.KeySizes != (SizeHistogram{2: 1, 3: 1}) {
+		t.Fatalf("key sizes %v", stats.KeySizes)
+	}
+}
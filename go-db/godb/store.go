@@ -0,0 +1,59 @@
+package godb
+
+import "io"
+
+// the pages of a B+tree, BTREE_PAGE_SIZE bytes each.
+// the pointer 0 is never allocated, it's the null pointer of the tree.
+type PageStore interface {
+	// the page of a pointer, it must not be modified
+	Read(ptr uint64) []byte
+	// store a new page, the node is copied or must not be modified
+	Allocate(node []byte) uint64
+	// deallocate a page, it's no longer read
+	Free(ptr uint64)
+	// make the pages allocated so far durable
+	Sync() error
+	Close() error
+}
+
+// pages in memory, for tests and temporary trees
+type MemStore struct {
+	pages map[uint64][]byte
+	next  uint64
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{pages: map[uint64][]byte{}}
+}
+
+func (s *MemStore) Read(ptr uint64) []byte {
+	page, ok := s.pages[ptr]
+	assert(ok)
+	return page
+}
+
+func (s *MemStore) Allocate(node []byte) uint64 {
+	assert(BNode(node).nbytes() <= BTREE_PAGE_SIZE)
+	page := make([]byte, BTREE_PAGE_SIZE)
+	copy(page, node)
+	s.next++
+	s.pages[s.next] = page
+	return s.next
+}
+
+func (s *MemStore) Free(ptr uint64) {
+	assert(s.pages[ptr] != nil)
+	delete(s.pages, ptr)
+}
+
+func (s *MemStore) Sync() error  { return nil }
+func (s *MemStore) Close() error { return nil }
+
+// the file under a DB, an *os.File or a wrapper of it in the tests:
+// the commits write the master page and fsync through it
+type StoreFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
@@ -0,0 +1,106 @@
+package godb
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestMemStore(t *testing.T) {
+	store := NewMemStore()
+	testStorePages(t, store)
+	tree, ref := testStoreTree(t, store)
+	checkStoreTree(t, &tree, ref)
+}
+
+// a leaf with a random value
+func storeTestPage(r *rand.Rand) []byte {
+	node := BNode(make([]byte, BTREE_PAGE_SIZE))
+	node.setHeader(BNODE_LEAF, 1)
+	val := make([]byte, r.Intn(BTREE_MAX_VAL_SIZE))
+	r.Read(val)
+	nodeAppendKV(node, 0, 0, []byte("key"), val)
+	return node[:node.nbytes()]
+}
+
+// allocated pages read back until freed
+func testStorePages(t *testing.T, store PageStore) {
+	r := rand.New(rand.NewSource(1))
+	pages := map[uint64][]byte{}
+	allocate := func(n int) {
+		for i := 0; i < n; i++ {
+			page := storeTestPage(r)
+			ptr := store.Allocate(page)
+			if ptr == 0 || pages[ptr] != nil {
+				t.Fatalf("allocated %d twice", ptr)
+			}
+			pages[ptr] = bytes.Clone(page)
+			// the store doesn't keep the input
+			clear(page)
+		}
+	}
+	check := func() {
+		for ptr, page := range pages {
+			got := store.Read(ptr)
+			if len(got) != BTREE_PAGE_SIZE || !bytes.Equal(got[:len(page)], page) {
+				t.Fatalf("page %d differs", ptr)
+			}
+		}
+	}
+
+	allocate(100)
+	check()
+	for ptr := range pages {
+		if r.Intn(2) == 0 {
+			store.Free(ptr)
+			delete(pages, ptr)
+		}
+	}
+	check()
+	if err := store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	allocate(100)
+	check()
+	if err := store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+// a tree on the store, synced
+func testStoreTree(t *testing.T, store PageStore) (BTree, map[string]string) {
+	tree := BTree{store: store}
+	ref := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		key, val := fmt.Sprintf("key%05d", i*7%3000), fmt.Sprintf("val%d", i)
+		tree.Insert([]byte(key), []byte(val))
+		ref[key] = val
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%05d", i*3)
+		tree.Delete([]byte(key))
+		delete(ref, key)
+	}
+	checkStoreTree(t, &tree, ref)
+	if err := store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	return tree, ref
+}
+
+func checkStoreTree(t *testing.T, tree *BTree, ref map[string]string) {
+	t.Helper()
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if kvs := dumpTree(tree); len(kvs) != len(ref) {
+		t.Fatalf("%d keys, expect %d", len(kvs), len(ref))
+	}
+	for key, val := range ref {
+		if got, ok := tree.Get([]byte(key)); !ok || string(got) != val {
+			t.Fatalf("Get(%s) = %q, %v", key, got, ok)
+		}
+	}
+}
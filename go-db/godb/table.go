@@ -0,0 +1,460 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// typed tables over the tree. they live in the reserved key space, so the
+// KV API doesn't see them and they keep the byte order whatever the comparator:
+//
+//	CATALOG_PREFIX | name                    -> the TableDef in JSON
+//	META_PREFIX | "next_prefix"              -> the next free table prefix
+//	TABLE_PREFIX | prefix | primary key      -> the other columns
+//	TABLE_PREFIX | prefix | index cols       -> nothing (secondary index)
+//
+// the prefix is 4B big-endian. the columns are encoded so that their byte
+// order is the order of the values, see encodeValues.
+const (
+	CATALOG_PREFIX = "\x00c"
+	META_PREFIX    = "\x00m"
+	TABLE_PREFIX   = "\x00t"
+)
+
+// column types
+const (
+	TYPE_NULL    = 0 // only in query results, e.g. a LEFT JOIN without a match
+	TYPE_BYTES   = 1
+	TYPE_INT64   = 2
+	TYPE_FLOAT64 = 3 // only in query results, the AVG of a column
+)
+
+// a typed value of a column
+type Value struct {
+	Type uint32
+	I64  int64
+	Str  []byte
+	F64  float64
+}
+
+// a row, or a part of a row, as named columns
+type Record struct {
+	Cols []string
+	Vals []Value
+}
+
+func (rec *Record) AddStr(col string, val []byte) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_BYTES, Str: val})
+	return rec
+}
+
+func (rec *Record) AddInt64(col string, val int64) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_INT64, I64: val})
+	return rec
+}
+
+// the value of a column, nil if the record doesn't have it
+func (rec *Record) Get(col string) *Value {
+	for i, c := range rec.Cols {
+		if c == col {
+			return &rec.Vals[i]
+		}
+	}
+	return nil
+}
+
+// the schema of a table
+type TableDef struct {
+	Name    string
+	Types   []uint32 // the column types
+	Cols    []string // the column names
+	PKeys   int      // the first PKeys columns are the primary key
+	Indexes [][]string
+	// set by CreateTable; the primary key columns are appended to each index
+	Prefix        uint32
+	IndexPrefixes []uint32
+}
+
+var (
+	ErrTableExists   = errors.New("table already exists")
+	ErrTableNotFound = errors.New("table not found")
+)
+
+// the position of a column, -1 if not found
+func (tdef *TableDef) colIndex(col string) int {
+	return slices.Index(tdef.Cols, col)
+}
+
+// the columns of an index, -1 for the primary key
+func (tdef *TableDef) indexCols(index int) []string {
+	if index < 0 {
+		return tdef.Cols[:tdef.PKeys]
+	}
+	return tdef.Indexes[index]
+}
+
+func (tdef *TableDef) indexPrefix(index int) uint32 {
+	if index < 0 {
+		return tdef.Prefix
+	}
+	return tdef.IndexPrefixes[index]
+}
+
+func (tdef *TableDef) colTypes(cols []string) []uint32 {
+	types := make([]uint32, len(cols))
+	for i, col := range cols {
+		types[i] = tdef.Types[tdef.colIndex(col)]
+	}
+	return types
+}
+
+func checkTableDef(tdef *TableDef) error {
+	switch {
+	case tdef.Name == "":
+		return errors.New("table without a name")
+	case len(tdef.Cols) == 0 || len(tdef.Types) != len(tdef.Cols):
+		return fmt.Errorf("table %s: bad columns", tdef.Name)
+	case tdef.PKeys < 1 || tdef.PKeys > len(tdef.Cols):
+		return fmt.Errorf("table %s: bad primary key", tdef.Name)
+	}
+	for i, col := range tdef.Cols {
+		if col == "" || tdef.colIndex(col) != i {
+			return fmt.Errorf("table %s: bad column name %q", tdef.Name, col)
+		}
+		if tdef.Types[i] != TYPE_BYTES && tdef.Types[i] != TYPE_INT64 {
+			return fmt.Errorf("table %s: bad type of column %s", tdef.Name, col)
+		}
+	}
+	for _, index := range tdef.Indexes {
+		for j, col := range index {
+			if tdef.colIndex(col) < 0 || slices.Index(index, col) != j {
+				return fmt.Errorf("table %s: bad index column %q", tdef.Name, col)
+			}
+		}
+	}
+	return nil
+}
+
+// the stored definition of a table, checked as it's trusted by the decoding
+func getTableDef(tree *BTree, name string) (*TableDef, error) {
+	data, ok := tree.Get([]byte(CATALOG_PREFIX + name))
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	tdef := &TableDef{}
+	if err := json.Unmarshal(data, tdef); err != nil {
+		return nil, fmt.Errorf("%w: table %s: %v", ErrCorrupt, name, err)
+	}
+	if err := checkTableDef(tdef); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if len(tdef.IndexPrefixes) != len(tdef.Indexes) {
+		return nil, fmt.Errorf("%w: table %s: bad index prefixes", ErrCorrupt, name)
+	}
+	return tdef, nil
+}
+
+// add a table to the catalog and assign its prefixes
+func tableCreate(tree *BTree, tdef *TableDef) error {
+	if err := checkTableDef(tdef); err != nil {
+		return err
+	}
+	if _, ok := tree.Get([]byte(CATALOG_PREFIX + tdef.Name)); ok {
+		return fmt.Errorf("%w: %s", ErrTableExists, tdef.Name)
+	}
+	def := *tdef
+	def.Indexes = nil
+	for _, index := range tdef.Indexes {
+		// the primary key makes the index keys unique and finds the row
+		index = slices.Clone(index)
+		for _, col := range tdef.Cols[:tdef.PKeys] {
+			if !slices.Contains(index, col) {
+				index = append(index, col)
+			}
+		}
+		def.Indexes = append(def.Indexes, index)
+	}
+
+	next := uint32(1)
+	if data, ok := tree.Get([]byte(META_PREFIX + "next_prefix")); ok {
+		next = binary.BigEndian.Uint32(data)
+	}
+	def.Prefix = next
+	def.IndexPrefixes = nil
+	for i := range def.Indexes {
+		def.IndexPrefixes = append(def.IndexPrefixes, next+1+uint32(i))
+	}
+	next += 1 + uint32(len(def.Indexes))
+	tree.Insert([]byte(META_PREFIX+"next_prefix"), binary.BigEndian.AppendUint32(nil, next))
+
+	data, err := json.Marshal(&def)
+	assert(err == nil)
+	if len(data) > BTREE_MAX_VAL_SIZE {
+		return fmt.Errorf("table %s: the definition is too large", tdef.Name)
+	}
+	tree.Insert([]byte(CATALOG_PREFIX+tdef.Name), data)
+	*tdef = def
+	return nil
+}
+
+// reorder the columns of a record to the table order; the first `n` columns
+// are required, the others are taken if present
+func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
+	vals := make([]Value, len(tdef.Cols))
+	found := 0
+	for i, col := range rec.Cols {
+		idx := tdef.colIndex(col)
+		if idx < 0 {
+			return nil, fmt.Errorf("table %s: unknown column %s", tdef.Name, col)
+		}
+		if rec.Vals[i].Type != tdef.Types[idx] {
+			return nil, fmt.Errorf("table %s: bad type of column %s", tdef.Name, col)
+		}
+		if vals[idx].Type != TYPE_NULL {
+			return nil, fmt.Errorf("table %s: duplicated column %s", tdef.Name, col)
+		}
+		vals[idx] = rec.Vals[i]
+		found++
+	}
+	for i := 0; i < n; i++ {
+		if vals[i].Type == TYPE_NULL {
+			return nil, fmt.Errorf("table %s: missing column %s", tdef.Name, tdef.Cols[i])
+		}
+	}
+	if found > n && n < len(tdef.Cols) {
+		return nil, fmt.Errorf("table %s: only the primary key is expected", tdef.Name)
+	}
+	return vals, nil
+}
+
+// the order-preserving encoding of values:
+// an int64 is 8B big-endian with the sign bit flipped, bytes are
+// terminated by 0x00 after escaping 0x00 as 0x01 0x01 and 0x01 as 0x01 0x02.
+func encodeValues(out []byte, vals []Value) []byte {
+	for _, v := range vals {
+		switch v.Type {
+		case TYPE_INT64:
+			out = binary.BigEndian.AppendUint64(out, uint64(v.I64)^(1<<63))
+		case TYPE_BYTES:
+			for _, b := range v.Str {
+				switch b {
+				case 0, 1:
+					out = append(out, 1, b+1)
+				default:
+					out = append(out, b)
+				}
+			}
+			out = append(out, 0)
+		default:
+			corrupt("bad value type %d", v.Type) // of a stored table
+		}
+	}
+	return out
+}
+
+// decode values of known types, returns the rest of the input
+func decodeValues(in []byte, types []uint32) ([]Value, []byte, error) {
+	vals := make([]Value, len(types))
+	for i, t := range types {
+		vals[i].Type = t
+		switch t {
+		case TYPE_INT64:
+			if len(in) < 8 {
+				return nil, nil, errors.New("truncated int64")
+			}
+			vals[i].I64 = int64(binary.BigEndian.Uint64(in) ^ (1 << 63))
+			in = in[8:]
+		case TYPE_BYTES:
+			end := bytes.IndexByte(in, 0)
+			if end < 0 {
+				return nil, nil, errors.New("unterminated bytes")
+			}
+			str := make([]byte, 0, end)
+			for j := 0; j < end; j++ {
+				if in[j] == 1 {
+					j++
+					if j == end || in[j] > 2 {
+						return nil, nil, errors.New("bad escape")
+					}
+					str = append(str, in[j]-1)
+				} else {
+					str = append(str, in[j])
+				}
+			}
+			vals[i].Str = str
+			in = in[end+1:]
+		default:
+			return nil, nil, fmt.Errorf("bad value type %d", t)
+		}
+	}
+	return vals, in, nil
+}
+
+// the key of a row or of an index entry, with the first values of the index
+func encodeKey(prefix uint32, vals []Value) []byte {
+	out := append([]byte(TABLE_PREFIX), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(out[len(TABLE_PREFIX):], prefix)
+	return encodeValues(out, vals)
+}
+
+// the values of a key of the prefix, false if the key has another prefix.
+// a key that fails to decode is a corruption.
+func decodeKey(prefix uint32, key []byte, types []uint32) ([]Value, bool) {
+	head := encodeKey(prefix, nil)
+	if !bytes.HasPrefix(key, head) {
+		return nil, false
+	}
+	vals, rest, err := decodeValues(key[len(head):], types)
+	if err == nil && len(rest) != 0 {
+		err = errors.New("trailing bytes")
+	}
+	if err != nil {
+		corrupt("table key %q: %v", key, err)
+	}
+	return vals, true
+}
+
+// the row from the KV of the primary key, a corruption if it fails to decode
+func decodeRow(tdef *TableDef, key []byte, val []byte) Record {
+	pkey, ok := decodeKey(tdef.Prefix, key, tdef.Types[:tdef.PKeys])
+	if !ok {
+		corrupt("table %s: key %q of another table", tdef.Name, key)
+	}
+	rest, tail, err := decodeValues(val, tdef.Types[tdef.PKeys:])
+	if err == nil && len(tail) != 0 {
+		err = errors.New("trailing bytes")
+	}
+	if err != nil {
+		corrupt("row of table %s: %v", tdef.Name, err)
+	}
+	return Record{Cols: slices.Clone(tdef.Cols), Vals: append(pkey, rest...)}
+}
+
+// the key of the index entry of a row
+func indexKey(tdef *TableDef, index int, vals []Value) []byte {
+	ivals := make([]Value, 0, len(tdef.Indexes[index]))
+	for _, col := range tdef.Indexes[index] {
+		ivals = append(ivals, vals[tdef.colIndex(col)])
+	}
+	return encodeKey(tdef.IndexPrefixes[index], ivals)
+}
+
+// get a row by its primary key, the other columns are added to the record
+func tableGet(tree *BTree, tdef *TableDef, rec *Record) (bool, error) {
+	vals, err := checkRecord(tdef, *rec, tdef.PKeys)
+	if err != nil {
+		return false, err
+	}
+	key := encodeKey(tdef.Prefix, vals[:tdef.PKeys])
+	val, ok := tree.Get(key)
+	if !ok {
+		return false, nil
+	}
+	*rec = decodeRow(tdef, key, val)
+	return true, nil
+}
+
+// insert or update a row according to the mode, and maintain the indexes
+func tableSet(tree *BTree, tdef *TableDef, rec Record, mode int) (added bool, err error) {
+	defer catchCorrupt(&err)
+	vals, err := checkRecord(tdef, rec, len(tdef.Cols))
+	if err != nil {
+		return false, err
+	}
+	key := encodeKey(tdef.Prefix, vals[:tdef.PKeys])
+	val := encodeValues(nil, vals[tdef.PKeys:])
+	if len(key) > BTREE_MAX_KEY_SIZE || len(val) > BTREE_MAX_VAL_SIZE {
+		return false, fmt.Errorf("table %s: the row is too large", tdef.Name)
+	}
+	for i := range tdef.Indexes {
+		if len(indexKey(tdef, i, vals)) > BTREE_MAX_KEY_SIZE {
+			return false, fmt.Errorf("table %s: the index key is too large", tdef.Name)
+		}
+	}
+
+	req := &UpdateReq{Key: key, Val: val, Mode: mode}
+	if err := tree.Update(req); err != nil {
+		return false, err
+	}
+	if !req.Added {
+		old := decodeRow(tdef, key, req.Old)
+		for i := range tdef.Indexes {
+			tree.Delete(indexKey(tdef, i, old.Vals))
+		}
+	}
+	for i := range tdef.Indexes {
+		tree.Insert(indexKey(tdef, i, vals), nil)
+	}
+	return req.Added, nil
+}
+
+// delete a row by its primary key, and its index entries
+func tableDelete(tree *BTree, tdef *TableDef, rec Record) (deleted bool, err error) {
+	defer catchCorrupt(&err)
+	vals, err := checkRecord(tdef, rec, tdef.PKeys)
+	if err != nil {
+		return false, err
+	}
+	key := encodeKey(tdef.Prefix, vals[:tdef.PKeys])
+	val, ok := tree.Get(key)
+	if !ok {
+		return false, nil
+	}
+	old := decodeRow(tdef, key, val)
+	tree.Delete(key)
+	for i := range tdef.Indexes {
+		tree.Delete(indexKey(tdef, i, old.Vals))
+	}
+	return true, nil
+}
+
+// create a table, the prefixes and the index columns are set in `tdef`
+func (tx *Tx) CreateTable(tdef *TableDef) error {
+	return tableCreate(&tx.tree, tdef)
+}
+
+// get a row by the primary key columns of the record
+func (tx *Tx) GetRecord(table string, rec *Record) (ok bool, err error) {
+	defer catchCorrupt(&err)
+	tdef, err := getTableDef(&tx.tree, table)
+	if err != nil {
+		return false, err
+	}
+	return tableGet(&tx.tree, tdef, rec)
+}
+
+// insert or update a row according to the mode; returns whether it was added
+func (tx *Tx) SetRecord(table string, rec Record, mode int) (bool, error) {
+	tdef, err := getTableDef(&tx.tree, table)
+	if err != nil {
+		return false, err
+	}
+	return tableSet(&tx.tree, tdef, rec, mode)
+}
+
+// delete a row by the primary key columns of the record
+func (tx *Tx) DeleteRecord(table string, rec Record) (bool, error) {
+	tdef, err := getTableDef(&tx.tree, table)
+	if err != nil {
+		return false, err
+	}
+	return tableDelete(&tx.tree, tdef, rec)
+}
+
+// get a row of the last commit
+func (db *DB) GetRecord(table string, rec *Record) (ok bool, err error) {
+	defer catchCorrupt(&err)
+	tree := db.pin()
+	defer db.unpin(tree.store)
+	tdef, err := getTableDef(&tree, table)
+	if err != nil {
+		return false, err
+	}
+	return tableGet(&tree, tdef, rec)
+}
@@ -0,0 +1,219 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"db.com/m/internal/kvtest"
+)
+
+func TestEncodeValuesOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func() []Value {
+		str := make([]byte, r.Intn(4))
+		for i := range str {
+			str[i] = []byte{0, 1, 2, 'a', 0xff}[r.Intn(5)]
+		}
+		return []Value{
+			{Type: TYPE_BYTES, Str: str},
+			{Type: TYPE_INT64, I64: []int64{-1 << 63, -2, 0, 1, 1<<63 - 1}[r.Intn(5)]},
+		}
+	}
+	types := []uint32{TYPE_BYTES, TYPE_INT64}
+	for i := 0; i < 10000; i++ {
+		a, b := random(), random()
+		ka, kb := encodeValues(nil, a), encodeValues(nil, b)
+		expect := cmpValue(a[0], b[0])
+		if expect == 0 {
+			expect = cmpValue(a[1], b[1])
+		}
+		if got := bytes.Compare(ka, kb); got != expect {
+			t.Fatalf("%v %v: compare %d, expect %d", a, b, got, expect)
+		}
+		back, rest, err := decodeValues(ka, types)
+		if err != nil || len(rest) != 0 || fmt.Sprint(back) != fmt.Sprint(a) {
+			t.Fatalf("decode %v: %v, %q, %v", a, back, rest, err)
+		}
+	}
+}
+
+// a table of people with an index on the city
+func createPeople(t *testing.T, db *DB) {
+	t.Helper()
+	var tx Tx
+	db.Begin(&tx)
+	err := tx.CreateTable(&TableDef{
+		Name:    "people",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES, TYPE_INT64},
+		Cols:    []string{"id", "name", "city", "age"},
+		PKeys:   1,
+		Indexes: [][]string{{"city", "age"}, {"name"}},
+	})
+	if err != nil {
+		db.Abort(&tx)
+		t.Fatal(err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func person(id int64, name string, city string, age int64) Record {
+	rec := Record{}
+	rec.AddInt64("id", id).AddStr("name", []byte(name)).AddStr("city", []byte(city)).AddInt64("age", age)
+	return rec
+}
+
+// the entries of an index in order, as the primary keys
+func indexIDs(t *testing.T, db *DB, index int) []int64 {
+	tree := db.pin()
+	tdef, err := getTableDef(&tree, "people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	prefix := encodeKey(tdef.IndexPrefixes[index], nil)
+	types := tdef.colTypes(tdef.Indexes[index])
+	for it := tree.Seek(prefix); it.Valid(); it.Next() {
+		key, _ := it.Deref()
+		vals, ok := decodeKey(tdef.IndexPrefixes[index], key, types)
+		if !ok {
+			break
+		}
+		ids = append(ids, vals[len(vals)-1].I64)
+	}
+	return ids
+}
+
+func TestTable(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	createPeople(t, db)
+
+	var tx Tx
+	db.Begin(&tx)
+	if err := tx.CreateTable(&TableDef{Name: "people", Types: []uint32{TYPE_INT64}, Cols: []string{"id"}, PKeys: 1}); err == nil {
+		t.Fatal("created twice")
+	}
+	for _, rec := range []Record{
+		person(1, "ann", "paris", 30),
+		person(2, "bob", "oslo", 25),
+		person(3, "cat", "paris", 41),
+	} {
+		if added, err := tx.SetRecord("people", rec, MODE_INSERT_ONLY); err != nil || !added {
+			t.Fatal(added, err)
+		}
+	}
+	if _, err := tx.SetRecord("people", person(1, "dup", "rome", 1), MODE_INSERT_ONLY); err != ErrKeyExists {
+		t.Fatal(err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	if got := indexIDs(t, db, 0); !slices.Equal(got, []int64{2, 1, 3}) {
+		t.Fatalf("city index: %v", got)
+	}
+
+	// an update moves the index entries
+	db.Begin(&tx)
+	if added, err := tx.SetRecord("people", person(2, "bob", "rome", 26), MODE_UPSERT); err != nil || added {
+		t.Fatal(added, err)
+	}
+	if deleted, err := tx.DeleteRecord("people", *(&Record{}).AddInt64("id", 1)); err != nil || !deleted {
+		t.Fatal(deleted, err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	if got := indexIDs(t, db, 0); !slices.Equal(got, []int64{3, 2}) {
+		t.Fatalf("city index: %v", got)
+	}
+	if got := indexIDs(t, db, 1); !slices.Equal(got, []int64{2, 3}) {
+		t.Fatalf("name index: %v", got)
+	}
+
+	rec := (&Record{}).AddInt64("id", 2)
+	if ok, err := db.GetRecord("people", rec); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if fmt.Sprint(rec.Vals) != fmt.Sprint(person(2, "bob", "rome", 26).Vals) {
+		t.Fatalf("got %v", rec)
+	}
+	// the tables are hidden from the KV API
+	if kvs := kvtest.Dump(db.Seek(nil)); len(kvs) != 0 {
+		t.Fatalf("visible KVs: %v", kvs)
+	}
+
+	bad := []Record{
+		*(&Record{}).AddInt64("id", 9),
+		*(&Record{}).AddStr("id", []byte("x")).AddStr("name", nil).AddStr("city", nil).AddInt64("age", 1),
+		*(&Record{}).AddInt64("id", 9).AddStr("name", nil).AddStr("city", nil).AddInt64("nope", 1),
+	}
+	db.Begin(&tx)
+	defer db.Abort(&tx)
+	for _, rec := range bad {
+		if _, err := tx.SetRecord("people", rec, MODE_UPSERT); err == nil {
+			t.Fatalf("bad record accepted: %v", rec)
+		}
+	}
+	if _, err := tx.SetRecord("nope", person(9, "", "", 0), MODE_UPSERT); err == nil {
+		t.Fatal("unknown table")
+	}
+}
+
+// a damaged row or index entry fails the query, not the process
+func TestCorruptTable(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	createPeople(t, db)
+	var tx Tx
+	db.Begin(&tx)
+	for _, rec := range []Record{person(1, "ann", "paris", 30), person(2, "bob", "oslo", 25)} {
+		if _, err := tx.SetRecord("people", rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tdef, err := getTableDef(&tx.tree, "people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a name with a bad escape
+	tx.tree.Insert(encodeKey(tdef.Prefix, []Value{{Type: TYPE_INT64, I64: 1}}), []byte("\x01\x09"))
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetRecord("people", (&Record{}).AddInt64("id", 1)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("GetRecord: %v", err)
+	}
+	if _, err := db.Query(&Query{Table: "people"}); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Query: %v", err)
+	}
+	if ok, err := db.GetRecord("people", (&Record{}).AddInt64("id", 2)); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+
+	// an index entry without its row
+	db.Begin(&tx)
+	tx.tree.Delete(encodeKey(tdef.Prefix, []Value{{Type: TYPE_INT64, I64: 2}}))
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	q := &Query{Table: "people", Where: []Cond{strCond("city", OP_EQ, "oslo")}}
+	if _, err := db.Query(q); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Query: %v", err)
+	}
+
+	db.Begin(&tx)
+	if _, err := tx.SetRecord("people", person(1, "ann", "rome", 31), MODE_UPSERT); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("SetRecord: %v", err)
+	}
+	db.Abort(&tx)
+	db.Begin(&tx)
+	if _, err := tx.DeleteRecord("people", *(&Record{}).AddInt64("id", 1)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+	db.Abort(&tx)
+}
@@ -0,0 +1,166 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// every value of the database is stored in an envelope:
+// | flags | expire | val |
+// |  1B   |   8B   | ... |
+// the expire time in unix nanoseconds is only there with VAL_TTL,
+// and the value is compressed with VAL_FLATE (see compress.go).
+const (
+	VAL_PLAIN = 0
+	VAL_TTL   = 1 << 0
+	VAL_FLATE = 1 << 1
+)
+
+// the largest envelope header
+const VAL_HEADER_MAX = 1 + 8
+
+// the keys starting with 0 are internal, user keys can't start with it.
+// the expiry index maps `EXPIRY_PREFIX | expire | key` to nothing,
+// the big-endian expire time sorts the index by time.
+const EXPIRY_PREFIX = "\x00x"
+
+// the number of index entries processed by each sweeping commit
+const SWEEP_BATCH = 256
+
+func encodeVal(val []byte, expire int64, flags byte) []byte {
+	if expire == 0 {
+		return append([]byte{flags}, val...)
+	}
+	out := make([]byte, 9, 9+len(val))
+	out[0] = flags | VAL_TTL
+	binary.LittleEndian.PutUint64(out[1:], uint64(expire))
+	return append(out, val...)
+}
+
+// returns the value and the expire time, 0 for never
+func decodeVal(raw []byte) (val []byte, expire int64, err error) {
+	defer catchCorrupt(&err)
+	expire = valExpire(raw)
+	val = raw[1:]
+	if expire != 0 {
+		val = raw[9:]
+	}
+	if raw[0]&VAL_FLATE != 0 {
+		if val, err = inflate(val); err != nil {
+			return nil, expire, err
+		}
+	}
+	return val, expire, nil
+}
+
+// the expire time of an envelope without decoding the value,
+// a bad envelope is a corruption
+func valExpire(raw []byte) int64 {
+	if len(raw) == 0 {
+		corrupt("empty value envelope")
+	}
+	if raw[0]&^(VAL_TTL|VAL_FLATE) != 0 {
+		corrupt("bad value envelope flags %#x", raw[0])
+	}
+	if raw[0]&VAL_TTL == 0 {
+		return 0
+	}
+	if len(raw) < 9 {
+		corrupt("value envelope of %d bytes with an expire time", len(raw))
+	}
+	return int64(binary.LittleEndian.Uint64(raw[1:]))
+}
+
+func expiryKey(expire int64, key []byte) []byte {
+	out := make([]byte, len(EXPIRY_PREFIX)+8, len(EXPIRY_PREFIX)+8+len(key))
+	copy(out, EXPIRY_PREFIX)
+	binary.BigEndian.PutUint64(out[len(EXPIRY_PREFIX):], uint64(expire))
+	return append(out, key...)
+}
+
+func parseExpiryKey(ikey []byte) (int64, []byte) {
+	ikey = ikey[len(EXPIRY_PREFIX):]
+	return int64(binary.BigEndian.Uint64(ikey)), ikey[8:]
+}
+
+// look up a key that isn't expired at `now`; also returns the expire time
+// of the stored value, which may be expired but not yet swept
+func lookupLive(tree *BTree, key []byte, now int64) (val []byte, live bool, expire int64, err error) {
+	raw, ok := tree.Get(key)
+	if !ok {
+		return nil, false, 0, nil
+	}
+	val, expire, err = decodeVal(raw)
+	return val, expire == 0 || expire > now, expire, err
+}
+
+// delete all expired keys, a batch per commit; returns the number of keys
+func (db *DB) Sweep() (int, error) {
+	total := 0
+	for {
+		count, more, err := db.sweepBatch(SWEEP_BATCH)
+		total += count
+		if err != nil || !more {
+			return total, err
+		}
+	}
+}
+
+// delete the keys of the first `limit` expired index entries;
+// also returns whether there may be more of them
+func (db *DB) sweepBatch(limit int) (int, bool, error) {
+	count, more := 0, false
+	err := db.transact(func(tx *Tx) error {
+		// scan the index up to the current time
+		now := db.now().UnixNano()
+		end := expiryKey(now+1, nil)
+		ops := []Op{}
+		count, more = 0, false
+		for iter := tx.tree.Seek([]byte(EXPIRY_PREFIX)); iter.Valid(); iter.Next() {
+			ikey, _ := iter.Deref()
+			if bytes.Compare(ikey, end) >= 0 {
+				break
+			}
+			if len(ops)-count == limit {
+				more = true
+				break
+			}
+			ops = append(ops, Op{Key: bytes.Clone(ikey), Del: true})
+
+			// the key may have been updated or deleted since the entry was added
+			expire, key := parseExpiryKey(ikey)
+			// a corrupt value is swept too, with no old value in the event
+			if val, _, cur, _ := lookupLive(&tx.tree, key, now); cur == expire {
+				ops = append(ops, Op{Key: bytes.Clone(key), Del: true})
+				count++
+				if db.watched(key) {
+					tx.events = append(tx.events, newEvent(EVENT_DELETE, key, val, nil))
+				}
+			}
+		}
+		// the raw ops also remove the index entries
+		tx.tree.ApplyBatch(ops)
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return count, more, nil
+}
+
+// sweep periodically until stopped
+func (db *DB) sweeper(every time.Duration, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		// errors are retried on the next tick
+		_, _ = db.Sweep()
+	}
+}
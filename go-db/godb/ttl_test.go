@@ -0,0 +1,224 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"db.com/m/internal/kvtest"
+)
+
+// a database with a clock that only moves when told
+func openClockKV(t *testing.T, path string) (*DB, *time.Time) {
+	db := openTestKV(t, path, nil)
+	clock := time.Unix(1000, 0)
+	db.now = func() time.Time { return clock }
+	return db, &clock
+}
+
+// the number of entries in the expiry index
+func countExpiry(db *DB) int {
+	n := 0
+	for iter := db.tree.Seek([]byte(EXPIRY_PREFIX)); iter.Valid(); iter.Next() {
+		if key, _ := iter.Deref(); !bytes.HasPrefix(key, []byte(EXPIRY_PREFIX)) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+func TestTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, clock := openClockKV(t, path)
+	set := func(key string, val string, ttl time.Duration, mode int) error {
+		return db.Update(&UpdateReq{Key: []byte(key), Val: []byte(val), TTL: ttl, Mode: mode})
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := set(key, "v"+key, 0, MODE_UPSERT); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := set("b", "vb", time.Second, MODE_UPSERT); err != nil {
+		t.Fatal(err)
+	}
+	if err := set("c", "vc", 2*time.Second, MODE_UPSERT); err != nil {
+		t.Fatal(err)
+	}
+	if err := set("x", "", time.Second, MODE_UPSERT); err != nil {
+		t.Fatal(err)
+	}
+	if err := set("\x00x", "", 0, MODE_UPSERT); err != errReservedKey {
+		t.Fatalf("reserved key: %v", err)
+	}
+
+	*clock = clock.Add(time.Second)
+	if _, ok, _ := db.Get([]byte("b")); ok {
+		t.Fatal("expired key is visible")
+	}
+	if val, ok, _ := db.Get([]byte("c")); !ok || string(val) != "vc" {
+		t.Fatal("live key is hidden")
+	}
+	if got := fmt.Sprint(kvtest.Dump(db.Seek(nil))); got != "[[a va] [c vc] [d vd]]" {
+		t.Fatalf("iterator: %s", got)
+	}
+
+	// an expired key is missing for the update modes
+	if err := set("b", "new", 0, MODE_UPDATE_ONLY); err != ErrKeyNotFound {
+		t.Fatalf("update-only on an expired key: %v", err)
+	}
+	req := &UpdateReq{Key: []byte("x"), Val: []byte("new"), Mode: MODE_INSERT_ONLY}
+	if err := db.Update(req); err != nil || !req.Added || req.Old != nil {
+		t.Fatalf("insert-only on an expired key: %v", err)
+	}
+	if ok, err := db.Del([]byte("b")); ok || err != nil {
+		t.Fatalf("delete an expired key: %v, %v", ok, err)
+	}
+	// dropping the TTL of a key
+	if err := set("c", "vc2", 0, MODE_UPSERT); err != nil {
+		t.Fatal(err)
+	}
+
+	// persisted
+	db.Close()
+	db, clock = openClockKV(t, path)
+	*clock = clock.Add(time.Hour)
+	if got := fmt.Sprint(kvtest.Dump(db.Seek(nil))); got != "[[a va] [c vc2] [d vd] [x new]]" {
+		t.Fatalf("reopened: %s", got)
+	}
+	if countExpiry(db) != 0 {
+		t.Fatal("stale index entries")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	db, clock := openClockKV(t, filepath.Join(t.TempDir(), "test.db"))
+	w := db.Watch([]byte("t"))
+	defer w.Close()
+
+	n := 3*SWEEP_BATCH + 10
+	for i := 0; i < n; i++ {
+		req := &UpdateReq{Key: []byte(fmt.Sprintf("t%05d", i)), Val: []byte("v"), TTL: time.Duration(1+i%3) * time.Second}
+		if err := db.Update(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// overwritten without a TTL, the index entry is stale
+	if err := db.Set([]byte("t00000"), []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	drainEvents(w)
+
+	if count, err := db.Sweep(); count != 0 || err != nil {
+		t.Fatalf("nothing expired yet: %d, %v", count, err)
+	}
+	*clock = clock.Add(2 * time.Second)
+	count, err := db.Sweep()
+	expect := 0 // TTLs of 1s and 2s, except t00000
+	for i := 1; i < n; i++ {
+		if i%3 < 2 {
+			expect++
+		}
+	}
+	if err != nil || count != expect {
+		t.Fatalf("swept %d keys, expect %d: %v", count, expect, err)
+	}
+	if events := drainEvents(w); len(events) != count || events[0] != `delete t00003 "v" ""` {
+		t.Fatalf("%d events: %v", len(events), events[:1])
+	}
+	if countExpiry(db) != n-expect-1 {
+		t.Fatalf("%d index entries left", countExpiry(db))
+	}
+	if val, ok, _ := db.Get([]byte("t00000")); !ok || string(val) != "kept" {
+		t.Fatal("a key without a TTL was swept")
+	}
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	*clock = clock.Add(time.Hour)
+	if count, err := db.Sweep(); count != n-expect-1 || err != nil {
+		t.Fatalf("swept %d keys: %v", count, err)
+	}
+	if countExpiry(db) != 0 || len(kvtest.Dump(db.Seek(nil))) != 1 {
+		t.Fatal("not everything was swept")
+	}
+}
+
+func TestBackgroundSweeper(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), &Options{SweepEvery: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		req := &UpdateReq{Key: []byte(fmt.Sprint(i)), Val: []byte("v"), TTL: time.Millisecond}
+		if err := db.Update(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.mu.Lock()
+		left := countExpiry(db)
+		db.mu.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d index entries left", left)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats := db.Stats(); stats.Keys != 0 {
+		t.Fatalf("%d keys left", stats.Keys)
+	}
+}
+
+// a bad envelope on the disk is an error, not a crash
+func TestCorruptEnvelope(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, nil)
+	for _, key := range []string{"a", "bad-flags", "bad-ttl", "z"} {
+		if err := db.Set([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// the envelope follows the key in the leaves
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, flags := range map[string]byte{"bad-flags": 0x80, "bad-ttl": VAL_TTL} {
+		kv := []byte(key + "\x00v")
+		for i := bytes.Index(data, kv); i >= 0; i = bytes.Index(data, kv) {
+			data[i+len(key)] = flags
+		}
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestKV(t, path, nil)
+	if val, ok, err := db.Get([]byte("a")); err != nil || !ok || string(val) != "v" {
+		t.Fatalf("Get(a) = %q, %v, %v", val, ok, err)
+	}
+	for _, key := range []string{"bad-flags", "bad-ttl"} {
+		if _, _, err := db.Get([]byte(key)); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+	}
+	iter := db.Seek(nil)
+	if got := fmt.Sprint(kvtest.Dump(iter)); got != "[[a v]]" {
+		t.Fatalf("iterated %s", got)
+	}
+	if !errors.Is(iter.Err(), ErrCorrupt) {
+		t.Fatalf("iterator: %v", iter.Err())
+	}
+}
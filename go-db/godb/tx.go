@@ -0,0 +1,190 @@
+package godb
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// a read-write transaction over a snapshot of the last commit. transactions
+// run concurrently: the updates go to private pages and only reach the
+// database on Commit, which fails with ErrConflict if a transaction committed
+// in between updated a key this one read; the caller can then retry it.
+// a transaction must end with Commit or Abort.
+type Tx struct {
+	db      *DB
+	tree    BTree // the snapshot with the updates of the transaction
+	log     txLog
+	version uint64  // the number of commits in the snapshot
+	events  []Event // delivered to the watchers on Commit
+}
+
+// begin a transaction
+func (db *DB) Begin(tx *Tx) {
+	db.txs.Lock()
+	defer db.txs.Unlock()
+	*tx = Tx{db: db, version: db.txs.version}
+	tx.tree = db.txTree(tx)
+	if db.txs.ongoing == nil {
+		db.txs.ongoing = map[uint64]int{}
+	}
+	db.txs.ongoing[tx.version]++
+}
+
+// end a transaction: check for conflicts and commit the updates
+func (db *DB) Commit(tx *Tx) error {
+	defer db.txEnd(tx)
+	if len(tx.log.ops) == 0 {
+		return nil // nothing to commit, the reads were of a consistent snapshot
+	}
+	start := time.Now()
+	defer func() { db.metrics.commit.Observe(time.Since(start).Seconds()) }()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.replica {
+		return ErrReadOnly
+	}
+	if db.conflicted(tx) {
+		return ErrConflict
+	}
+	root := db.tree.root
+	tx.log.replay(&db.tree)
+	db.seq++
+	if err := updateOrRevert(db, root); err != nil {
+		db.seq--
+		return err
+	}
+	db.replAppend(tx.log.ops)
+	// a transaction that begins in between sees the commit in its snapshot
+	// but may still be checked against it, which is only conservative
+	db.txs.Lock()
+	db.txs.version++
+	db.txs.history = append(db.txs.history, txCommit{version: db.txs.version, writes: tx.log.writes})
+	db.txs.Unlock()
+	db.notify(tx.events)
+	return nil
+}
+
+// end a transaction: discard the updates
+func (db *DB) Abort(tx *Tx) {
+	db.txEnd(tx)
+}
+
+// read the transaction, including its own updates; the error is a corruption
+func (tx *Tx) Get(key []byte) (val []byte, ok bool, err error) {
+	defer catchCorrupt(&err)
+	if len(key) == 0 || key[0] == 0 {
+		return nil, false, nil
+	}
+	val, ok, _, err = lookupLive(&tx.tree, key, tx.db.now().UnixNano())
+	return val, ok, err
+}
+
+// an iterator over the transaction, it's invalidated by the next update
+func (tx *Tx) Seek(key []byte) *Iter {
+	return seekLive(&tx.tree, key, tx.db.now().UnixNano())
+}
+
+func (tx *Tx) Set(key []byte, val []byte) error {
+	return tx.Update(&UpdateReq{Key: key, Val: val})
+}
+
+// insert or update a key according to the mode of the request;
+// nothing is changed if the mode doesn't allow it
+func (tx *Tx) Update(req *UpdateReq) error {
+	if err := checkKV(req.Key, req.Val); err != nil {
+		return err
+	}
+	if req.TTL < 0 {
+		return fmt.Errorf("negative TTL %v", req.TTL)
+	}
+	if req.TTL > 0 && len(expiryKey(0, req.Key)) > BTREE_MAX_KEY_SIZE {
+		return fmt.Errorf("key of %d bytes is too large for a TTL", len(req.Key))
+	}
+	db := tx.db
+
+	// the mode is checked here since an expired key counts as missing
+	now := db.now()
+	old, live, oldExpire, err := lookupLive(&tx.tree, req.Key, now.UnixNano())
+	if err != nil {
+		return err
+	}
+	req.Added, req.Old = !live, nil
+	if live {
+		req.Old = bytes.Clone(old)
+	}
+	if err := checkMode(req, live); err != nil {
+		return err
+	}
+
+	expire := int64(0)
+	if req.TTL > 0 {
+		expire = now.Add(req.TTL).UnixNano()
+	}
+	val, flags := db.compress(req.Val)
+	tx.tree.Insert(req.Key, encodeVal(val, expire, flags))
+	if oldExpire != 0 {
+		tx.tree.Delete(expiryKey(oldExpire, req.Key))
+	}
+	if expire != 0 {
+		tx.tree.Insert(expiryKey(expire, req.Key), nil)
+	}
+	if db.watched(req.Key) {
+		etype := EVENT_UPDATE
+		if req.Added {
+			etype = EVENT_INSERT
+		}
+		tx.events = append(tx.events, newEvent(etype, req.Key, req.Old, req.Val))
+	}
+	return nil
+}
+
+// delete a key and returns whether the key was there
+func (tx *Tx) Del(key []byte) (bool, error) {
+	if err := checkKV(key, nil); err != nil {
+		return false, err
+	}
+	db := tx.db
+
+	// an expired key is deleted too, but it wasn't there for the caller
+	old, live, expire, err := lookupLive(&tx.tree, key, db.now().UnixNano())
+	if err != nil {
+		return false, err
+	}
+	if live && db.watched(key) {
+		tx.events = append(tx.events, newEvent(EVENT_DELETE, key, old, nil))
+	}
+	if !tx.tree.Delete(key) {
+		return false, nil
+	}
+	if expire != 0 {
+		tx.tree.Delete(expiryKey(expire, key))
+	}
+	return live, nil
+}
+
+// delete all keys in [start, end), a nil end means to the last key.
+// the entries of the expiry index are left to the sweeper.
+func (tx *Tx) DeleteRange(start []byte, end []byte) int {
+	start, end = userRange(&tx.tree, start, end)
+	tx.events = append(tx.events, rangeEvents(tx.db, &tx.tree, start, end)...)
+	return tx.tree.DeleteRange(start, end)
+}
+
+// apply the mutations with a single pass over the tree
+func (tx *Tx) ApplyBatch(ops []Op) error {
+	for _, op := range ops {
+		if err := checkKV(op.Key, op.Val); err != nil {
+			return err
+		}
+	}
+	db := tx.db
+	tx.events = append(tx.events, batchEvents(db, &tx.tree, ops)...)
+	wrapped := make([]Op, len(ops))
+	for i, op := range ops {
+		val, flags := db.compress(op.Val)
+		wrapped[i] = Op{Key: op.Key, Val: encodeVal(val, 0, flags), Del: op.Del}
+	}
+	tx.tree.ApplyBatch(wrapped)
+	return nil
+}
@@ -0,0 +1,75 @@
+package godb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"db.com/m/internal/kvtest"
+)
+
+func TestKVTX(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, nil)
+	ref := kvtest.Fill(t, db, 1000)
+	w := db.Watch(nil)
+	defer w.Close()
+
+	// aborted
+	var tx Tx
+	db.Begin(&tx)
+	for i := 0; i < 1000; i++ {
+		if _, err := tx.Del([]byte(fmt.Sprintf("key%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Set([]byte("new"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, _ := tx.Get([]byte("new")); !ok || string(val) != "1" {
+		t.Fatal("the transaction doesn't see its own update")
+	}
+	db.Abort(&tx)
+	if got := kvtest.Dump(db.Seek(nil)); fmt.Sprint(got) != fmt.Sprint(kvtest.Sorted(ref)) {
+		t.Fatal("aborted updates are visible")
+	}
+	if events := drainEvents(w); len(events) != 0 {
+		t.Fatalf("events of an aborted transaction: %v", events)
+	}
+
+	// committed
+	db.Begin(&tx)
+	if err := tx.Set([]byte("new"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	req := &UpdateReq{Key: []byte("new"), Val: []byte("2"), Mode: MODE_INSERT_ONLY}
+	if err := tx.Update(req); err != ErrKeyExists {
+		t.Fatalf("insert-only in a transaction: %v", err)
+	}
+	if _, err := tx.Del([]byte("key000001")); err != nil {
+		t.Fatal(err)
+	}
+	if iter := tx.Seek([]byte("n")); !iter.Valid() {
+		t.Fatal("the iterator doesn't see the update")
+	} else if key, _ := iter.Deref(); string(key) != "new" {
+		t.Fatalf("the iterator is at %q", key)
+	}
+	// readers see the last commit until Commit
+	if _, ok, _ := db.Get([]byte("new")); ok {
+		t.Fatal("readers see an uncommitted update")
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	ref["new"] = "1"
+	delete(ref, "key000001")
+	if events := drainEvents(w); fmt.Sprint(events) != `[insert new "" "1" delete key000001 "val143" ""]` {
+		t.Fatalf("events: %v", events)
+	}
+
+	db.Close()
+	db = openTestKV(t, path, nil)
+	if got := kvtest.Dump(db.Seek(nil)); fmt.Sprint(got) != fmt.Sprint(kvtest.Sorted(ref)) {
+		t.Fatal("reopened keys don't match")
+	}
+}
@@ -0,0 +1,100 @@
+package godb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestInsertReturnsOld(t *testing.T) {
+	c := newC()
+	if added, old := c.tree.Insert([]byte("k"), []byte("v1")); !added || old != nil {
+		t.Fatalf("first insert: %v, %q", added, old)
+	}
+	for i := 0; i < 500; i++ {
+		c.add(string(rune('a'+i%26))+string(rune(i)), "x") // grow the tree
+	}
+	if added, old := c.tree.Insert([]byte("k"), []byte("v2")); added || string(old) != "v1" {
+		t.Fatalf("replace: %v, %q", added, old)
+	}
+	if added, _ := c.tree.Insert([]byte("new"), nil); !added {
+		t.Fatal("new key not added")
+	}
+}
+
+func TestUpdateModes(t *testing.T) {
+	c := newC()
+	update := func(mode int, key string, val string, expect string) (*UpdateReq, error) {
+		req := &UpdateReq{Key: []byte(key), Val: []byte(val), Mode: mode, Expect: []byte(expect)}
+		return req, c.tree.Update(req)
+	}
+
+	// on an empty tree
+	if _, err := update(MODE_UPDATE_ONLY, "a", "1", ""); err != ErrKeyNotFound {
+		t.Fatalf("update-only on an empty tree: %v", err)
+	}
+	if _, err := update(MODE_CAS, "a", "1", ""); err != ErrKeyNotFound {
+		t.Fatalf("CAS on an empty tree: %v", err)
+	}
+	if c.tree.root != 0 {
+		t.Fatal("failed updates created a root")
+	}
+
+	if req, err := update(MODE_INSERT_ONLY, "a", "1", ""); err != nil || !req.Added {
+		t.Fatalf("insert-only: %v", err)
+	}
+	c.ref["a"] = "1"
+	for i := 0; i < 1000; i++ {
+		c.add(string(rune(0x100+i)), "filler")
+	}
+	pages := len(c.pages)
+
+	req, err := update(MODE_INSERT_ONLY, "a", "2", "")
+	if err != ErrKeyExists || string(req.Old) != "1" {
+		t.Fatalf("insert-only on an existing key: %v, %q", err, req.Old)
+	}
+	if _, err := update(MODE_UPDATE_ONLY, "b", "2", ""); err != ErrKeyNotFound {
+		t.Fatalf("update-only on a missing key: %v", err)
+	}
+	req, err = update(MODE_CAS, "a", "2", "wrong")
+	if err != ErrValueMismatch || string(req.Old) != "1" {
+		t.Fatalf("CAS mismatch: %v, %q", err, req.Old)
+	}
+	if err := c.check(); err != nil || len(c.pages) != pages {
+		t.Fatalf("failed updates changed the tree: %v", err)
+	}
+
+	req, err = update(MODE_CAS, "a", "2", "1")
+	if err != nil || req.Added || string(req.Old) != "1" {
+		t.Fatalf("CAS: %v, %v, %q", err, req.Added, req.Old)
+	}
+	req, err = update(MODE_UPDATE_ONLY, "a", "3", "")
+	if err != nil || string(req.Old) != "2" {
+		t.Fatalf("update-only: %v, %q", err, req.Old)
+	}
+	c.ref["a"] = "3"
+	if err := c.check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKVUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path, nil)
+	if err := db.Update(&UpdateReq{Key: []byte("k"), Val: []byte("1"), Mode: MODE_INSERT_ONLY}); err != nil {
+		t.Fatal(err)
+	}
+	req := &UpdateReq{Key: []byte("k"), Val: []byte("2"), Mode: MODE_CAS, Expect: []byte("0")}
+	if err := db.Update(req); err != ErrValueMismatch {
+		t.Fatalf("CAS mismatch: %v", err)
+	}
+	req.Expect = req.Old // retry with the current value
+	if err := db.Update(req); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+	db = openTestKV(t, path, nil)
+	if val, _, _ := db.Get([]byte("k")); string(val) != "2" {
+		t.Fatalf("got %q", val)
+	}
+}
@@ -0,0 +1,104 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// a page or a value that fails its checks when read
+var ErrCorrupt = errors.New("corrupt database")
+
+// the reads deep in the tree have no error to return: a corruption found
+// there is raised as a panic and turned back into an error by catchCorrupt
+type corruptError struct {
+	err error
+}
+
+func corrupt(format string, args ...any) {
+	panic(corruptError{fmt.Errorf("%w: "+format, append([]any{ErrCorrupt}, args...)...)})
+}
+
+// deferred by the API, other panics are bugs and carry on
+func catchCorrupt(err *error) {
+	if p := recover(); p != nil {
+		ce, ok := p.(corruptError)
+		if !ok {
+			panic(p)
+		}
+		*err = ce.err
+	}
+}
+
+// check the structure of the last committed tree
+func (db *DB) Verify() (err error) {
+	defer catchCorrupt(&err)
+	tree := db.pin()
+	defer db.unpin(tree.store)
+	return tree.Verify()
+}
+
+// check the structural invariants of the whole tree
+func (tree *BTree) Verify() error {
+	if tree.root == 0 {
+		return nil // empty tree
+	}
+
+	root, err := decodeNode(tree.get(tree.root))
+	if err != nil {
+		return fmt.Errorf("root %d: %w", tree.root, err)
+	}
+	if root.nkeys() == 0 || len(root.getKey(0)) != 0 {
+		return fmt.Errorf("root %d: the first key is not the dummy key", tree.root)
+	}
+
+	leafDepth := -1
+	return verifyNode(tree, tree.root, root, nil, 0, &leafDepth)
+}
+
+// check a node whose keys must not be less than `lo`,
+// and whose leaves must all sit at the same depth
+func verifyNode(tree *BTree, ptr uint64, node BNode, lo []byte, depth int, leafDepth *int) error {
+	node, err := decodeNode(node)
+	if err != nil {
+		return fmt.Errorf("node %d: %w", ptr, err)
+	}
+	if node.nkeys() == 0 {
+		return fmt.Errorf("node %d: no keys", ptr)
+	}
+	if node.nbytes() > BTREE_PAGE_SIZE {
+		return fmt.Errorf("node %d: %d bytes do not fit in a page", ptr, node.nbytes())
+	}
+	if !bytes.Equal(node.getKey(0), lo) {
+		return fmt.Errorf("node %d: first key %q does not match the parent key %q", ptr, node.getKey(0), lo)
+	}
+	for i := uint16(1); i < node.nkeys(); i++ {
+		if tree.compare(node.getKey(i-1), node.getKey(i)) >= 0 {
+			return fmt.Errorf("node %d: keys %d and %d are out of order", ptr, i-1, i)
+		}
+	}
+
+	switch node.btype() {
+	case BNODE_LEAF:
+		if *leafDepth < 0 {
+			*leafDepth = depth
+		}
+		if *leafDepth != depth {
+			return fmt.Errorf("node %d: leaf at depth %d, expect %d", ptr, depth, *leafDepth)
+		}
+	case BNODE_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if len(node.getVal(i)) != 0 {
+				return fmt.Errorf("node %d: internal node has a value at %d", ptr, i)
+			}
+			kptr := node.getPtr(i)
+			err := verifyNode(tree, kptr, tree.get(kptr), node.getKey(i), depth+1, leafDepth)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("node %d: bad node type %d", ptr, node.btype())
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package godb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// output formats of Dump
+type DumpFormat string
+
+const (
+	DUMP_DOT  DumpFormat = "dot"  // a Graphviz digraph
+	DUMP_JSON DumpFormat = "json" // nested JSON objects
+)
+
+// write the structure of the last committed tree
+func (db *DB) Dump(w io.Writer, format DumpFormat) error {
+	tree := db.pin()
+	defer db.unpin(tree.store)
+	return tree.Dump(w, format)
+}
+
+// write the structure of the tree, each node with its type, keys and kids
+func (tree *BTree) Dump(w io.Writer, format DumpFormat) error {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case DUMP_DOT:
+		fmt.Fprintln(bw, "digraph btree {")
+		fmt.Fprintln(bw, "  node [shape=record];")
+		if tree.root != 0 {
+			dumpDOT(tree, bw, tree.root)
+		}
+		fmt.Fprintln(bw, "}")
+	case DUMP_JSON:
+		var root any
+		if tree.root != 0 {
+			root = dumpJSON(tree, tree.root)
+		}
+		enc := json.NewEncoder(bw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(root); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown dump format %q", format)
+	}
+	return bw.Flush()
+}
+
+// a node is a record whose fields are the keys; links start from the keys
+func dumpDOT(tree *BTree, w io.Writer, ptr uint64) {
+	node := BNode(tree.get(ptr))
+	fields := []string{fmt.Sprintf("%s #%d", nodeTypeName(node), ptr)}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		fields = append(fields, fmt.Sprintf("<k%d> %s", i, dotEscape(printableKey(node.getKey(i)))))
+	}
+	fmt.Fprintf(w, "  n%d [label=\"{%s}\"];\n", ptr, strings.Join(fields, "|"))
+
+	if node.btype() != BNODE_NODE {
+		return
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kptr := node.getPtr(i)
+		fmt.Fprintf(w, "  n%d:k%d -> n%d;\n", ptr, i, kptr)
+		dumpDOT(tree, w, kptr)
+	}
+}
+
+type jsonNode struct {
+	Page uint64      `json:"page"`
+	Type string      `json:"type"`
+	Keys []string    `json:"keys"`
+	Kids []*jsonNode `json:"kids,omitempty"`
+}
+
+func dumpJSON(tree *BTree, ptr uint64) *jsonNode {
+	node := BNode(tree.get(ptr))
+	out := &jsonNode{Page: ptr, Type: nodeTypeName(node), Keys: []string{}}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		out.Keys = append(out.Keys, printableKey(node.getKey(i)))
+		if node.btype() == BNODE_NODE {
+			out.Kids = append(out.Kids, dumpJSON(tree, node.getPtr(i)))
+		}
+	}
+	return out
+}
+
+func nodeTypeName(node BNode) string {
+	switch node.btype() {
+	case BNODE_NODE:
+		return "node"
+	case BNODE_LEAF:
+		return "leaf"
+	default:
+		return fmt.Sprintf("bad type %d", node.btype())
+	}
+}
+
+// keys may be binary, show them as Go strings
+func printableKey(key []byte) string {
+	return strconv.Quote(string(key))
+}
+
+// escape the special characters of record labels
+func dotEscape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`, `"`, `\"`, `{`, `\{`, `}`, `\}`,
+		`|`, `\|`, `<`, `\<`, `>`, `\>`, ` `, `\ `,
+	).Replace(s)
+}
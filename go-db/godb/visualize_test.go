@@ -0,0 +1,107 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// verify the tree, on failure draw it to a file to look at
+func checkTree(t *testing.T, tree *BTree) {
+	t.Helper()
+	err := tree.Verify()
+	if err == nil {
+		return
+	}
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()) + ".dot"
+	path := filepath.Join(os.TempDir(), name)
+	if fp, ferr := os.Create(path); ferr == nil {
+		if tree.Dump(fp, DUMP_DOT) == nil {
+			t.Logf("tree drawn to %s", path)
+		}
+		fp.Close()
+	}
+	t.Fatal(err)
+}
+
+func TestDumpDOT(t *testing.T) {
+	c := newC()
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("key|%d", i), "v")
+	}
+	checkTree(t, &c.tree)
+
+	var buf bytes.Buffer
+	if err := c.tree.Dump(&buf, DUMP_DOT); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "digraph btree {") || !strings.HasSuffix(out, "}\n") {
+		t.Fatal("not a digraph")
+	}
+	stats := c.tree.Stats()
+	if n := strings.Count(out, "[label="); n != stats.Internal+stats.Leaves {
+		t.Fatalf("%d nodes drawn", n)
+	}
+	if n := strings.Count(out, " -> "); n != stats.Internal+stats.Leaves-1 {
+		t.Fatalf("%d edges drawn", n)
+	}
+	if !strings.Contains(out, `\"key\|999\"`) {
+		t.Fatal("keys are not escaped")
+	}
+	root := fmt.Sprintf("n%d [label=\"{node #%d|<k0> \\\"\\\"|", c.tree.root, c.tree.root)
+	if !strings.Contains(out, root) {
+		t.Fatalf("root not found:\n%s", out[:200])
+	}
+}
+
+func TestDumpJSON(t *testing.T) {
+	c := newC()
+	var buf bytes.Buffer
+	if err := c.tree.Dump(&buf, DUMP_JSON); err != nil || buf.String() != "null\n" {
+		t.Fatalf("empty tree: %q, %v", buf.String(), err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("key%d", i), "v")
+	}
+	buf.Reset()
+	if err := c.tree.Dump(&buf, DUMP_JSON); err != nil {
+		t.Fatal(err)
+	}
+	var root jsonNode
+	if err := json.Unmarshal(buf.Bytes(), &root); err != nil {
+		t.Fatal(err)
+	}
+
+	// walk the decoded tree against the pages
+	var walk func(n *jsonNode) int
+	walk = func(n *jsonNode) int {
+		node := BNode(c.tree.get(n.Page))
+		if n.Type != nodeTypeName(node) || len(n.Keys) != int(node.nkeys()) {
+			t.Fatalf("page %d: %s with %d keys", n.Page, n.Type, len(n.Keys))
+		}
+		if node.btype() == BNODE_LEAF {
+			return len(n.Keys)
+		}
+		total := 0
+		for i, kid := range n.Kids {
+			if kid.Page != node.getPtr(uint16(i)) {
+				t.Fatalf("page %d: kid %d is %d", n.Page, i, kid.Page)
+			}
+			total += walk(kid)
+		}
+		return total
+	}
+	if root.Page != c.tree.root || walk(&root) != len(c.ref)+1 {
+		t.Fatal("the JSON doesn't cover the tree")
+	}
+
+	if err := c.tree.Dump(&buf, "svg"); err == nil {
+		t.Fatal("unknown format accepted")
+	}
+}
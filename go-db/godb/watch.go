@@ -0,0 +1,227 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// the number of events a watcher can fall behind before it's dropped
+const WATCH_BUFFER = 1024
+
+const (
+	EVENT_INSERT = 1 // a new key
+	EVENT_UPDATE = 2 // an existing key was overwritten
+	EVENT_DELETE = 3 // a key was removed
+)
+
+// a committed change of a key
+type Event struct {
+	Type int
+	Key  []byte
+	Old  []byte // the value before the commit, nil for EVENT_INSERT
+	New  []byte // the value after the commit, nil for EVENT_DELETE
+}
+
+var ErrWatchOverflow = errors.New("watcher fell behind, events were dropped")
+
+// receives the committed changes of the keys with a prefix, in commit order.
+// a watcher that falls WATCH_BUFFER events behind is closed instead of
+// blocking the writers; C is then closed and Err returns ErrWatchOverflow.
+type Watcher struct {
+	C      <-chan Event
+	ch     chan Event
+	db     *DB
+	prefix []byte
+	err    error
+}
+
+// the watchers of a database
+type watchList struct {
+	sync.Mutex
+	list map[*Watcher]struct{}
+}
+
+// watch the keys with a prefix, an empty prefix watches everything. the
+// prefix is matched in the key order of the database: with CaseInsensitive,
+// a watch on "user:" also gets "USER:x".
+func (db *DB) Watch(prefix []byte) *Watcher {
+	ch := make(chan Event, WATCH_BUFFER)
+	w := &Watcher{C: ch, ch: ch, db: db, prefix: bytes.Clone(prefix)}
+
+	db.watch.Lock()
+	defer db.watch.Unlock()
+	if db.watch.list == nil {
+		db.watch.list = map[*Watcher]struct{}{}
+	}
+	db.watch.list[w] = struct{}{}
+	return w
+}
+
+// stop watching; C is closed after the pending events
+func (w *Watcher) Close() {
+	w.db.watch.Lock()
+	defer w.db.watch.Unlock()
+	w.db.unwatch(w, nil)
+}
+
+// why C was closed: nil if by Close, or ErrWatchOverflow
+func (w *Watcher) Err() error {
+	w.db.watch.Lock()
+	defer w.db.watch.Unlock()
+	return w.err
+}
+
+// remove a watcher and close its channel, called with the lock held
+func (db *DB) unwatch(w *Watcher, err error) {
+	if _, ok := db.watch.list[w]; !ok {
+		return // already closed
+	}
+	delete(db.watch.list, w)
+	w.err = err
+	close(w.ch)
+}
+
+// close all watchers
+func (db *DB) unwatchAll() {
+	db.watch.Lock()
+	defer db.watch.Unlock()
+	for w := range db.watch.list {
+		db.unwatch(w, nil)
+	}
+}
+
+// whether any watcher wants the key
+func (db *DB) watched(key []byte) bool {
+	db.watch.Lock()
+	defer db.watch.Unlock()
+	for w := range db.watch.list {
+		if db.hasPrefix(key, w.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the first bytes of the key are the same key as the prefix
+func (db *DB) hasPrefix(key []byte, prefix []byte) bool {
+	c := db.opts.Comparator // set once by Open
+	if c.Compare == nil {
+		return bytes.HasPrefix(key, prefix)
+	}
+	return len(key) >= len(prefix) && c.Compare(key[:len(prefix)], prefix) == 0
+}
+
+// whether any watcher wants a key in [start, end)
+func (db *DB) watchedRange(start []byte, end []byte) bool {
+	db.watch.Lock()
+	defer db.watch.Unlock()
+	if db.tree.cmp != nil {
+		// the keys with a prefix aren't contiguous in another order
+		return len(db.watch.list) > 0
+	}
+	for w := range db.watch.list {
+		// the keys with the prefix are in [prefix, prefixEnd(prefix))
+		pend := prefixEnd(w.prefix)
+		if (end == nil || bytes.Compare(w.prefix, end) < 0) &&
+			(pend == nil || bytes.Compare(start, pend) < 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// the smallest key greater than all keys with the prefix, nil if none
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil
+	}
+	end[len(end)-1]++
+	return end
+}
+
+// a change to be delivered after the commit;
+// the values are copied since they may point into the mmap
+func newEvent(etype int, key []byte, old []byte, new []byte) Event {
+	return Event{Type: etype, Key: bytes.Clone(key), Old: bytes.Clone(old), New: bytes.Clone(new)}
+}
+
+// deliver the events of a commit, called by the writer after the commit.
+// sending never blocks, a full channel closes the watcher.
+func (db *DB) notify(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	db.watch.Lock()
+	defer db.watch.Unlock()
+	for w := range db.watch.list {
+		if !w.send(events) {
+			db.unwatch(w, ErrWatchOverflow)
+		}
+	}
+}
+
+// queue the matching events, false if the channel is full
+func (w *Watcher) send(events []Event) bool {
+	for _, ev := range events {
+		if !w.db.hasPrefix(ev.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// the events of deleting [start, end), collected before the deletion
+func rangeEvents(db *DB, tree *BTree, start []byte, end []byte) []Event {
+	if tree.root == 0 || !db.watchedRange(start, end) {
+		return nil
+	}
+	var events []Event
+	now := db.now().UnixNano()
+	for iter := tree.Seek(start); iter.Valid(); iter.Next() {
+		key, raw := iter.Deref()
+		if len(key) == 0 {
+			continue // the dummy key
+		}
+		if end != nil && tree.compare(key, end) >= 0 {
+			break
+		}
+		val, expire, _ := decodeVal(raw) // nil if corrupt, it's deleted anyway
+		if (expire == 0 || expire > now) && db.watched(key) {
+			events = append(events, newEvent(EVENT_DELETE, key, val, nil))
+		}
+	}
+	return events
+}
+
+// the events of a batch, collected before it's applied
+func batchEvents(db *DB, tree *BTree, ops []Op) []Event {
+	var events []Event
+	now := db.now().UnixNano()
+	for _, op := range sortOps(tree, ops) {
+		if !db.watched(op.Key) {
+			continue
+		}
+		old, ok, _, _ := lookupLive(tree, op.Key, now) // nil if corrupt
+		switch {
+		case op.Del && ok:
+			events = append(events, newEvent(EVENT_DELETE, op.Key, old, nil))
+		case op.Del:
+			// deleting a missing key is not a change
+		case ok:
+			events = append(events, newEvent(EVENT_UPDATE, op.Key, old, op.Val))
+		default:
+			events = append(events, newEvent(EVENT_INSERT, op.Key, nil, op.Val))
+		}
+	}
+	return events
+}
@@ -0,0 +1,169 @@
+package godb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// receive the queued events of a watcher
+func drainEvents(w *Watcher) []string {
+	var out []string
+	for {
+		select {
+		case ev, ok := <-w.C:
+			if !ok {
+				return append(out, "closed")
+			}
+			name := [...]string{EVENT_INSERT: "insert", EVENT_UPDATE: "update", EVENT_DELETE: "delete"}[ev.Type]
+			out = append(out, fmt.Sprintf("%s %s %q %q", name, ev.Key, ev.Old, ev.New))
+		default:
+			return out
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	defer db.Close()
+	all := db.Watch(nil)
+	users := db.Watch([]byte("user/"))
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(db.Set([]byte("user/1"), []byte("a")))
+	must(db.Set([]byte("other"), []byte("x")))
+	must(db.Set([]byte("user/1"), []byte("b")))
+	if err := db.Update(&UpdateReq{Key: []byte("user/1"), Val: []byte("c"), Mode: MODE_INSERT_ONLY}); err != ErrKeyExists {
+		t.Fatal(err)
+	}
+	must(db.ApplyBatch([]Op{
+		{Key: []byte("user/3"), Val: []byte("z")},
+		{Key: []byte("user/2"), Val: []byte("y")},
+		{Key: []byte("user/1"), Del: true},
+		{Key: []byte("user/9"), Del: true}, // missing
+	}))
+	if _, err := db.Del([]byte("user/2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Del([]byte("user/2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DeleteRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		`insert user/1 "" "a"`,
+		`update user/1 "a" "b"`,
+		`delete user/1 "b" ""`,
+		`insert user/2 "" "y"`,
+		`insert user/3 "" "z"`,
+		`delete user/2 "y" ""`,
+		`delete user/3 "z" ""`,
+	}
+	if got := drainEvents(users); fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Fatalf("prefix watcher got:\n%v", got)
+	}
+	got := drainEvents(all)
+	if len(got) != len(expect)+2 || got[1] != `insert other "" "x"` {
+		t.Fatalf("watcher of all keys got:\n%v", got)
+	}
+
+	users.Close()
+	must(db.Set([]byte("user/4"), nil))
+	if got := drainEvents(users); fmt.Sprint(got) != "[closed]" || users.Err() != nil {
+		t.Fatalf("closed watcher got %v, %v", got, users.Err())
+	}
+	users.Close() // no-op
+}
+
+func TestWatchOverflow(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), nil)
+	defer db.Close()
+	slow := db.Watch(nil)
+	fast := db.Watch(nil)
+
+	ops := make([]Op, WATCH_BUFFER+1)
+	for i := range ops {
+		ops[i] = Op{Key: []byte(fmt.Sprintf("key%05d", i)), Val: []byte("v")}
+	}
+	if err := db.ApplyBatch(ops[:WATCH_BUFFER/2]); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(drainEvents(fast)); n != WATCH_BUFFER/2 {
+		t.Fatalf("got %d events", n)
+	}
+	// the writer is never blocked by the slow watcher
+	if err := db.ApplyBatch(ops[WATCH_BUFFER/2:]); err != nil {
+		t.Fatal(err)
+	}
+
+	got := drainEvents(slow)
+	if got[len(got)-1] != "closed" || slow.Err() != ErrWatchOverflow {
+		t.Fatalf("slow watcher: %v", slow.Err())
+	}
+	if len(got)-1 > WATCH_BUFFER {
+		t.Fatalf("%d events were buffered", len(got)-1)
+	}
+	if n := len(drainEvents(fast)); n != len(ops)-WATCH_BUFFER/2 {
+		t.Fatalf("got %d events", n)
+	}
+	if fast.Err() != nil {
+		t.Fatal(fast.Err())
+	}
+}
+
+func TestWatchRange(t *testing.T) {
+	db := &DB{}
+	watch := func(prefix string, start string, end string) bool {
+		w := db.Watch([]byte(prefix))
+		defer w.Close()
+		var endKey []byte
+		if end != "-" {
+			endKey = []byte(end)
+		}
+		return db.watchedRange([]byte(start), endKey)
+	}
+	cases := []struct {
+		prefix, start, end string
+		expect             bool
+	}{
+		{"b", "a", "b", false},
+		{"b", "a", "ba", true},
+		{"b", "b", "c", true},
+		{"b", "bzz", "-", true},
+		{"b", "c", "-", false},
+		{"b\xff", "c", "-", false},
+		{"\xff", "\xff\xff", "-", true},
+		{"", "z", "-", true},
+	}
+	for _, tc := range cases {
+		if got := watch(tc.prefix, tc.start, tc.end); got != tc.expect {
+			t.Errorf("prefix %q, range [%q, %q): %v", tc.prefix, tc.start, tc.end, got)
+		}
+	}
+}
+
+// the prefix is matched in the order of the comparator
+func TestWatchComparator(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"), &Options{Comparator: CaseInsensitive})
+	w := db.Watch([]byte("user:"))
+	defer w.Close()
+	for _, key := range []string{"USER:a", "User:b", "users", "use"} {
+		if err := db.Set([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Del([]byte("user:A")); err != nil {
+		t.Fatal(err)
+	}
+	expect := `[insert USER:a "" "v" insert User:b "" "v" delete user:A "v" ""]`
+	if got := fmt.Sprint(drainEvents(w)); got != expect {
+		t.Fatalf("events: %s", got)
+	}
+}
@@ -0,0 +1,45 @@
+// Package godbtest has helpers for the tests of code that embeds godb.
+package godbtest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"db.com/m/godb"
+	"db.com/m/internal/kvtest"
+)
+
+// what Dump reads: a *godb.DB or a *godb.Tx
+type Seeker interface {
+	Seek(key []byte) *godb.Iter
+}
+
+// open a database file in a temporary directory, closed when the test ends
+func Open(t testing.TB, opts *godb.Options) *godb.DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	return kvtest.Open(t, func() (*godb.DB, error) { return godb.Open(path, opts) })
+}
+
+// fill a database with `n` keys, every 5th of them deleted again,
+// and return the reference data
+func Fill(t testing.TB, db *godb.DB, n int) map[string]string {
+	t.Helper()
+	return kvtest.Fill(t, db, n)
+}
+
+// the live KVs in order
+func Dump(store Seeker) [][2]string {
+	return kvtest.Dump(store.Seek(nil))
+}
+
+// the reference data in the order of Dump
+func Sorted(ref map[string]string) [][2]string {
+	return kvtest.Sorted(ref)
+}
+
+// fail the test unless the store holds exactly the reference data
+func Check(t testing.TB, store Seeker, ref map[string]string) {
+	t.Helper()
+	kvtest.Check(t, store.Seek(nil), ref)
+}
@@ -0,0 +1,92 @@
+// Package kvtest has the test helpers shared by the internal tests of godb
+// and by godbtest, which wraps them. it doesn't import godb, whose own tests
+// import it.
+package kvtest
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// what Fill updates: a *godb.DB
+type Writer interface {
+	Set(key []byte, val []byte) error
+	Del(key []byte) (bool, error)
+}
+
+// what Dump reads: a *godb.Iter
+type Iter interface {
+	Valid() bool
+	Deref() ([]byte, []byte)
+	Next()
+}
+
+// open a database by `open`, closed when the test ends
+func Open[DB interface{ Close() }](t testing.TB, open func() (DB, error)) DB {
+	t.Helper()
+	db, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// fill a database with `n` keys, every 5th of them deleted again,
+// and return the reference data
+func Fill(t testing.TB, db Writer, n int) map[string]string {
+	t.Helper()
+	ref := map[string]string{}
+	for i := 0; i < n; i++ {
+		key, val := fmt.Sprintf("key%06d", i*7%n), fmt.Sprintf("val%d", i)
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		ref[key] = val
+	}
+	for i := 0; i < n; i += 5 {
+		key := fmt.Sprintf("key%06d", i)
+		if _, err := db.Del([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		delete(ref, key)
+	}
+	return ref
+}
+
+// the KVs from an iterator on
+func Dump(iter Iter) [][2]string {
+	var kvs [][2]string
+	for ; iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		kvs = append(kvs, [2]string{string(key), string(val)})
+	}
+	return kvs
+}
+
+// the reference data in the order of Dump
+func Sorted(ref map[string]string) [][2]string {
+	var kvs [][2]string
+	for k, v := range ref {
+		kvs = append(kvs, [2]string{k, v})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i][0] < kvs[j][0] })
+	return kvs
+}
+
+// fail the test unless the iterator yields exactly the reference data
+func Check(t testing.TB, iter Iter, ref map[string]string) {
+	t.Helper()
+	got, expect := Dump(iter), Sorted(ref)
+	for i := 0; i < len(got) || i < len(expect); i++ {
+		switch {
+		case i >= len(expect):
+			t.Fatalf("extra key %q", got[i][0])
+		case i >= len(got):
+			t.Fatalf("missing key %q", expect[i][0])
+		case got[i] != expect[i]:
+			t.Fatalf("got %q = %q, expect %q = %q", got[i][0], got[i][1], expect[i][0], expect[i][1])
+		}
+	}
+}
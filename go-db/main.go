@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"db.com/m/godb"
+)
+
+// command line tools for database files:
+//
+//	go-db backup -db FILE [-o DUMP]
+//	go-db restore -db FILE [-i DUMP] [-comparator NAME]
+//	go-db compact -db FILE
+//	go-db stats -db FILE
+//	go-db tree -db FILE [-format dot|json]
+//	go-db serve -db FILE [-addr ADDR] [-comparator NAME] [-metrics ADDR]
+//	            [-replicate ADDR | -follow ADDR]
+//
+// the dump is written to stdout or read from stdin if no file is given.
+// the key of an encrypted database is read from $GODB_KEY in hex.
+// the comparator of a new file is one of the built-in key orders.
+
+var commands = map[string]func(args []string) error{
+	"backup":  cmdBackup,
+	"restore": cmdRestore,
+	"compact": cmdCompact,
+	"stats":   cmdStats,
+	"tree":    cmdTree,
+	"serve":   cmdServe,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: go-db <command> [flags]")
+		fmt.Fprintln(os.Stderr, "commands: backup, restore, compact, stats, tree, serve")
+		os.Exit(2)
+	}
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "go-db:", err)
+		os.Exit(1)
+	}
+}
+
+// open an existing database file
+func openDB(path string) (*godb.DB, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no database file, use -db")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return openKV(path, &godb.Options{})
+}
+
+// open or create a database file
+func openKV(path string, opts *godb.Options) (*godb.DB, error) {
+	if err := envKey(opts); err != nil {
+		return nil, err
+	}
+	return godb.Open(path, opts)
+}
+
+// the encryption key from GODB_KEY in hex, if set
+func envKey(opts *godb.Options) error {
+	if key := os.Getenv("GODB_KEY"); key != "" {
+		var err error
+		if opts.EncryptionKey, err = hex.DecodeString(key); err != nil {
+			return fmt.Errorf("GODB_KEY: %w", err)
+		}
+	}
+	return nil
+}
+
+// a built-in comparator, the zero one for the byte order
+func lookupComparator(name string) (godb.Comparator, error) {
+	if name == "" {
+		return godb.Comparator{}, nil
+	}
+	comparator, ok := godb.ComparatorByName(name)
+	if !ok {
+		return comparator, fmt.Errorf("unknown comparator %q", name)
+	}
+	return comparator, nil
+}
+
+func cmdBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	path := flags.String("db", "", "the database file")
+	out := flags.String("o", "", "the dump file, defaults to stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB(*path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		fp, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		w = fp
+	}
+	count, err := db.Backup(w)
+	if err != nil {
+		return err
+	}
+	if fp, ok := w.(*os.File); ok && fp != os.Stdout {
+		if err := fp.Sync(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d keys backed up\n", count)
+	return nil
+}
+
+func cmdRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	path := flags.String("db", "", "the database file to create")
+	in := flags.String("i", "", "the dump file, defaults to stdin")
+	order := flags.String("comparator", "", "the key order of the dump, read from it if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return fmt.Errorf("no database file, use -db")
+	}
+	comparator, err := lookupComparator(*order)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		fp, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		r = fp
+	}
+	opts := &godb.Options{Comparator: comparator}
+	if err := envKey(opts); err != nil {
+		return err
+	}
+	count, err := godb.Restore(*path, r, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d keys restored\n", count)
+	return nil
+}
+
+func cmdCompact(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	path := flags.String("db", "", "the database file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB(*path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	before := db.Stats().FileSize
+	if err := db.Compact(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "compacted from %d to %d bytes\n", before, db.Stats().FileSize)
+	return nil
+}
+
+func cmdStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	path := flags.String("db", "", "the database file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB(*path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats := db.Stats()
+	fmt.Printf("file:     %d bytes, %d pages used\n", stats.FileSize, stats.Pages)
+	fmt.Printf("height:   %d\n", stats.Height)
+	fmt.Printf("nodes:    %d internal, %d leaves\n", stats.Internal, stats.Leaves)
+	fmt.Printf("keys:     %d, %d internal\n", stats.Keys, stats.Reserved)
+	for i, level := range stats.Levels {
+		fmt.Printf("level %d:  %d nodes, %d keys, %.1f%% full\n",
+			i, level.Nodes, level.Keys, 100*level.AvgFill())
+	}
+	printHistogram("key sizes", &stats.KeySizes)
+	printHistogram("val sizes", &stats.ValSizes)
+	return nil
+}
+
+func printHistogram(name string, h *godb.SizeHistogram) {
+	fmt.Printf("%s:\n", name)
+	for i, n := range h {
+		if n == 0 {
+			continue
+		}
+		lo, hi := h.Bucket(i)
+		fmt.Printf("  %5d - %-5d %d\n", lo, hi, n)
+	}
+}
+
+func cmdTree(args []string) error {
+	flags := flag.NewFlagSet("tree", flag.ContinueOnError)
+	path := flags.String("db", "", "the database file")
+	format := flags.String("format", string(godb.DUMP_DOT), "dot or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB(*path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Dump(os.Stdout, godb.DumpFormat(*format))
+}
+
+func cmdServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	path := flags.String("db", "", "the database file, created if missing")
+	addr := flags.String("addr", "127.0.0.1:6380", "the address to listen on")
+	sweep := flags.Duration("sweep", time.Second, "how often to delete expired keys")
+	order := flags.String("comparator", "", "the key order of a new file, bytes if empty")
+	metrics := flags.String("metrics", "", "the address of the HTTP /metrics endpoint, none if empty")
+	replicate := flags.String("replicate", "", "the address to serve the followers on, none if empty")
+	follow := flags.String("follow", "", "the address of a primary to follow as a read-only replica")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return fmt.Errorf("no database file, use -db")
+	}
+	if *replicate != "" && *follow != "" {
+		return fmt.Errorf("-replicate and -follow are exclusive")
+	}
+	comparator, err := lookupComparator(*order)
+	if err != nil {
+		return err
+	}
+
+	opts := &godb.Options{SweepEvery: *sweep, Comparator: comparator}
+	if *metrics != "" {
+		registry := godb.NewRegistry()
+		opts.Metrics = registry
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		mln, err := net.Listen("tcp", *metrics)
+		if err != nil {
+			return err
+		}
+		defer mln.Close()
+		go func() { _ = http.Serve(mln, mux) }()
+		fmt.Fprintf(os.Stderr, "metrics on http://%s/metrics\n", mln.Addr())
+	}
+	db, err := openKV(*path, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+
+	if *replicate != "" {
+		rln, err := net.Listen("tcp", *replicate)
+		if err != nil {
+			return err
+		}
+		primary := &godb.Primary{DB: db}
+		go func() { _ = primary.Serve(rln) }()
+		defer primary.Shutdown()
+		fmt.Fprintf(os.Stderr, "followers on %s\n", rln.Addr())
+	}
+	if *follow != "" {
+		follower := godb.Follow(db, *follow)
+		defer follower.Close()
+		fmt.Fprintf(os.Stderr, "following %s\n", *follow)
+	}
+
+	srv := &godb.Server{DB: db}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown()
+	}()
+	fmt.Fprintf(os.Stderr, "listening on %s\n", ln.Addr())
+	if err := srv.Serve(ln); err != godb.ErrServerClosed {
+		return err
+	}
+	return nil
+}